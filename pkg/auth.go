@@ -0,0 +1,429 @@
+package pkg
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The authentication modes of the config.
+const (
+	AUTH_MODE_NONE    string = "none"    // every caller is upgraded and gets a random ID
+	AUTH_MODE_JWT     string = "jwt"     // callers need a signed JWT and get its subject as ID
+	AUTH_MODE_API_KEY string = "api-key" // callers need one of the static API keys and get its subject as ID
+)
+
+// ErrUnauthenticated is returned by authenticators for requests that don't carry valid credentials.
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// Identity is who an authenticator found behind a request. The Subject becomes the ID of the member and the Roles,
+// when there are any, replace the configured default roles of the member.
+type Identity struct {
+	Subject string
+	Roles   Roles
+	Claims  map[string]any
+}
+
+// An Authenticator is consulted before a request is upgraded to a websocket connection. A request it returns an error
+// for is answered with 401 and never upgraded.
+type Authenticator interface {
+	Authenticate(r *http.Request) (Identity, error)
+}
+
+// NewAuthenticator builds the authenticator selected by the config. It returns nil for AUTH_MODE_NONE.
+func NewAuthenticator(config *Config) (Authenticator, error) {
+	switch config.AuthMode {
+	case AUTH_MODE_NONE, "":
+		return nil, nil
+	case AUTH_MODE_JWT:
+		authenticator, err := LoadJWTAuthenticator(config.JWTAlgorithm, config.JWTKeyFile, config.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticator.Issuer = config.JWTIssuer
+		authenticator.Audience = config.JWTAudience
+		return authenticator, nil
+	case AUTH_MODE_API_KEY:
+		return LoadAPIKeyAuthenticator(config.APIKeysFile)
+	}
+	return nil, fmt.Errorf("unknown auth mode %q", config.AuthMode)
+}
+
+// bearerToken returns the token of the 'Authorization: Bearer' header or, as browsers can't set headers on websocket
+// requests, the 'access_token' query parameter.
+func bearerToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// jwtKey is a key that verifies the signature of tokens signed with its algorithm and nothing else, so that an
+// RS256 public key can never be used as an HS256 secret.
+type jwtKey struct {
+	algorithm string
+	key       any // []byte for HS256 and *rsa.PublicKey for RS256
+}
+
+// JWTAuthenticator accepts requests carrying a JWT signed with HS256 or RS256. Keys are looked up by the 'kid' of the
+// token header and tokens without a 'kid' are verified with the key registered under the empty name. Issuer and
+// Audience are only checked when they are set.
+type JWTAuthenticator struct {
+	Issuer   string
+	Audience string
+	Leeway   time.Duration // clock skew tolerated when checking 'exp' and 'nbf'
+	keys     map[string]jwtKey
+	now      func() time.Time
+}
+
+func newJWTAuthenticator() *JWTAuthenticator {
+	return &JWTAuthenticator{
+		Leeway: 30 * time.Second,
+		keys:   make(map[string]jwtKey),
+		now:    time.Now,
+	}
+}
+
+// NewHS256Authenticator verifies tokens signed with the shared secret.
+func NewHS256Authenticator(secret []byte) *JWTAuthenticator {
+	authenticator := newJWTAuthenticator()
+	authenticator.keys[""] = jwtKey{"HS256", secret}
+	return authenticator
+}
+
+// NewRS256Authenticator verifies tokens signed with the private half of the key.
+func NewRS256Authenticator(key *rsa.PublicKey) *JWTAuthenticator {
+	authenticator := newJWTAuthenticator()
+	authenticator.keys[""] = jwtKey{"RS256", key}
+	return authenticator
+}
+
+// LoadJWTAuthenticator reads the verification keys either from a key file, which holds the shared secret for HS256
+// or a PEM encoded public key for RS256, or from a JWKS file. Keys of both files are used when both are given.
+func LoadJWTAuthenticator(algorithm string, keyFile string, jwksFile string) (*JWTAuthenticator, error) {
+	authenticator := newJWTAuthenticator()
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the JWT key file: %w", err)
+		}
+		switch algorithm {
+		case "HS256":
+			authenticator.keys[""] = jwtKey{"HS256", []byte(strings.TrimSpace(string(data)))}
+		case "RS256":
+			key, err := parseRSAPublicKey(data)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse the JWT key file %s: %w", keyFile, err)
+			}
+			authenticator.keys[""] = jwtKey{"RS256", key}
+		default:
+			return nil, fmt.Errorf("unsupported JWT algorithm %q", algorithm)
+		}
+	}
+	if jwksFile != "" {
+		data, err := os.ReadFile(jwksFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the JWKS file: %w", err)
+		}
+		if err := authenticator.addJWKS(data); err != nil {
+			return nil, fmt.Errorf("could not parse the JWKS file %s: %w", jwksFile, err)
+		}
+	}
+	if len(authenticator.keys) == 0 {
+		return nil, errors.New("JWT authentication needs a key file or a JWKS file")
+	}
+	return authenticator, nil
+}
+
+func parseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if rsaKey, ok := key.(*rsa.PublicKey); ok {
+			return rsaKey, nil
+		}
+		return nil, errors.New("the public key is not an RSA key")
+	case "CERTIFICATE":
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if rsaKey, ok := certificate.PublicKey.(*rsa.PublicKey); ok {
+			return rsaKey, nil
+		}
+		return nil, errors.New("the certificate does not hold an RSA key")
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+// addJWKS registers the RSA ('kty' RSA) and HMAC ('kty' oct) keys of a JSON Web Key Set under their 'kid'.
+func (authenticator *JWTAuthenticator) addJWKS(data []byte) error {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return err
+	}
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		switch key.Kty {
+		case "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(key.N)
+			if err != nil {
+				return fmt.Errorf("invalid modulus of key %q: %w", key.Kid, err)
+			}
+			e, err := base64.RawURLEncoding.DecodeString(key.E)
+			if err != nil {
+				return fmt.Errorf("invalid exponent of key %q: %w", key.Kid, err)
+			}
+			exponent := new(big.Int).SetBytes(e)
+			if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+				return fmt.Errorf("invalid exponent of key %q", key.Kid)
+			}
+			authenticator.keys[key.Kid] = jwtKey{"RS256", &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}}
+		case "oct":
+			secret, err := base64.RawURLEncoding.DecodeString(key.K)
+			if err != nil {
+				return fmt.Errorf("invalid secret of key %q: %w", key.Kid, err)
+			}
+			authenticator.keys[key.Kid] = jwtKey{"HS256", secret}
+		default:
+			return fmt.Errorf("unsupported key type %q of key %q", key.Kty, key.Kid)
+		}
+	}
+	return nil
+}
+
+func (authenticator *JWTAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return Identity{}, fmt.Errorf("%w: no bearer token", ErrUnauthenticated)
+	}
+	claims, err := authenticator.Verify(token)
+	if err != nil {
+		return Identity{}, err
+	}
+	subject, _ := claims["sub"].(string)
+	return Identity{Subject: subject, Roles: rolesClaim(claims["roles"]), Claims: claims}, nil
+}
+
+// rolesClaim reads the 'roles' claim, which is either a list of strings or a space separated string.
+func rolesClaim(claim any) Roles {
+	var roles Roles
+	switch claim := claim.(type) {
+	case string:
+		roles = strings.Fields(claim)
+	case []any:
+		for _, role := range claim {
+			if role, ok := role.(string); ok {
+				roles = append(roles, role)
+			}
+		}
+	}
+	return roles
+}
+
+// Verify checks the signature and the registered claims of the token and returns all of its claims.
+func (authenticator *JWTAuthenticator) Verify(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", ErrUnauthenticated)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: malformed token header: %v", ErrUnauthenticated, err)
+	}
+	key, ok := authenticator.keys[header.Kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrUnauthenticated, header.Kid)
+	}
+	if header.Alg != key.algorithm {
+		return nil, fmt.Errorf("%w: algorithm %q doesn't match the key", ErrUnauthenticated, header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", ErrUnauthenticated)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	switch key := key.key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, fmt.Errorf("%w: invalid signature", ErrUnauthenticated)
+		}
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return nil, fmt.Errorf("%w: invalid signature", ErrUnauthenticated)
+		}
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: malformed token claims: %v", ErrUnauthenticated, err)
+	}
+	if err := authenticator.validate(claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+	return claims, nil
+}
+
+// validate checks the time, issuer, audience and subject claims.
+func (authenticator *JWTAuthenticator) validate(claims map[string]any) error {
+	now := authenticator.now()
+	if exp, ok := claims["exp"].(float64); ok && now.Add(-authenticator.Leeway).After(time.Unix(int64(exp), 0)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(authenticator.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token not valid yet")
+	}
+	if authenticator.Issuer != "" && claims["iss"] != authenticator.Issuer {
+		return fmt.Errorf("token issued by %v instead of %s", claims["iss"], authenticator.Issuer)
+	}
+	if authenticator.Audience != "" && !hasAudience(claims["aud"], authenticator.Audience) {
+		return fmt.Errorf("token is not meant for %s", authenticator.Audience)
+	}
+	if subject, _ := claims["sub"].(string); subject == "" {
+		return errors.New("token has no subject")
+	}
+	return nil
+}
+
+// hasAudience reports whether the 'aud' claim, which is either a string or a list of strings, contains the audience.
+func hasAudience(claim any, audience string) bool {
+	switch claim := claim.(type) {
+	case string:
+		return claim == audience
+	case []any:
+		for _, candidate := range claim {
+			if candidate == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, value any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+// APIKeyAuthenticator accepts requests carrying one of a fixed set of API keys in the 'X-API-Key' header or the
+// 'api_key' query parameter. Only the SHA-256 hashes of the keys are kept so that looking them up doesn't leak them
+// through timing.
+type APIKeyAuthenticator struct {
+	identities map[[sha256.Size]byte]Identity
+}
+
+// NewAPIKeyAuthenticator accepts the keys of the map and gives callers the subject the key maps to.
+func NewAPIKeyAuthenticator(keys map[string]string) *APIKeyAuthenticator {
+	identities := make(map[string]Identity, len(keys))
+	for key, subject := range keys {
+		identities[key] = Identity{Subject: subject}
+	}
+	return newAPIKeyAuthenticator(identities)
+}
+
+func newAPIKeyAuthenticator(identities map[string]Identity) *APIKeyAuthenticator {
+	authenticator := &APIKeyAuthenticator{identities: make(map[[sha256.Size]byte]Identity, len(identities))}
+	for key, identity := range identities {
+		authenticator.identities[sha256.Sum256([]byte(key))] = identity
+	}
+	return authenticator
+}
+
+// apiKey is an entry of the API keys file, which is either just the subject or the subject with its roles.
+type apiKey Identity
+
+func (key *apiKey) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		key.Subject = node.Value
+		return nil
+	}
+	var entry struct {
+		Subject string `yaml:"subject"`
+		Roles   Roles  `yaml:"roles"`
+	}
+	if err := node.Decode(&entry); err != nil {
+		return err
+	}
+	key.Subject, key.Roles = entry.Subject, entry.Roles
+	return nil
+}
+
+// LoadAPIKeyAuthenticator reads the keys from a YAML file mapping every key either to its subject or to a map with
+// the 'subject' and its 'roles'.
+func LoadAPIKeyAuthenticator(path string) (*APIKeyAuthenticator, error) {
+	if path == "" {
+		return nil, errors.New("API key authentication needs an API keys file")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the API keys file: %w", err)
+	}
+	keys := make(map[string]apiKey)
+	if err := yaml.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("could not parse the API keys file %s: %w", path, err)
+	}
+	identities := make(map[string]Identity, len(keys))
+	for key, identity := range keys {
+		identities[key] = Identity(identity)
+	}
+	return newAPIKeyAuthenticator(identities), nil
+}
+
+func (authenticator *APIKeyAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		key = r.URL.Query().Get("api_key")
+	}
+	if key == "" {
+		return Identity{}, fmt.Errorf("%w: no API key", ErrUnauthenticated)
+	}
+	identity, ok := authenticator.identities[sha256.Sum256([]byte(key))]
+	if !ok || identity.Subject == "" {
+		return Identity{}, fmt.Errorf("%w: unknown API key", ErrUnauthenticated)
+	}
+	return identity, nil
+}
@@ -0,0 +1,358 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The kinds of buses, see NewBus.
+const (
+	BUS_NONE  string = "none"  // the server runs on its own
+	BUS_REDIS string = "redis" // the nodes share their rooms through Redis pub/sub at RedisAddress
+)
+
+// busBuffer is how many messages a subscription holds before further ones are dropped.
+const busBuffer = 1024
+
+// A Bus connects the nodes of a cluster so that their groups of the same name form one room. Every group publishes the
+// broadcasts and DMs it routes and the members joining and leaving it to the topic of its room and subscribes to that
+// topic for the ones of the other nodes. Messages are delivered to every subscriber of the topic on every node,
+// including the node that published them, and may be dropped when a subscriber doesn't keep up.
+//
+// Buses are used by many groups at once and have to be safe for concurrent use.
+type Bus interface {
+	// Publish sends the message to the subscribers of the topic.
+	Publish(topic string, message []byte) error
+	// Subscribe returns a subscription to the messages published to the topic from then on.
+	Subscribe(topic string) (*Subscription, error)
+	Close() error
+}
+
+// NewBus returns the bus the config asks for, which is nil for BUS_NONE.
+func NewBus(config *Config) (Bus, error) {
+	switch config.Bus {
+	case BUS_NONE, "":
+		return nil, nil
+	case BUS_REDIS:
+		return OpenRedisBus(config.RedisAddress, config.RedisPassword, config.WriteDeadline)
+	}
+	return nil, fmt.Errorf("bus must be none or redis but is %q", config.Bus)
+}
+
+// Subscription receives the messages of a topic on C until it is closed. C is never closed.
+type Subscription struct {
+	C      <-chan []byte
+	cancel func()
+	once   sync.Once
+}
+
+// Close stops the delivery of messages to the subscription.
+func (subscription *Subscription) Close() {
+	subscription.once.Do(subscription.cancel)
+}
+
+// subscribers are the channels of the subscriptions to a topic.
+type subscribers map[chan []byte]struct{}
+
+// deliver hands the message to every subscriber without blocking, dropping it for the ones that are full.
+func (subscribers subscribers) deliver(topic string, message []byte) {
+	for messages := range subscribers {
+		select {
+		case messages <- message:
+		default:
+			slog.Warn("Dropping a message of the bus as a subscriber is not keeping up", "topic", topic)
+		}
+	}
+}
+
+// MemoryBus is a bus within the process, which lets many registries in one process (such as in tests) act as nodes of
+// a cluster.
+type MemoryBus struct {
+	mu     sync.Mutex
+	topics map[string]subscribers
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{topics: make(map[string]subscribers)}
+}
+
+func (bus *MemoryBus) Publish(topic string, message []byte) error {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	bus.topics[topic].deliver(topic, message)
+	return nil
+}
+
+func (bus *MemoryBus) Subscribe(topic string) (*Subscription, error) {
+	messages := make(chan []byte, busBuffer)
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	if bus.topics[topic] == nil {
+		bus.topics[topic] = make(subscribers)
+	}
+	bus.topics[topic][messages] = struct{}{}
+	return &Subscription{C: messages, cancel: func() {
+		bus.mu.Lock()
+		defer bus.mu.Unlock()
+
+		delete(bus.topics[topic], messages)
+		if len(bus.topics[topic]) == 0 {
+			delete(bus.topics, topic)
+		}
+	}}, nil
+}
+
+func (bus *MemoryBus) Close() error {
+	return nil
+}
+
+// The kinds of messages the groups publish on the bus.
+const (
+	busBroadcast   = "broadcast"   // a broadcast in the room
+	busDM          = "dm"          // a DM or read receipt to a member on another node
+	busDelivered   = "delivered"   // the member got the DM, the answer to busDM
+	busUndelivered = "undelivered" // the member did not get the DM for the reason in Code, the answer to busDM
+	busModerated   = "moderated"   // an admin muted, unmuted, banned, unbanned or kicked a member of the room
+	busJoined      = "joined"      // members joined the room on the node
+	busLeft        = "left"        // members left the room on the node
+	busRoster      = "roster"      // all the members of the room on the node, sent when asked for with busSync
+	busSync        = "sync"        // asks the other nodes for their rosters
+)
+
+// busMessage is what the groups publish on the bus.
+type busMessage struct {
+	Node    string    `json:"node"`
+	Kind    string    `json:"kind"`
+	To      string    `json:"to,omitempty"`   // the node a DM or its answer is for
+	Ref     uint64    `json:"ref,omitempty"`  // ties the answer to a DM to the DM
+	Code    string    `json:"code,omitempty"` // why a DM was not delivered
+	Members []string  `json:"members,omitempty"`
+	Message *Envelope `json:"message,omitempty"`
+}
+
+// busTopic is the topic of the room on the bus.
+func busTopic(room string) string {
+	return "room/" + room
+}
+
+// subscribe subscribes the group to its room on the bus and asks the other nodes who is in the room. It returns a nil
+// channel, which never delivers, without a bus or if subscribing failed.
+func (group *Group) subscribe() <-chan []byte {
+	if group.Bus == nil {
+		return nil
+	}
+	subscription, err := group.Bus.Subscribe(busTopic(group.Name))
+	if err != nil {
+		group.log.Error("Could not subscribe to the room on the bus, it only has the members of this node", "error", err)
+		return nil
+	}
+	group.subscription = subscription
+	group.publish(busMessage{Kind: busSync})
+	return subscription.C
+}
+
+// unsubscribe tells the other nodes that the room has no members on this node anymore and stops listening to them.
+func (group *Group) unsubscribe() {
+	if group.subscription == nil {
+		return
+	}
+	group.publish(busMessage{Kind: busRoster})
+	group.subscription.Close()
+}
+
+// publish sends the message to the other nodes, if the group is subscribed to the bus.
+func (group *Group) publish(message busMessage) {
+	if group.subscription == nil {
+		return
+	}
+	message.Node = group.Node
+	data, err := json.Marshal(message)
+	if err == nil {
+		err = group.Bus.Publish(busTopic(group.Name), data)
+	}
+	if err != nil {
+		group.log.Error("Could not publish to the bus", "kind", message.Kind, "error", err)
+	}
+}
+
+// announce tells the other nodes that the member joined or left the room.
+func (group *Group) announce(kind string, id string) {
+	group.publish(busMessage{Kind: kind, Members: []string{id}})
+}
+
+// forward publishes the DM to the member on the other node, which answers whether the member got it. The sender gets
+// its ack or nack once the answer is in or a nack when there is none within the WriteDeadline. It is called by the loop.
+func (group *Group) forward(node string, message Envelope) {
+	group.refs++
+	ref := group.refs
+	group.awaiting[ref] = message
+	group.publish(busMessage{Kind: busDM, To: node, Ref: ref, Message: &message})
+	time.AfterFunc(group.Config.WriteDeadline, func() {
+		select {
+		case group.unanswered <- ref:
+		case <-group.done:
+		}
+	})
+}
+
+// answered acks the DM the other node delivered or nacks it with the code the node gave. A DM to a member that is not
+// on that node anymore is queued as for any member that is not connected. It is called by the loop.
+func (group *Group) answered(ref uint64, code string) {
+	message, ok := group.awaiting[ref]
+	if !ok {
+		// answered after the WriteDeadline
+		return
+	}
+	delete(group.awaiting, ref)
+	switch {
+	case code == "":
+		if message.Type == TypeDM {
+			group.record(message)
+		}
+		group.reply(message, ackEnvelope(message))
+	case code == CodeUnknownRecipient && message.Type == TypeDM && group.Offline != nil:
+		group.queueOffline(message)
+	case code == CodeUnknownRecipient:
+		group.reply(message, nackEnvelope(message, code, fmt.Sprintf("member %s is not in room %s", message.To, group.Name)))
+	default:
+		group.reply(message, nackEnvelope(message, code, fmt.Sprintf("member %s is not able to receive messages", message.To)))
+	}
+}
+
+// locate returns the node the member with the ID is connected to, if it is in the room. With a presence registry a
+// member is on the node the registry says, as long as the room has it there, so that the members of nodes that are gone
+// are not found. It is called by the loop.
+func (group *Group) locate(id string) (string, bool) {
+	if _, ok := group.members[id]; ok {
+		return group.Node, true
+	}
+	if group.Presence != nil {
+		node, ok := group.Presence.Locate(id)
+		if !ok || node == group.Node {
+			return "", false
+		}
+		_, ok = group.remote[node][id]
+		return node, ok
+	}
+	for node, members := range group.remote {
+		if _, ok := members[id]; ok {
+			return node, true
+		}
+	}
+	return "", false
+}
+
+// receive acts on a message of the bus. It is called by the loop.
+func (group *Group) receive(data []byte) {
+	var message busMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		group.log.Warn("Could not decode a message of the bus", "error", err)
+		return
+	}
+	if message.Node == group.Node {
+		// our own, which the members of this node already got
+		return
+	}
+
+	switch message.Kind {
+	case busBroadcast:
+		if message.Message == nil {
+			return
+		}
+		// the sequence works like a Lamport clock across the nodes
+		advanceSequence(message.Message.Seq)
+		fan := newFanOut(*message.Message)
+		for _, member := range group.members {
+			if !fan.deliver(member) {
+				group.log.Warn("Could not queue a broadcast of another node", "member_id", member.ID, "seq", message.Message.Seq)
+			}
+		}
+		group.record(*message.Message)
+	case busDM:
+		if message.Message == nil || message.To != group.Node {
+			return
+		}
+		advanceSequence(message.Message.Seq)
+		answer := busMessage{Kind: busDelivered, To: message.Node, Ref: message.Ref}
+		member, ok := group.members[message.Message.To]
+		if !ok {
+			answer.Kind, answer.Code = busUndelivered, CodeUnknownRecipient
+		} else if !member.deliver(*message.Message) {
+			answer.Kind, answer.Code = busUndelivered, CodeUndeliverable
+		} else if message.Message.Type == TypeDM {
+			group.record(*message.Message)
+		}
+		if answer.Code != "" {
+			group.log.Warn("Could not deliver a direct message of another node", "node", message.Node, "to", message.Message.To, "seq", message.Message.Seq, "code", answer.Code)
+		}
+		group.publish(answer)
+	case busDelivered, busUndelivered:
+		if message.To == group.Node {
+			group.answered(message.Ref, message.Code)
+		}
+	case busModerated:
+		if message.Message == nil {
+			return
+		}
+		reason, _ := message.Message.Payload.(string)
+		group.applyModeration(*message.Message, reason)
+	case busJoined, busLeft, busRoster:
+		group.mu.Lock()
+		members := group.remote[message.Node]
+		if message.Kind == busRoster || members == nil {
+			members = make(map[string]struct{})
+		}
+		for _, id := range message.Members {
+			if message.Kind == busLeft {
+				delete(members, id)
+			} else {
+				members[id] = struct{}{}
+			}
+		}
+		if len(members) > 0 {
+			group.remote[message.Node] = members
+		} else {
+			delete(group.remote, message.Node)
+		}
+		group.mu.Unlock()
+	case busSync:
+		roster := make([]string, 0, len(group.members))
+		for id := range group.members {
+			roster = append(roster, id)
+		}
+		group.publish(busMessage{Kind: busRoster, Members: roster})
+	}
+}
+
+// Roster returns the sorted IDs of the members of the room on all the nodes at the time of the call, which are the
+// members of the group without a bus. With a presence registry the nodes that are gone are left out.
+func (group *Group) Roster() []string {
+	group.mu.RLock()
+	defer group.mu.RUnlock()
+
+	seen := make(map[string]struct{}, len(group.members))
+	ids := make([]string, 0, len(group.members))
+	for id := range group.members {
+		seen[id] = struct{}{}
+		ids = append(ids, id)
+	}
+	for node, members := range group.remote {
+		if group.Presence != nil && !group.Presence.Alive(node) {
+			continue
+		}
+		for id := range members {
+			if _, ok := seen[id]; !ok {
+				seen[id] = struct{}{}
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
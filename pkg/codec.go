@@ -0,0 +1,222 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const SUBPROTOCOL_V1_MSGPACK string = "v1.msgpack"
+const SUBPROTOCOL_V1_CBOR string = "v1.cbor"
+
+// A Codec turns envelopes into websocket frames and back. Every codec is offered as a websocket subprotocol during
+// the upgrade and the one picked is used for everything the member sends and receives, so the groups only ever deal
+// with envelopes and never with the wire format.
+type Codec interface {
+	// Name is the websocket subprotocol the codec is negotiated with.
+	Name() string
+	// MessageType is the websocket message type of the frames the codec produces.
+	MessageType() int
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// Codecs are all the codecs the server supports in the order of preference used when a client offers several.
+var Codecs = []Codec{JSONCodec{}, MessagePackCodec{}, CBORCodec{}}
+
+// CodecFor returns the codec negotiated with the given subprotocol. The legacy protocol has no subprotocol and no codec.
+func CodecFor(subprotocol string) (Codec, bool) {
+	for _, codec := range Codecs {
+		if codec.Name() == subprotocol {
+			return codec, true
+		}
+	}
+	return nil, false
+}
+
+// ErrNestedTooDeep is returned by the binary codecs for messages nested deeper than their MaxDepth.
+var ErrNestedTooDeep = errors.New("message is nested too deeply")
+
+// limitDepth returns the codec refusing messages nested deeper than the depth, for the codecs that need to be told.
+// JSON is measured by jsonDepth before it is decoded instead.
+func limitDepth(codec Codec, depth int) Codec {
+	switch codec.(type) {
+	case MessagePackCodec:
+		return MessagePackCodec{MaxDepth: depth}
+	case CBORCodec:
+		return CBORCodec{MaxDepth: depth}
+	}
+	return codec
+}
+
+// subprotocols returns the names of all the codecs to be offered by the upgrader.
+func subprotocols() []string {
+	names := make([]string, 0, len(Codecs))
+	for _, codec := range Codecs {
+		names = append(names, codec.Name())
+	}
+	return names
+}
+
+// JSONCodec speaks the envelopes as JSON in text frames.
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string                       { return SUBPROTOCOL_V1 }
+func (JSONCodec) MessageType() int                   { return websocket.TextMessage }
+func (JSONCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (JSONCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+// MessagePackCodec speaks the envelopes as MessagePack in binary frames. It uses the same field names as JSON. Messages
+// nested deeper than MaxDepth levels are refused before they are decoded, any depth is decoded when it is 0.
+type MessagePackCodec struct {
+	MaxDepth int
+}
+
+func (MessagePackCodec) Name() string     { return SUBPROTOCOL_V1_MSGPACK }
+func (MessagePackCodec) MessageType() int { return websocket.BinaryMessage }
+
+func (MessagePackCodec) Marshal(v any) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := msgpack.NewEncoder(&buffer)
+	encoder.SetCustomStructTag("json")
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (codec MessagePackCodec) Unmarshal(data []byte, v any) error {
+	if codec.MaxDepth > 0 && msgpackDepth(data, codec.MaxDepth) > codec.MaxDepth {
+		return fmt.Errorf("%w than %d levels", ErrNestedTooDeep, codec.MaxDepth)
+	}
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	decoder.SetCustomStructTag("json")
+	return decoder.Decode(v)
+}
+
+// CBORCodec speaks the envelopes as CBOR in binary frames. It uses the same field names as JSON. Messages nested deeper
+// than MaxDepth levels, which the decoder supports from 4 to 65535, are refused before they are decoded, the decoder's
+// default of 32 applies when it is 0.
+type CBORCodec struct {
+	MaxDepth int
+}
+
+// cborDecoders are the decoders by the depth they allow, made once for every depth as making them is expensive.
+var cborDecoders sync.Map
+
+// cborDecoder returns the decoder allowing the depth. It decodes maps with string keys so that payloads can be handed
+// to the other codecs as they are.
+func cborDecoder(depth int) cbor.DecMode {
+	if depth != 0 {
+		depth = min(max(depth, 4), 65535)
+	}
+	if decoder, ok := cborDecoders.Load(depth); ok {
+		return decoder.(cbor.DecMode)
+	}
+	decoder, _ := cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]any(nil)), MaxNestedLevels: depth}.DecMode()
+	cborDecoders.Store(depth, decoder)
+	return decoder
+}
+
+func (CBORCodec) Name() string                  { return SUBPROTOCOL_V1_CBOR }
+func (CBORCodec) MessageType() int              { return websocket.BinaryMessage }
+func (CBORCodec) Marshal(v any) ([]byte, error) { return cbor.Marshal(v) }
+
+func (codec CBORCodec) Unmarshal(data []byte, v any) error {
+	err := cborDecoder(codec.MaxDepth).Unmarshal(data, v)
+	var tooDeep *cbor.MaxNestedLevelError
+	if errors.As(err, &tooDeep) {
+		return fmt.Errorf("%w: %v", ErrNestedTooDeep, err)
+	}
+	return err
+}
+
+// msgpackDepth returns how deep the arrays and maps of the MessagePack message are nested without decoding it, the way
+// jsonDepth does for JSON. It stops looking once it is past the limit and doesn't validate the message.
+func msgpackDepth(data []byte, limit int) int {
+	pending := []uint64{1} // the items still to come on every level, the outermost holds the message itself
+	deepest := 0
+	for i := 0; i < len(data) && len(pending) > 0; {
+		pending[len(pending)-1]--
+		b := data[i]
+		i++
+		// the size of the length or count that follows the type and how much more to skip after it
+		var size, extra int
+		var items, multiplier uint64
+		switch {
+		case b <= 0x7f || b >= 0xe0 || (b >= 0xc0 && b <= 0xc3):
+			// fixints, nil and booleans
+		case b <= 0x8f:
+			items = 2 * uint64(b&0x0f)
+			multiplier = 2
+		case b <= 0x9f:
+			items = uint64(b & 0x0f)
+			multiplier = 1
+		case b <= 0xbf:
+			extra = int(b & 0x1f)
+		case b == 0xc4 || b == 0xd9:
+			size = 1
+		case b == 0xc5 || b == 0xda:
+			size = 2
+		case b == 0xc6 || b == 0xdb:
+			size = 4
+		case b == 0xc7:
+			size, extra = 1, 1
+		case b == 0xc8:
+			size, extra = 2, 1
+		case b == 0xc9:
+			size, extra = 4, 1
+		case b == 0xca:
+			extra = 4
+		case b == 0xcb:
+			extra = 8
+		case b >= 0xcc && b <= 0xd3:
+			extra = 1 << (b & 0x03)
+		case b >= 0xd4 && b <= 0xd8:
+			extra = 1 + 1<<(b-0xd4)
+		case b == 0xdc || b == 0xde:
+			size, multiplier = 2, uint64(b-0xdc)/2+1
+		case b == 0xdd || b == 0xdf:
+			size, multiplier = 4, uint64(b-0xdd)/2+1
+		}
+		if size > len(data)-i {
+			return deepest
+		}
+		var length uint64
+		switch size {
+		case 1:
+			length = uint64(data[i])
+		case 2:
+			length = uint64(binary.BigEndian.Uint16(data[i:]))
+		case 4:
+			length = uint64(binary.BigEndian.Uint32(data[i:]))
+		}
+		i += size
+		if multiplier > 0 {
+			// an array or a map, which has a level of its own even when it is empty
+			items += multiplier * length
+			deepest = max(deepest, len(pending))
+			if deepest > limit {
+				return deepest
+			}
+			pending = append(pending, items)
+		} else {
+			if length+uint64(extra) > uint64(len(data)-i) {
+				return deepest
+			}
+			i += int(length) + extra
+		}
+		for len(pending) > 0 && pending[len(pending)-1] == 0 {
+			pending = pending[:len(pending)-1]
+		}
+	}
+	return deepest
+}
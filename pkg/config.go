@@ -0,0 +1,448 @@
+package pkg
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const CONFIG_ENV_PREFIX string = "WS_" // every setting can be given as an environment variable named WS_<FLAG NAME>
+
+// Config holds every setting of the server. It is loaded once on startup by LoadConfig and handed to the groups,
+// which pass it on to their members and the handlers.
+//
+// Settings are looked up in the following order and the later ones win:
+// 1. The defaults from DefaultConfig
+// 2. The YAML file given by the -config flag or the WS_CONFIG environment variable
+// 3. The environment variables, named WS_ followed by the flag name in upper case with '-' replaced by '_'
+// 4. The command line flags
+type Config struct {
+	ListenAddress        string          `yaml:"listen_address"`
+	SecretKey            string          `yaml:"secret_key"`
+	PingInterval         time.Duration   `yaml:"ping_interval"`          // how often members are pinged
+	TimeoutInterval      time.Duration   `yaml:"timeout_interval"`       // how long we wait for a member to send us something before closing the connection
+	ReadDeadline         time.Duration   `yaml:"read_deadline"`          // read and control write timeout used while closing a connection
+	SocketCooldownPeriod time.Duration   `yaml:"socket_cooldown_period"` // how long we wait for the read to time out before closing the TCP connection
+	WriteDeadline        time.Duration   `yaml:"write_deadline"`         // how long a single write to a member may take before we consider the member dead
+	SendQueueSize        int             `yaml:"send_queue_size"`        // number of outbound messages a member can have pending
+	SendQueueOverflow    OverflowPolicy  `yaml:"send_queue_overflow"`    // what happens when a member's send queue is full
+	MaxPayloadSize       int             `yaml:"max_payload_size"`       // in bytes the largest message a member may send before it is rejected
+	MaxFrameSize         int64           `yaml:"max_frame_size"`         // in bytes the largest message read at all, larger ones close the connection
+	MaxJSONDepth         int             `yaml:"max_json_depth"`         // how deep arrays and objects of a JSON message may be nested
+	Compression          bool            `yaml:"compression"`            // whether permessage-deflate is offered to the clients
+	CompressionLevel     int             `yaml:"compression_level"`      // the flate level from -2 (huffman only) to 9 (best compression)
+	CompressionThreshold int             `yaml:"compression_threshold"`  // in bytes the smallest message that is sent compressed
+	DefaultRoom          string          `yaml:"default_room"`           // the room of connections that don't ask for one
+	RoomIdleTimeout      time.Duration   `yaml:"room_idle_timeout"`      // how long a room without members lives before it is torn down
+	ShutdownReason       string          `yaml:"shutdown_reason"`        // text of the CloseGoingAway frame members get when the server shuts down
+	DrainTimeout         time.Duration   `yaml:"drain_timeout"`          // how long the send queues may take to flush when the server shuts down
+	AuthMode             string          `yaml:"auth_mode"`              // none, jwt or api-key
+	JWTAlgorithm         string          `yaml:"jwt_algorithm"`          // HS256 or RS256, the algorithm of the key in JWTKeyFile
+	JWTKeyFile           string          `yaml:"jwt_key_file"`           // the shared secret for HS256 or the PEM encoded public key for RS256
+	JWKSFile             string          `yaml:"jwks_file"`              // a JSON Web Key Set with the keys tokens can be signed with
+	JWTIssuer            string          `yaml:"jwt_issuer"`             // the 'iss' tokens need to have, not checked when empty
+	JWTAudience          string          `yaml:"jwt_audience"`           // the 'aud' tokens need to have, not checked when empty
+	APIKeysFile          string          `yaml:"api_keys_file"`          // a YAML file mapping every API key to the member ID it authenticates
+	DefaultRoles         Roles           `yaml:"default_roles"`          // the roles of members whose credentials don't name any
+	AllowedOrigins       StringList      `yaml:"allowed_origins"`        // origins browsers may open websockets from, only the same origin when empty
+	CORSOrigins          StringList      `yaml:"cors_origins"`           // origins browsers may call the HTTP endpoints from
+	MemberMessageRate    float64         `yaml:"member_message_rate"`    // messages per second a member may send, no limit when 0
+	MemberMessageBurst   int             `yaml:"member_message_burst"`   // messages a member may send at once
+	MemberByteRate       float64         `yaml:"member_byte_rate"`       // bytes per second a member may send, no limit when 0
+	MemberByteBurst      int             `yaml:"member_byte_burst"`      // bytes a member may send at once
+	UpgradeRate          float64         `yaml:"upgrade_rate"`           // new connections per second from one IP, no limit when 0
+	UpgradeBurst         int             `yaml:"upgrade_burst"`          // new connections from one IP at once
+	RoomBroadcastRate    float64         `yaml:"room_broadcast_rate"`    // broadcasts per second in one room, no limit when 0
+	RoomBroadcastBurst   int             `yaml:"room_broadcast_burst"`   // broadcasts in one room at once
+	RateLimitAction      RateLimitAction `yaml:"rate_limit_action"`      // what happens when a member goes over a limit
+	LogFormat            string          `yaml:"log_format"`             // text or json
+	LogLevel             slog.Level      `yaml:"log_level"`              // debug, info, warn or error
+	RedactPayloads       bool            `yaml:"redact_payloads"`        // whether only the size of message payloads is logged instead of their contents
+	MaxConnections       int             `yaml:"max_connections"`        // the most members connected at once, new ones get a 503, no cap when 0
+	ReadinessTimeout     time.Duration   `yaml:"readiness_timeout"`      // how long /readyz waits for the room loops to respond
+	HistoryStore         string          `yaml:"history_store"`          // none, memory or file
+	HistoryFile          string          `yaml:"history_file"`           // the append-only log of the file history store
+	HistorySize          int             `yaml:"history_size"`           // messages of every conversation the memory history store keeps
+	HistoryPageSize      int             `yaml:"history_page_size"`      // the most messages a history request returns
+	OfflineQueueSize     int             `yaml:"offline_queue_size"`     // DMs kept for a member that is not connected, 0 refuses DMs to them
+	OfflineTTL           time.Duration   `yaml:"offline_ttl"`            // how long a DM waits for a member that is not connected
+	OfflineFile          string          `yaml:"offline_file"`           // where the waiting DMs are kept across restarts, in memory only when empty
+	OfflineRecipients    int             `yaml:"offline_recipients"`     // members that may have DMs waiting at the same time
+	OfflineMessages      int             `yaml:"offline_messages"`       // DMs that may be waiting for all the members together
+	ResumeGrace          time.Duration   `yaml:"resume_grace"`           // how long a member whose connection dropped can resume its session, no resumption when 0
+	ResumeBufferSize     int             `yaml:"resume_buffer_size"`     // the last messages of every member kept for a replay when it resumes
+	Bus                  string          `yaml:"bus"`                    // none or redis
+	NodeID               string          `yaml:"node_id"`                // the ID of this node on the bus, random when empty
+	NodeNumber           int             `yaml:"node_number"`            // the number of this node in its message IDs, 0 to 1023 and different on every node, needed with a bus
+	RedisAddress         string          `yaml:"redis_address"`          // host:port of the Redis server of the redis bus
+	RedisPassword        string          `yaml:"redis_password"`         // the password of the Redis server, if it needs one
+	PresenceHeartbeat    time.Duration   `yaml:"presence_heartbeat"`     // how often the node tells the others which members are connected to it
+	PresenceLease        time.Duration   `yaml:"presence_lease"`         // how long the other nodes trust a heartbeat before they forget the members of the node
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		ListenAddress:        ":8080",
+		SecretKey:            "thisIsTheSecret",
+		PingInterval:         15 * time.Second,
+		TimeoutInterval:      240 * time.Second,
+		ReadDeadline:         10 * time.Millisecond,
+		SocketCooldownPeriod: 20 * time.Millisecond,
+		WriteDeadline:        10 * time.Second,
+		SendQueueSize:        256,
+		SendQueueOverflow:    OverflowDropOldest,
+		MaxPayloadSize:       64 * 1024,
+		MaxFrameSize:         1024 * 1024,
+		MaxJSONDepth:         32,
+		Compression:          true,
+		CompressionLevel:     1,
+		CompressionThreshold: 512,
+		DefaultRoom:          "lobby",
+		RoomIdleTimeout:      300 * time.Second,
+		ShutdownReason:       "server is shutting down",
+		DrainTimeout:         10 * time.Second,
+		AuthMode:             AUTH_MODE_NONE,
+		JWTAlgorithm:         "HS256",
+		DefaultRoles:         Roles{"member"},
+		MemberMessageRate:    20,
+		MemberMessageBurst:   40,
+		MemberByteRate:       256 * 1024,
+		MemberByteBurst:      1024 * 1024,
+		UpgradeRate:          5,
+		UpgradeBurst:         20,
+		RoomBroadcastRate:    100,
+		RoomBroadcastBurst:   200,
+		RateLimitAction:      RateLimitDrop,
+		LogFormat:            LOG_FORMAT_TEXT,
+		LogLevel:             slog.LevelInfo,
+		RedactPayloads:       true,
+		ReadinessTimeout:     time.Second,
+		HistoryStore:         HISTORY_STORE_MEMORY,
+		HistorySize:          1000,
+		HistoryPageSize:      50,
+		OfflineQueueSize:     100,
+		OfflineTTL:           24 * time.Hour,
+		OfflineRecipients:    10000,
+		OfflineMessages:      100000,
+		ResumeBufferSize:     128,
+		Bus:                  BUS_NONE,
+		NodeNumber:           -1,
+		RedisAddress:         "localhost:6379",
+		PresenceHeartbeat:    5 * time.Second,
+		PresenceLease:        15 * time.Second,
+	}
+}
+
+// StringList is a list setting. As text it is a comma separated list so that it can be given as a flag.
+type StringList []string
+
+func (list StringList) MarshalText() ([]byte, error) {
+	return []byte(strings.Join(list, ",")), nil
+}
+
+func (list *StringList) UnmarshalText(text []byte) error {
+	*list = StringList{}
+	for _, item := range strings.Split(string(text), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*list = append(*list, item)
+		}
+	}
+	return nil
+}
+
+// flagSet binds every setting of the config to a flag of the returned set. Setting a flag of the set, either by
+// parsing arguments or calling Set, changes the config.
+func (config *Config) flagSet() *flag.FlagSet {
+	flags := flag.NewFlagSet("websocket-server", flag.ContinueOnError)
+	flags.String("config", "", "path of the YAML config file")
+	flags.StringVar(&config.ListenAddress, "listen-address", config.ListenAddress, "address the server listens on")
+	flags.StringVar(&config.SecretKey, "secret-key", config.SecretKey, "secret the admin endpoints expect in the authorization header")
+	flags.DurationVar(&config.PingInterval, "ping-interval", config.PingInterval, "how often members are pinged")
+	flags.DurationVar(&config.TimeoutInterval, "timeout-interval", config.TimeoutInterval, "how long a member may stay silent before it is disconnected")
+	flags.DurationVar(&config.ReadDeadline, "read-deadline", config.ReadDeadline, "read and control write timeout used while closing a connection")
+	flags.DurationVar(&config.SocketCooldownPeriod, "socket-cooldown-period", config.SocketCooldownPeriod, "how long to wait for the read to time out before closing the TCP connection")
+	flags.DurationVar(&config.WriteDeadline, "write-deadline", config.WriteDeadline, "how long a single write to a member may take")
+	flags.IntVar(&config.SendQueueSize, "send-queue-size", config.SendQueueSize, "number of outbound messages a member can have pending")
+	flags.TextVar(&config.SendQueueOverflow, "send-queue-overflow", config.SendQueueOverflow, "drop-oldest, drop-newest or disconnect when a member's send queue is full")
+	flags.IntVar(&config.MaxPayloadSize, "max-payload-size", config.MaxPayloadSize, "largest message in bytes a member may send")
+	flags.Int64Var(&config.MaxFrameSize, "max-frame-size", config.MaxFrameSize, "largest message in bytes that is read at all, larger ones close the connection")
+	flags.IntVar(&config.MaxJSONDepth, "max-json-depth", config.MaxJSONDepth, "how deep arrays and objects of a JSON message may be nested")
+	flags.BoolVar(&config.Compression, "compression", config.Compression, "whether permessage-deflate is offered to the clients")
+	flags.IntVar(&config.CompressionLevel, "compression-level", config.CompressionLevel, "flate level from -2 (huffman only) to 9 (best compression)")
+	flags.IntVar(&config.CompressionThreshold, "compression-threshold", config.CompressionThreshold, "smallest message in bytes that is sent compressed")
+	flags.StringVar(&config.DefaultRoom, "default-room", config.DefaultRoom, "room of the connections that don't ask for one")
+	flags.DurationVar(&config.RoomIdleTimeout, "room-idle-timeout", config.RoomIdleTimeout, "how long a room without members lives")
+	flags.StringVar(&config.ShutdownReason, "shutdown-reason", config.ShutdownReason, "text of the close frame members get when the server shuts down")
+	flags.DurationVar(&config.DrainTimeout, "drain-timeout", config.DrainTimeout, "how long the send queues may take to flush when the server shuts down")
+	flags.StringVar(&config.AuthMode, "auth-mode", config.AuthMode, "none, jwt or api-key")
+	flags.StringVar(&config.JWTAlgorithm, "jwt-algorithm", config.JWTAlgorithm, "HS256 or RS256, the algorithm of the key in the JWT key file")
+	flags.StringVar(&config.JWTKeyFile, "jwt-key-file", config.JWTKeyFile, "file with the shared secret for HS256 or the PEM encoded public key for RS256")
+	flags.StringVar(&config.JWKSFile, "jwks-file", config.JWKSFile, "JSON Web Key Set file with the keys tokens can be signed with")
+	flags.StringVar(&config.JWTIssuer, "jwt-issuer", config.JWTIssuer, "issuer tokens need to have")
+	flags.StringVar(&config.JWTAudience, "jwt-audience", config.JWTAudience, "audience tokens need to have")
+	flags.StringVar(&config.APIKeysFile, "api-keys-file", config.APIKeysFile, "YAML file mapping every API key to the member ID it authenticates")
+	flags.TextVar(&config.DefaultRoles, "default-roles", config.DefaultRoles, "comma separated roles of members whose credentials don't name any")
+	flags.TextVar(&config.AllowedOrigins, "allowed-origins", config.AllowedOrigins, "comma separated origins browsers may open websockets from, like https://*.example.com")
+	flags.TextVar(&config.CORSOrigins, "cors-origins", config.CORSOrigins, "comma separated origins browsers may call the HTTP endpoints from")
+	flags.Float64Var(&config.MemberMessageRate, "member-message-rate", config.MemberMessageRate, "messages per second a member may send, 0 for no limit")
+	flags.IntVar(&config.MemberMessageBurst, "member-message-burst", config.MemberMessageBurst, "messages a member may send at once")
+	flags.Float64Var(&config.MemberByteRate, "member-byte-rate", config.MemberByteRate, "bytes per second a member may send, 0 for no limit")
+	flags.IntVar(&config.MemberByteBurst, "member-byte-burst", config.MemberByteBurst, "bytes a member may send at once")
+	flags.Float64Var(&config.UpgradeRate, "upgrade-rate", config.UpgradeRate, "new connections per second from one IP, 0 for no limit")
+	flags.IntVar(&config.UpgradeBurst, "upgrade-burst", config.UpgradeBurst, "new connections from one IP at once")
+	flags.Float64Var(&config.RoomBroadcastRate, "room-broadcast-rate", config.RoomBroadcastRate, "broadcasts per second in one room, 0 for no limit")
+	flags.IntVar(&config.RoomBroadcastBurst, "room-broadcast-burst", config.RoomBroadcastBurst, "broadcasts in one room at once")
+	flags.TextVar(&config.RateLimitAction, "rate-limit-action", config.RateLimitAction, "drop, throttle or disconnect when a member goes over a rate limit")
+	flags.StringVar(&config.LogFormat, "log-format", config.LogFormat, "text or json")
+	flags.TextVar(&config.LogLevel, "log-level", config.LogLevel, "debug, info, warn or error")
+	flags.BoolVar(&config.RedactPayloads, "redact-payloads", config.RedactPayloads, "log only the size of message payloads instead of their contents")
+	flags.IntVar(&config.MaxConnections, "max-connections", config.MaxConnections, "most members connected at once, 0 for no cap")
+	flags.DurationVar(&config.ReadinessTimeout, "readiness-timeout", config.ReadinessTimeout, "how long /readyz waits for the room loops to respond")
+	flags.StringVar(&config.HistoryStore, "history-store", config.HistoryStore, "none, memory or file")
+	flags.StringVar(&config.HistoryFile, "history-file", config.HistoryFile, "append-only log of the file history store")
+	flags.IntVar(&config.HistorySize, "history-size", config.HistorySize, "messages of every conversation the memory history store keeps")
+	flags.IntVar(&config.HistoryPageSize, "history-page-size", config.HistoryPageSize, "most messages a history request returns")
+	flags.IntVar(&config.OfflineQueueSize, "offline-queue-size", config.OfflineQueueSize, "DMs kept for a member that is not connected, 0 refuses DMs to them")
+	flags.DurationVar(&config.OfflineTTL, "offline-ttl", config.OfflineTTL, "how long a DM waits for a member that is not connected")
+	flags.StringVar(&config.OfflineFile, "offline-file", config.OfflineFile, "where the waiting DMs are kept across restarts, in memory only when empty")
+	flags.IntVar(&config.OfflineRecipients, "offline-recipients", config.OfflineRecipients, "members that may have DMs waiting at the same time")
+	flags.IntVar(&config.OfflineMessages, "offline-messages", config.OfflineMessages, "DMs that may be waiting for all the members together")
+	flags.DurationVar(&config.ResumeGrace, "resume-grace", config.ResumeGrace, "how long a member whose connection dropped can resume its session, 0 for no resumption")
+	flags.IntVar(&config.ResumeBufferSize, "resume-buffer-size", config.ResumeBufferSize, "last messages of every member kept for a replay when it resumes")
+	flags.StringVar(&config.Bus, "bus", config.Bus, "none or redis")
+	flags.StringVar(&config.NodeID, "node-id", config.NodeID, "ID of this node on the bus, random when empty")
+	flags.IntVar(&config.NodeNumber, "node-number", config.NodeNumber, "number of this node in its message IDs, 0 to 1023 and different on every node, needed with a bus")
+	flags.StringVar(&config.RedisAddress, "redis-address", config.RedisAddress, "host:port of the Redis server of the redis bus")
+	flags.StringVar(&config.RedisPassword, "redis-password", config.RedisPassword, "password of the Redis server, if it needs one")
+	flags.DurationVar(&config.PresenceHeartbeat, "presence-heartbeat", config.PresenceHeartbeat, "how often the node tells the others which members are connected to it")
+	flags.DurationVar(&config.PresenceLease, "presence-lease", config.PresenceLease, "how long the other nodes trust a heartbeat before they forget the members of the node")
+	return flags
+}
+
+// envName returns the name of the environment variable for the flag with the given name.
+func envName(flagName string) string {
+	return CONFIG_ENV_PREFIX + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// LoadConfig builds the config from the defaults, the config file, the environment and the command line arguments
+// (without the program name) and validates it. getenv is usually os.Getenv.
+func LoadConfig(args []string, getenv func(string) string) (*Config, error) {
+	// the flags are parsed once up front only to find the config file and to fail early on bad arguments
+	scratch := DefaultConfig().flagSet()
+	if err := scratch.Parse(args); err != nil {
+		return nil, err
+	}
+	path := scratch.Lookup("config").Value.String()
+	if path == "" {
+		path = getenv(envName("config"))
+	}
+
+	config := DefaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the config file: %w", err)
+		}
+		if err := yaml.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("could not parse the config file %s: %w", path, err)
+		}
+	}
+
+	flags := config.flagSet()
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if value := getenv(envName(f.Name)); value != "" && f.Name != "config" {
+			if setErr := flags.Set(f.Name, value); setErr != nil {
+				err = errors.Join(err, fmt.Errorf("invalid value %q for %s: %w", value, envName(f.Name), setErr))
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate reports every setting that doesn't make sense.
+func (config *Config) Validate() error {
+	var errs []error
+	if config.ListenAddress == "" {
+		errs = append(errs, errors.New("listen address must not be empty"))
+	}
+	if config.SecretKey == "" {
+		errs = append(errs, errors.New("secret key must not be empty"))
+	}
+	positive := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"ping interval", config.PingInterval},
+		{"timeout interval", config.TimeoutInterval},
+		{"read deadline", config.ReadDeadline},
+		{"socket cooldown period", config.SocketCooldownPeriod},
+		{"write deadline", config.WriteDeadline},
+		{"drain timeout", config.DrainTimeout},
+		{"readiness timeout", config.ReadinessTimeout},
+		{"offline TTL", config.OfflineTTL},
+		{"presence heartbeat", config.PresenceHeartbeat},
+		{"presence lease", config.PresenceLease},
+	}
+	for _, setting := range positive {
+		if setting.value <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive but is %v", setting.name, setting.value))
+		}
+	}
+	if config.RoomIdleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("room idle timeout must not be negative but is %v", config.RoomIdleTimeout))
+	}
+	if config.PingInterval >= config.TimeoutInterval {
+		errs = append(errs, fmt.Errorf("ping interval %v must be shorter than the timeout interval %v", config.PingInterval, config.TimeoutInterval))
+	}
+	if config.SendQueueSize <= 0 {
+		errs = append(errs, fmt.Errorf("send queue size must be positive but is %d", config.SendQueueSize))
+	}
+	if config.MaxPayloadSize <= 0 {
+		errs = append(errs, fmt.Errorf("max payload size must be positive but is %d", config.MaxPayloadSize))
+	}
+	if config.MaxFrameSize < int64(config.MaxPayloadSize) {
+		errs = append(errs, fmt.Errorf("max frame size %d must not be smaller than the max payload size %d", config.MaxFrameSize, config.MaxPayloadSize))
+	}
+	if config.CompressionLevel < -2 || config.CompressionLevel > 9 {
+		errs = append(errs, fmt.Errorf("compression level must be between -2 and 9 but is %d", config.CompressionLevel))
+	}
+	if config.CompressionThreshold < 0 {
+		errs = append(errs, fmt.Errorf("compression threshold must not be negative but is %d", config.CompressionThreshold))
+	}
+	if config.MaxJSONDepth < 2 {
+		errs = append(errs, fmt.Errorf("max JSON depth must be at least 2 but is %d", config.MaxJSONDepth))
+	}
+	if config.MaxConnections < 0 {
+		errs = append(errs, fmt.Errorf("max connections must not be negative but is %d", config.MaxConnections))
+	}
+	if config.DefaultRoom == "" {
+		errs = append(errs, errors.New("default room must not be empty"))
+	}
+	if unknown := config.DefaultRoles.unknown(); len(unknown) > 0 {
+		errs = append(errs, fmt.Errorf("unknown default roles %v", unknown))
+	}
+	limits := []struct {
+		name  string
+		rate  float64
+		burst int
+		least int
+	}{
+		{"member message", config.MemberMessageRate, config.MemberMessageBurst, 1},
+		{"member byte", config.MemberByteRate, config.MemberByteBurst, config.MaxPayloadSize},
+		{"upgrade", config.UpgradeRate, config.UpgradeBurst, 1},
+		{"room broadcast", config.RoomBroadcastRate, config.RoomBroadcastBurst, 1},
+	}
+	for _, limit := range limits {
+		if limit.rate < 0 {
+			errs = append(errs, fmt.Errorf("%s rate must not be negative but is %v", limit.name, limit.rate))
+		} else if limit.rate > 0 && limit.burst < limit.least {
+			errs = append(errs, fmt.Errorf("%s burst must be at least %d but is %d", limit.name, limit.least, limit.burst))
+		}
+	}
+	for _, setting := range []struct {
+		name    string
+		origins StringList
+	}{{"allowed origin", config.AllowedOrigins}, {"CORS origin", config.CORSOrigins}} {
+		for _, origin := range setting.origins {
+			if _, err := parseOriginPattern(origin); err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s: %w", setting.name, err))
+			}
+		}
+	}
+	if config.LogFormat != LOG_FORMAT_TEXT && config.LogFormat != LOG_FORMAT_JSON {
+		errs = append(errs, fmt.Errorf("log format must be text or json but is %q", config.LogFormat))
+	}
+	switch config.HistoryStore {
+	case HISTORY_STORE_NONE:
+	case HISTORY_STORE_MEMORY:
+		if config.HistorySize <= 0 {
+			errs = append(errs, fmt.Errorf("history size must be positive but is %d", config.HistorySize))
+		}
+	case HISTORY_STORE_FILE:
+		if config.HistoryFile == "" {
+			errs = append(errs, errors.New("file history store needs a history file"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("history store must be none, memory or file but is %q", config.HistoryStore))
+	}
+	if config.HistoryPageSize <= 0 {
+		errs = append(errs, fmt.Errorf("history page size must be positive but is %d", config.HistoryPageSize))
+	}
+	if config.OfflineQueueSize < 0 {
+		errs = append(errs, fmt.Errorf("offline queue size must not be negative but is %d", config.OfflineQueueSize))
+	} else if config.AuthMode != AUTH_MODE_NONE && config.OfflineQueueSize >= config.SendQueueSize {
+		// the waiting DMs are queued along with the welcome message faster than the writer of the member sends them
+		errs = append(errs, fmt.Errorf("offline queue size must be below the send queue size of %d but is %d", config.SendQueueSize, config.OfflineQueueSize))
+	}
+	if config.OfflineQueueSize > 0 && (config.OfflineRecipients <= 0 || config.OfflineMessages <= 0) {
+		errs = append(errs, fmt.Errorf("offline recipients and messages must be positive but are %d and %d", config.OfflineRecipients, config.OfflineMessages))
+	}
+	if config.ResumeGrace < 0 {
+		errs = append(errs, fmt.Errorf("resume grace must not be negative but is %v", config.ResumeGrace))
+	}
+	if config.ResumeGrace > 0 && config.ResumeBufferSize <= 0 {
+		errs = append(errs, fmt.Errorf("resume buffer size must be positive but is %d", config.ResumeBufferSize))
+	} else if config.ResumeGrace > 0 {
+		// a resumed member gets the replay and the waiting DMs along with its welcome message
+		queued := config.ResumeBufferSize
+		if config.AuthMode != AUTH_MODE_NONE {
+			queued += max(config.OfflineQueueSize, 0)
+		}
+		if queued >= config.SendQueueSize {
+			errs = append(errs, fmt.Errorf("resume buffer size plus offline queue size must be below the send queue size of %d but is %d", config.SendQueueSize, queued))
+		}
+	}
+	if config.NodeNumber < -1 || config.NodeNumber > maxNodeNumber {
+		errs = append(errs, fmt.Errorf("node number must be between 0 and %d but is %d", maxNodeNumber, config.NodeNumber))
+	}
+	switch config.Bus {
+	case BUS_NONE:
+	case BUS_REDIS:
+		if config.RedisAddress == "" {
+			errs = append(errs, errors.New("redis bus needs a Redis address"))
+		}
+		// the nodes can't pick a number of their own that is sure to differ from the numbers of the others
+		if config.NodeNumber == -1 {
+			errs = append(errs, fmt.Errorf("redis bus needs a node number between 0 and %d that no other node has", maxNodeNumber))
+		}
+		if config.PresenceHeartbeat >= config.PresenceLease {
+			errs = append(errs, fmt.Errorf("presence heartbeat %v must be shorter than the presence lease %v", config.PresenceHeartbeat, config.PresenceLease))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("bus must be none or redis but is %q", config.Bus))
+	}
+	switch config.AuthMode {
+	case AUTH_MODE_NONE:
+	case AUTH_MODE_JWT:
+		if config.JWTKeyFile == "" && config.JWKSFile == "" {
+			errs = append(errs, errors.New("jwt auth mode needs a JWT key file or a JWKS file"))
+		}
+		if config.JWTKeyFile != "" && config.JWTAlgorithm != "HS256" && config.JWTAlgorithm != "RS256" {
+			errs = append(errs, fmt.Errorf("JWT algorithm must be HS256 or RS256 but is %q", config.JWTAlgorithm))
+		}
+	case AUTH_MODE_API_KEY:
+		if config.APIKeysFile == "" {
+			errs = append(errs, errors.New("api-key auth mode needs an API keys file"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("auth mode must be none, jwt or api-key but is %q", config.AuthMode))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,294 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const PROTOCOL_VERSION int = 1
+const SUBPROTOCOL_V1 string = "v1.json" // clients asking for this websocket subprotocol get envelopes instead of bare strings
+
+// The type of an envelope says what the envelope is about.
+const (
+	TypeWelcome   = "welcome"
+	TypeDM        = "dm"
+	TypeBroadcast = "broadcast"
+	TypeWhoami    = "whoami"
+	TypeJoin      = "join"
+	TypeLeave     = "leave"
+	TypeRead      = "read"
+	TypeAck       = "ack"
+	TypeNack      = "nack"
+	TypeError     = "error"
+	TypeKick      = "kick"
+	TypeMute      = "mute"
+	TypeUnmute    = "unmute"
+	TypeBan       = "ban"
+	TypeUnban     = "unban"
+	TypeHistory   = "history"
+)
+
+// Envelope is the versioned message format spoken in both directions. ID is chosen by the client to correlate
+// replies with its requests, To names the recipient of a DM, From is always filled in by the server with the ID
+// of the sending member and Room names the room a message is meant for (the member's own room when left out).
+//
+// DMs and broadcasts are stamped by the group that routes them with Seq, a server wide monotonic message ID that
+// clients can use to order and dedupe messages, and TS, the server time in unix milliseconds. Code is only set on
+// error envelopes, see errorEnvelope.
+//
+// A client that sends a request with an ID gets an ack once the request was handled (for DMs and broadcasts once
+// the message was queued for all its recipients) or a nack with a code and reason otherwise. A client can send a
+// read envelope with the Seq of a DM it has read to the sender of that DM, which gets it forwarded as a read receipt.
+//
+// Admins can send kick, mute, unmute, ban and unban envelopes naming the member in To and optionally a reason as the
+// payload. The member gets the same envelope from the admin before it is removed from the room.
+//
+// A member pages back through the broadcasts of a room or its DMs with another member in To by sending history
+// envelopes with the Seq of the oldest message it has as the cursor, see HistoryPayload.
+//
+// Clients connected with the subprotocol of one of the Codecs receive every frame as an envelope in that codec.
+// Everybody else receives the bare strings of the legacy protocol, see Chat.
+type Envelope struct {
+	V       int    `json:"v"`
+	Type    string `json:"type"`
+	ID      string `json:"id,omitempty"`
+	To      string `json:"to,omitempty"`
+	From    string `json:"from,omitempty"`
+	Room    string `json:"room,omitempty"`
+	Seq     uint64 `json:"seq,omitempty"`
+	TS      int64  `json:"ts,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Payload any    `json:"payload,omitempty"`
+}
+
+// nodeBits are the low bits of a message ID that hold the node number of the node that handed it out. Two nodes with
+// different numbers never hand out the same ID that way while the counter in the high bits still orders the messages
+// across the nodes.
+const nodeBits = 10
+
+// maxNodeNumber is the highest node number that fits in the low bits of a message ID.
+const maxNodeNumber = 1<<nodeBits - 1
+
+// sequence is the counter of the last message ID handed out by stamp.
+var sequence atomic.Uint64
+
+// stamp assigns the next message ID of the node with the number and the current server time to the envelope. A node
+// without a number, which it only may be without a bus, hands out the IDs of number 0.
+func (envelope *Envelope) stamp(node int) {
+	envelope.Seq = sequence.Add(1)<<nodeBits | uint64(max(node, 0))
+	envelope.TS = time.Now().UnixMilli()
+}
+
+// advanceSequence makes sure that the message IDs handed out by stamp from now on are above seq, e.g. the last one
+// of a store that kept messages across a restart or one of another node, so that they work like a Lamport clock.
+func advanceSequence(seq uint64) {
+	seq >>= nodeBits
+	for {
+		current := sequence.Load()
+		if current >= seq || sequence.CompareAndSwap(current, seq) {
+			return
+		}
+	}
+}
+
+// WelcomePayload is the payload of the welcome envelope sent when a member joins a room.
+type WelcomePayload struct {
+	ID          string   `json:"id"`
+	Members     []string `json:"members"`
+	ResumeToken string   `json:"resume_token,omitempty"` // resumes the session after the connection dropped, see session.go
+	Resumed     bool     `json:"resumed,omitempty"`      // the member took over the session of a dropped connection
+}
+
+// probe has the fields of both the envelope and the legacy Chat so that we can tell them apart with a single parse.
+type probe struct {
+	V       *int    `json:"v"`
+	Type    *string `json:"type"`
+	ID      string  `json:"id"`
+	To      string  `json:"to"`
+	Room    string  `json:"room"`
+	Seq     uint64  `json:"seq"`
+	Payload any     `json:"payload"`
+	Message string  `json:"message"`
+}
+
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+// ParseMessage parses the body of a text message sent by a client. A body with a 'v' or 'type' field is a
+// versioned envelope, anything else is treated as the legacy Chat and converted to the equivalent envelope.
+func ParseMessage(body []byte) (Envelope, error) {
+	return DecodeMessage(JSONCodec{}, body)
+}
+
+// DecodeMessage is ParseMessage for a message in any codec.
+func DecodeMessage(codec Codec, body []byte) (Envelope, error) {
+	var p probe
+	if err := codec.Unmarshal(body, &p); err != nil {
+		return Envelope{}, err
+	}
+
+	if p.V == nil && p.Type == nil {
+		return Chat{ID: p.ID, Message: p.Message, Room: p.Room}.envelope(), nil
+	}
+
+	if p.V == nil || *p.V != PROTOCOL_VERSION {
+		return Envelope{ID: p.ID}, ErrUnsupportedVersion
+	}
+	envelope := Envelope{V: *p.V, ID: p.ID, To: p.To, Room: p.Room, Seq: p.Seq, Payload: p.Payload}
+	if p.Type != nil {
+		envelope.Type = *p.Type
+	}
+	return envelope, nil
+}
+
+// envelope converts the legacy chat with its magic IDs to the envelope it stands for.
+func (chat Chat) envelope() Envelope {
+	envelope := Envelope{V: PROTOCOL_VERSION, Room: chat.Room}
+	switch chat.ID {
+	case "0":
+		envelope.Type = TypeWhoami
+	case "-1":
+		envelope.Type = TypeBroadcast
+		envelope.Payload = chat.Message
+	case "-2":
+		envelope.Type = TypeJoin
+	case "-3":
+		envelope.Type = TypeLeave
+	default:
+		envelope.Type = TypeDM
+		envelope.To = chat.ID
+		envelope.Payload = chat.Message
+	}
+	return envelope
+}
+
+// text returns the payload as a string, which is what the legacy protocol sends for DMs and broadcasts.
+func (envelope Envelope) text() string {
+	switch payload := envelope.Payload.(type) {
+	case nil:
+		return ""
+	case string:
+		return payload
+	default:
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Sprint(payload)
+		}
+		return string(data)
+	}
+}
+
+// legacy renders the envelope the way the legacy protocol did and reports false for envelopes it has no
+// equivalent for.
+func (envelope Envelope) legacy() ([]byte, bool) {
+	switch envelope.Type {
+	case TypeWelcome:
+		welcome, _ := envelope.Payload.(WelcomePayload)
+		var welcomeMessage strings.Builder
+		welcomeMessage.WriteString("Welcome!")
+		welcomeMessage.WriteString(" IDs of the other members [")
+		welcomeMessage.WriteString(strings.Join(welcome.Members, ", "))
+		welcomeMessage.WriteString("]")
+		return []byte(welcomeMessage.String()), true
+	case TypeDM, TypeBroadcast, TypeWhoami:
+		return []byte(envelope.text()), true
+	}
+	return nil, false
+}
+
+// encode renders the envelope for members speaking the codec, where a nil codec is the legacy protocol. It reports
+// false if there is nothing to send as the legacy protocol has no way to express the envelope.
+func encode(codec Codec, envelope Envelope) (frame, bool, error) {
+	if codec == nil {
+		data, ok := envelope.legacy()
+		return frame{messageType: websocket.TextMessage, data: data, kind: envelope.Type}, ok, nil
+	}
+
+	envelope.V = PROTOCOL_VERSION
+	data, err := codec.Marshal(envelope)
+	if err != nil {
+		return frame{}, false, err
+	}
+	return frame{messageType: codec.MessageType(), data: data, kind: envelope.Type}, true, nil
+}
+
+// deliver renders the envelope in the protocol the member speaks and queues it.
+func (member *Member) deliver(envelope Envelope) bool {
+	if member.remember(envelope) {
+		return true
+	}
+	message, ok, err := encode(member.Codec, envelope)
+	if err != nil {
+		return false
+	}
+	if !ok {
+		return true
+	}
+	return member.send(message)
+}
+
+// jsonDepth returns how deep the arrays and objects of the JSON document are nested without decoding it, so that
+// deeply nested documents can be refused before the decoder recurses into them. It doesn't validate the document.
+func jsonDepth(data []byte) int {
+	depth, deepest := 0, 0
+	inString, escaped := false, false
+	for _, b := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			if b == '\\' {
+				escaped = true
+			} else if b == '"' {
+				inString = false
+			}
+		case b == '"':
+			inString = true
+		case b == '{' || b == '[':
+			depth++
+			deepest = max(deepest, depth)
+		case b == '}' || b == ']':
+			depth--
+		}
+	}
+	return deepest
+}
+
+// valueDepth returns how deep the arrays and maps of a decoded value are nested, the way jsonDepth does for JSON, for
+// the values the binary codecs decode. It looks no deeper than one level past the limit, so that a value nested too
+// deeply costs no more to check than one that is just over the limit.
+func valueDepth(value any, limit int) int {
+	deepest := 0
+	deeper := func(child any) bool {
+		deepest = max(deepest, valueDepth(child, limit-1))
+		return deepest < limit
+	}
+	switch value := value.(type) {
+	case []any:
+		for _, child := range value {
+			if limit <= 0 || !deeper(child) {
+				break
+			}
+		}
+	case map[string]any:
+		for _, child := range value {
+			if limit <= 0 || !deeper(child) {
+				break
+			}
+		}
+	case map[any]any:
+		for _, child := range value {
+			if limit <= 0 || !deeper(child) {
+				break
+			}
+		}
+	default:
+		return 0
+	}
+	return deepest + 1
+}
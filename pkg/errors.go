@@ -0,0 +1,79 @@
+package pkg
+
+import (
+	"fmt"
+)
+
+// The machine readable codes of error envelopes.
+const (
+	CodeInvalidJSON        = "invalid_json"
+	CodeUnsupportedVersion = "unsupported_version"
+	CodeUnsupportedType    = "unsupported_type"
+	CodeUnknownRecipient   = "unknown_recipient"
+	CodePayloadTooLarge    = "payload_too_large"
+	CodeRateLimited        = "rate_limited"
+	CodeInvalidRoom        = "invalid_room"
+	CodeUndeliverable      = "undeliverable"
+	CodeForbidden          = "forbidden"
+	CodeMuted              = "muted"
+)
+
+// errorEnvelope builds the error envelope replying to the request. It carries the ID of the request so that the
+// client can tell which of its messages was rejected, the code and a human readable reason as the payload.
+func errorEnvelope(request Envelope, code string, reason string) Envelope {
+	return Envelope{
+		Type:    TypeError,
+		ID:      request.ID,
+		To:      request.From,
+		Room:    request.Room,
+		Code:    code,
+		Payload: reason,
+	}
+}
+
+// nackEnvelope builds the reply to a request that could not be delivered. Requests which carry an ID get a nack so
+// that every request with an ID is answered by exactly one ack or nack, the others get an error envelope.
+func nackEnvelope(request Envelope, code string, reason string) Envelope {
+	envelope := errorEnvelope(request, code, reason)
+	if request.ID != "" {
+		envelope.Type = TypeNack
+	}
+	return envelope
+}
+
+// ackEnvelope builds the reply to a request that was handled, which for DMs and broadcasts means that it was queued
+// for all its recipients. It carries the message ID the server assigned to the request if it has one.
+func ackEnvelope(request Envelope) Envelope {
+	return Envelope{
+		Type: TypeAck,
+		ID:   request.ID,
+		To:   request.From,
+		Room: request.Room,
+		Seq:  request.Seq,
+	}
+}
+
+// reject tells the member that its request was rejected. The legacy protocol has no way to express errors so
+// legacy members only get it logged.
+func (member *Member) reject(request Envelope, code string, format string, args ...any) {
+	reason := fmt.Sprintf(format, args...)
+	member.log.Info("Rejected a message", "id", request.ID, "code", code, "reason", reason)
+	request.From = member.ID
+	member.deliver(errorEnvelope(request, code, reason))
+}
+
+// refuse is reject for requests that were understood but could not be carried out.
+func (member *Member) refuse(request Envelope, code string, format string, args ...any) {
+	reason := fmt.Sprintf(format, args...)
+	member.log.Info("Refused a message", "id", request.ID, "type", request.Type, "code", code, "reason", reason)
+	request.From = member.ID
+	member.deliver(nackEnvelope(request, code, reason))
+}
+
+// acknowledge acks the request if the member asked for it by giving it an ID.
+func (member *Member) acknowledge(request Envelope) {
+	if request.ID != "" {
+		request.From = member.ID
+		member.deliver(ackEnvelope(request))
+	}
+}
@@ -0,0 +1,59 @@
+package pkg
+
+import (
+	"log/slog"
+
+	"github.com/gorilla/websocket"
+)
+
+// fanOut renders one broadcast for all the members of a group. Every wire format (a codec or the legacy protocol)
+// is only encoded once into a prepared message, which the writers of all the members share. The prepared message
+// frames the data once per compression setting, so a broadcast is also only compressed once instead of once per member.
+type fanOut struct {
+	envelope Envelope
+	frames   map[Codec]fanOutFrame
+}
+
+type fanOutFrame struct {
+	message frame
+	ok      bool
+}
+
+func newFanOut(envelope Envelope) *fanOut {
+	return &fanOut{envelope: envelope, frames: make(map[Codec]fanOutFrame)}
+}
+
+// frame returns the frame for members speaking the codec, where a nil codec is the legacy protocol, and reports
+// false if there is nothing to send to them.
+func (fan *fanOut) frame(codec Codec) (frame, bool) {
+	if cached, ok := fan.frames[codec]; ok {
+		return cached.message, cached.ok
+	}
+	message, ok, err := encode(codec, fan.envelope)
+	if err != nil {
+		slog.Error("Could not encode a broadcast", "group", fan.envelope.Room, "seq", fan.envelope.Seq, "error", err)
+		ok = false
+	}
+	if ok {
+		prepared, err := websocket.NewPreparedMessage(message.messageType, message.data)
+		if err != nil {
+			slog.Error("Could not prepare a broadcast", "group", fan.envelope.Room, "seq", fan.envelope.Seq, "error", err)
+		} else {
+			message.prepared = prepared
+		}
+	}
+	fan.frames[codec] = fanOutFrame{message, ok}
+	return message, ok
+}
+
+// deliver queues the broadcast for the member in the protocol the member speaks.
+func (fan *fanOut) deliver(member *Member) bool {
+	if member.remember(fan.envelope) {
+		return true
+	}
+	message, ok := fan.frame(member.Codec)
+	if !ok {
+		return true
+	}
+	return member.send(message)
+}
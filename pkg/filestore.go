@@ -0,0 +1,137 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// FileStore keeps every message in an append-only log with one JSON envelope per line. Only an index of where the
+// messages of every conversation are in the file is kept in memory, the messages themselves are read back from the
+// file when they are asked for.
+//
+// Appends are not synced to disk one by one, so the last messages can be lost when the machine (not the server)
+// crashes. A line that was only partly written is cut off the next time the log is opened.
+type FileStore struct {
+	mu            sync.RWMutex
+	file          *os.File
+	size          int64 // where the next message goes
+	conversations map[string][]fileEntry
+}
+
+// fileEntry is where a message is in the log.
+type fileEntry struct {
+	seq    uint64
+	offset int64
+	length int
+}
+
+// OpenFileStore opens the log at the path, creating it if needed, and indexes the messages that are already in it.
+// The message IDs handed out from then on continue after the last message in the log.
+func OpenFileStore(path string) (*FileStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open the history file: %w", err)
+	}
+	store := &FileStore{file: file, conversations: make(map[string][]fileEntry)}
+	if err := store.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// load indexes the log and cuts off a last line that was only partly written.
+func (store *FileStore) load() error {
+	reader := bufio.NewReader(store.file)
+	var last uint64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				slog.Warn("Cutting off a partly written message at the end of the history file", "file", store.file.Name(), "bytes", len(line))
+				if err := store.file.Truncate(store.size); err != nil {
+					return fmt.Errorf("could not repair the history file: %w", err)
+				}
+			}
+			break
+		} else if err != nil {
+			return fmt.Errorf("could not read the history file: %w", err)
+		}
+
+		var message Envelope
+		if err := json.Unmarshal(line, &message); err != nil {
+			slog.Warn("Skipping a message of the history file that can't be decoded", "file", store.file.Name(), "offset", store.size, "error", err)
+		} else if key, ok := conversation(message); ok {
+			store.index(key, fileEntry{message.Seq, store.size, len(line)})
+			last = max(last, message.Seq)
+		}
+		store.size += int64(len(line))
+	}
+	advanceSequence(last)
+	return nil
+}
+
+func (store *FileStore) Append(message Envelope) error {
+	key, ok := conversation(message)
+	if !ok {
+		return fmt.Errorf("%s messages are not kept", message.Type)
+	}
+	line, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if _, err := store.file.WriteAt(line, store.size); err != nil {
+		// don't leave half a message behind for the next one to be appended to
+		store.file.Truncate(store.size)
+		return fmt.Errorf("could not append to the history file: %w", err)
+	}
+	store.index(key, fileEntry{message.Seq, store.size, len(line)})
+	store.size += int64(len(line))
+	return nil
+}
+
+// index adds the entry to the conversation where its Seq belongs, the log itself is in the order the messages arrived.
+func (store *FileStore) index(key string, entry fileEntry) {
+	entries := store.conversations[key]
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].seq > entry.seq })
+	store.conversations[key] = slices.Insert(entries, i, entry)
+}
+
+func (store *FileStore) History(conversation string, before uint64, limit int) ([]Envelope, error) {
+	store.mu.RLock()
+	entries := store.conversations[conversation]
+	from, to := page(func(i int) uint64 { return entries[i].seq }, len(entries), before, limit)
+	// a late message moves the entries after it, the messages they point to never change though
+	entries = slices.Clone(entries[from:to])
+	store.mu.RUnlock()
+
+	history := make([]Envelope, 0, len(entries))
+	for _, entry := range entries {
+		line := make([]byte, entry.length)
+		if _, err := store.file.ReadAt(line, entry.offset); err != nil {
+			return nil, fmt.Errorf("could not read the history file: %w", err)
+		}
+		var message Envelope
+		if err := json.Unmarshal(line, &message); err != nil {
+			return nil, fmt.Errorf("could not decode a message of the history file: %w", err)
+		}
+		history = append(history, message)
+	}
+	return history, nil
+}
+
+func (store *FileStore) Close() error {
+	return store.file.Close()
+}
@@ -1,102 +1,387 @@
 package pkg
 
 import (
-	"log"
-	"strings"
-)
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"sync"
+	"time"
 
+	"github.com/gorilla/websocket"
+)
 
 // A group can have multiple members. Every member can be thought of a websocket connection.
 // There are four functions that we can perform on the group of members. That is:
-// 1. Add a member: Which basically registers a new member 
+// 1. Add a member: Which basically registers a new member
 // 2. Remove a member: Which to unregister or delete an existing member from the group
 // 3. Broadcast a message in the group: Which is to broadcast a text message to all the members of the group
 // 4. Direct message (DM) an other member: Which allows one member to DM other member
-// 
-// Since, the Members data structure in a group can be operated by multiple members and multiple functions by the same member.
-// It is synchronized using 'select' and 'channels' in Go which prevent race conditions. 
+// 5. Moderate a member: Which allows an admin to kick, mute or ban an other member, see handleModeration
+//
+// Since, the members data structure in a group can be operated by multiple members and multiple functions by the same member.
+// It is synchronized using 'select' and 'channels' in Go which prevent race conditions. The loop is the only one changing
+// the members and it does so under a write lock, so that Snapshot, Count and Has can be used from any goroutine (HTTP handlers,
+// tests) with a read lock without going through the loop.
+//
+// A group that belongs to a room registry (see Rooms) has a Name and exits its loop once it has been empty for
+// the configured RoomIdleTimeout. The done channel is closed when the loop exits so that nobody blocks forever sending to it.
+//
+// Stop makes the loop exit as well. Whenever the loop exits the remaining members get their pending messages flushed and
+// are closed with CloseGoingAway, after which the stopped channel is closed.
+//
+// With a Bus the group forms one room with the groups of the same name on the other nodes of a cluster, see bus.go. The
+// Presence registry tells which node the recipient of a DM is connected to and leaves out the members of nodes that are
+// gone, see presence.go.
 type Group struct {
-    AddMember   chan *Member
-    RemoveMember chan *Member
-    BroadcastMessage  chan string
-	DM         chan Chat
-	Members    map[string]*Member
+	Name             string
+	Config           *Config
+	Authenticator    Authenticator // nil lets every caller in under a random ID
+	Store            MessageStore  // keeps the broadcasts and DMs for history requests, nil keeps nothing
+	Offline          *OfflineQueue // holds the DMs to members that are not connected, nil refuses them
+	Bus              Bus           // shares the room with the other nodes of a cluster, nil keeps it to this node
+	Node             string        // the ID of this node on the bus
+	Presence         *Presence     // tells which node a member is connected to, nil relies on the rosters of the bus
+	AddMember        chan *Member
+	RemoveMember     chan *Member
+	BroadcastMessage chan Envelope
+	DM               chan Envelope
+	Moderate         chan Envelope
+	probe            chan struct{} // received by the loop to show that it is not wedged, see responsive
+	mu               sync.RWMutex
+	members          map[string]*Member
+	remote           map[string]map[string]struct{} // the IDs of the members on other nodes by node, see bus.go
+	subscription     *Subscription
+	muted            map[string]struct{}
+	banned           map[string]struct{}
+	broadcasts       *TokenBucket  // caps the broadcasts of all the members together
+	upgrades         *keyedLimiter // limits the new connections per IP when the group is served on its own
+	rooms            *Rooms
+	awaiting         map[uint64]Envelope // the DMs forwarded to other nodes that did not answer yet, see forward
+	refs             uint64              // the last reference handed out by forward
+	unanswered       chan uint64         // the references of the DMs that were not answered in time
+	done             chan struct{}
+	stopping         chan struct{}
+	stopOnce         sync.Once
+	stopped          chan struct{}
+	log              *slog.Logger // carries the group name, set when the loop starts
+}
+
+func NewGroup(config *Config) *Group {
+	return &Group{
+		Config:           config,
+		AddMember:        make(chan *Member),
+		RemoveMember:     make(chan *Member),
+		BroadcastMessage: make(chan Envelope),
+		DM:               make(chan Envelope),
+		Moderate:         make(chan Envelope),
+		probe:            make(chan struct{}),
+		awaiting:         make(map[uint64]Envelope),
+		unanswered:       make(chan uint64),
+		members:          make(map[string]*Member),
+		remote:           make(map[string]map[string]struct{}),
+		muted:            make(map[string]struct{}),
+		banned:           make(map[string]struct{}),
+		broadcasts:       NewTokenBucket(config.RoomBroadcastRate, config.RoomBroadcastBurst),
+		upgrades:         newKeyedLimiter(config.UpgradeRate, config.UpgradeBurst),
+		done:             make(chan struct{}),
+		stopping:         make(chan struct{}),
+		stopped:          make(chan struct{}),
+	}
+}
+
+// Stop makes the group loop exit, which drains and closes every member with the configured ShutdownReason. It waits
+// until all the members are closed or the context is done, whichever comes first.
+func (group *Group) Stop(ctx context.Context) error {
+	group.stopOnce.Do(func() {
+		close(group.stopping)
+	})
+	select {
+	case <-group.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stopping reports whether the group was asked to stop and doesn't take new members anymore.
+func (group *Group) Stopping() bool {
+	select {
+	case <-group.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// Snapshot returns the sorted IDs of the members of the group at the time of the call.
+func (group *Group) Snapshot() []string {
+	group.mu.RLock()
+	defer group.mu.RUnlock()
+
+	ids := make([]string, 0, len(group.members))
+	for id := range group.members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Count returns the number of members of the group.
+func (group *Group) Count() int {
+	group.mu.RLock()
+	defer group.mu.RUnlock()
+	return len(group.members)
+}
+
+// Has reports whether the member with the given ID is part of the group.
+func (group *Group) Has(id string) bool {
+	group.mu.RLock()
+	defer group.mu.RUnlock()
+	_, ok := group.members[id]
+	return ok
+}
+
+// add hands the member to the group loop and reports false if the loop has already exited.
+func (group *Group) add(member *Member) bool {
+	select {
+	case group.AddMember <- member:
+		return true
+	case <-group.done:
+		return false
+	}
+}
+
+// remove hands the member to the group loop for deletion. It is a no-op if the loop has already exited.
+func (group *Group) remove(member *Member) {
+	select {
+	case group.RemoveMember <- member:
+	case <-group.done:
+	}
+}
+
+// settle waits until the loop is done with everything it was handed before, such as adding a member. It returns right
+// away if the loop has already exited.
+func (group *Group) settle() {
+	select {
+	case group.probe <- struct{}{}:
+	case <-group.done:
+	}
+}
+
+// responsive reports an error if the loop doesn't pick up a probe before the context is done, which means that it is
+// wedged. A loop that has exited is not wedged.
+func (group *Group) responsive(ctx context.Context) error {
+	select {
+	case group.probe <- struct{}{}:
+		return nil
+	case <-group.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("room %q did not respond: %w", group.Name, ctx.Err())
+	}
+}
+
+// broadcast hands the envelope to the group loop and reports false if the loop has already exited.
+func (group *Group) broadcast(envelope Envelope) bool {
+	select {
+	case group.BroadcastMessage <- envelope:
+		return true
+	case <-group.done:
+		return false
+	}
 }
 
-func NewGroup() *Group {
-    return &Group{
-        AddMember:   make(chan *Member),
-        RemoveMember: make(chan *Member),
-        BroadcastMessage:  make(chan string),
-		DM:         make(chan Chat),
-		Members:    make(map[string]*Member),
-    }
+// dm hands the envelope to the group loop and reports false if the loop has already exited.
+func (group *Group) dm(envelope Envelope) bool {
+	select {
+	case group.DM <- envelope:
+		return true
+	case <-group.done:
+		return false
+	}
 }
 
 func (group *Group) buildAndSendWelcomeMessage(member *Member) {
-	log.Printf("Building welcome message for Member %s", member.ID)
-	var welcomeMessage strings.Builder
-	welcomeMessage.WriteString("Welcome!")
-	welcomeMessage.WriteString(" IDs of the other members [")
-	var list []string
-	for id := range group.Members {
-		if id != member.ID {
-			list = append(list, id)
-		}
+	group.log.Debug("Building the welcome message", "member_id", member.ID)
+	// the members on other nodes can be sent DMs as well
+	list := slices.DeleteFunc(group.Roster(), func(id string) bool { return id == member.ID })
+	welcome := Envelope{
+		Type:    TypeWelcome,
+		To:      member.ID,
+		Room:    group.Name,
+		Payload: WelcomePayload{ID: member.ID, Members: list, ResumeToken: member.resumeToken, Resumed: member.resumed.Load() != nil},
 	}
-	welcomeMessage.WriteString(strings.Join(list, ", "));
-	welcomeMessage.WriteString("]")
-	err := member.Connection.WriteMessage(1,[]byte(welcomeMessage.String()))
-	if err != nil {
-		log.Printf("Error %v while sending welcome message to Member %s", err, member.ID)
+	if !member.deliver(welcome) {
+		group.log.Warn("Could not queue the welcome message", "member_id", member.ID)
 	}
 }
 
+// reply sends the ack, nack or error for the message back to its sender. Acks are only sent for messages with an
+// ID as the sender didn't ask for them otherwise.
+func (group *Group) reply(message Envelope, envelope Envelope) {
+	if envelope.Type == TypeAck && message.ID == "" {
+		return
+	}
+	if sender, ok := group.members[message.From]; ok {
+		sender.deliver(envelope)
+	}
+}
+
+// idleTimer returns a channel that fires once the group has been empty for the RoomIdleTimeout. Groups which are not
+// part of a room registry live forever so they get a nil channel which never fires.
+func (group *Group) idleTimer() <-chan time.Time {
+	if group.rooms == nil || group.Config.RoomIdleTimeout <= 0 || len(group.members) > 0 {
+		return nil
+	}
+	return time.After(group.Config.RoomIdleTimeout)
+}
+
 func (group *Group) Create() {
+	group.log = slog.Default().With("group", group.Name)
+	remote := group.subscribe()
 	defer func() {
-		for _, member := range group.Members {
-			if member.IsActive {
-				err := member.GracefulClose()
-				if err != nil {
-					log.Printf("Error while closing connection to Member %s when exiting the group", member.ID)
-				}
+		group.unsubscribe()
+		// closed before the members are cleaned up so that their close doesn't wait on this loop
+		close(group.done)
+
+		var wg sync.WaitGroup
+		for _, member := range group.members {
+			if member.IsActive() {
+				wg.Add(1)
+				go func(member *Member) {
+					defer wg.Done()
+					err := member.drain(websocket.CloseGoingAway, group.Config.ShutdownReason)
+					if err != nil {
+						group.log.Warn("Could not close the connection when exiting the group", "member_id", member.ID, "error", err)
+					}
+				}(member)
 			}
 		}
+		wg.Wait()
+
+		group.mu.Lock()
+		MembersGauge.Add(-float64(len(group.members)))
+		group.members = make(map[string]*Member)
+		group.mu.Unlock()
+		close(group.stopped)
 	}()
 
+	idle := group.idleTimer()
 	for {
 		// select helps to synchronise threads such that at any single only one of them is operating on the common data structure which is members
 		select {
-		case member := <- group.AddMember:
-			group.Members[member.ID] = member
-			log.Printf("Added one more member %s to the group. The final size of the group is %d", member.ID, len(group.Members))
+		case member := <-group.AddMember:
+			if _, ok := group.banned[member.ID]; ok {
+				group.log.Info("Refusing to add a banned member", "member_id", member.ID)
+				group.expel(member, fmt.Sprintf("banned from room %s", group.Name))
+				continue
+			}
+			group.mu.Lock()
+			if _, resumed := group.members[member.ID]; !resumed {
+				MembersGauge.Add(1)
+			}
+			group.members[member.ID] = member
+			group.mu.Unlock()
+			idle = nil
+			group.log.Info("Added a member", "member_id", member.ID, "members", len(group.members))
+			group.announce(busJoined, member.ID)
 			group.buildAndSendWelcomeMessage(member)
-		case member := <- group.RemoveMember:
-			if _, ok:= group.Members[member.ID]; ok {	
-				delete(group.Members, member.ID)
-				log.Printf("Successfully deleted member %s from the group. The final size of the group is %d", member.ID, len(group.Members))
+			group.replay(member)
+			group.deliverOffline(member)
+		case member := <-group.RemoveMember:
+			// a member that resumed a session has replaced the parked one under the same ID
+			if current, ok := group.members[member.ID]; ok && current == member {
+				group.mu.Lock()
+				delete(group.members, member.ID)
+				group.mu.Unlock()
+				MembersGauge.Add(-1)
+				group.log.Info("Removed a member", "member_id", member.ID, "members", len(group.members))
+				group.announce(busLeft, member.ID)
+				idle = group.idleTimer()
 			} else {
-				log.Printf("Could not delete member %s from group as it doesn't exist", member.ID)
+				group.log.Debug("Could not remove a member that is not in the group", "member_id", member.ID)
+			}
+		case message := <-group.BroadcastMessage:
+			message.Room = group.Name
+			if _, ok := group.muted[message.From]; ok {
+				group.reply(message, nackEnvelope(message, CodeMuted, fmt.Sprintf("muted in room %s", group.Name)))
+				continue
+			}
+			// the cap is shared by all the members, so it is never held against the one that happens to hit it
+			if !group.broadcasts.Allow(1) {
+				RateLimited.Inc("room_broadcasts")
+				group.reply(message, nackEnvelope(message, CodeRateLimited, "room_broadcasts rate limit exceeded"))
+				continue
+			}
+			message.stamp(group.Config.NodeNumber)
+			start := time.Now()
+			fan := newFanOut(message)
+			for _, member := range group.members {
+				if !fan.deliver(member) {
+					group.log.Warn("Could not queue a broadcast", "member_id", member.ID, "seq", message.Seq)
+				}
+			}
+			FanOutSeconds.Observe(time.Since(start).Seconds())
+			group.publish(busMessage{Kind: busBroadcast, Message: &message})
+			group.record(message)
+			group.log.Debug("Broadcast a message", "from", message.From, "seq", message.Seq, "members", len(group.members), payloadAttr(group.Config, message))
+			group.reply(message, ackEnvelope(message))
+		case message := <-group.DM:
+			message.Room = group.Name
+			if _, ok := group.muted[message.From]; ok && message.Type != TypeRead {
+				group.reply(message, nackEnvelope(message, CodeMuted, fmt.Sprintf("muted in room %s", group.Name)))
+				continue
 			}
-		case message := <- group.BroadcastMessage:
-			for _, member := range group.Members {
-                if err := member.Connection.WriteMessage(1, []byte(message)); err != nil {
-                    log.Printf("Error while broadcasting message %v", err)
-                    return
-                }
-            }
-			log.Printf("Message %s successfully broadcasted to the group", message)
-		case message := <- group.DM: 
-			if member, ok := group.Members[message.ID]; ok {
-				if err := member.Connection.WriteMessage(1, []byte(message.Message)); err != nil {
-                    log.Printf("Error while broadcasting message %v", err)
-                    return
-                }
-				log.Printf("Message %s successfully sent to the member %s", message.Message, member.ID)
+			// read receipts keep the message ID of the DM they are about
+			if message.Type != TypeRead {
+				message.stamp(group.Config.NodeNumber)
+			}
+			if node, ok := group.locate(message.To); ok && node == group.Node {
+				member := group.members[message.To]
+				if !member.deliver(message) {
+					group.log.Warn("Could not queue a direct message", "member_id", member.ID, "seq", message.Seq)
+					group.reply(message, nackEnvelope(message, CodeUndeliverable, fmt.Sprintf("member %s is not able to receive messages", message.To)))
+				} else {
+					group.log.Debug("Sent a direct message", "type", message.Type, "from", message.From, "to", message.To, "seq", message.Seq, payloadAttr(group.Config, message))
+					if message.Type == TypeDM {
+						group.record(message)
+					}
+					group.reply(message, ackEnvelope(message))
+				}
+			} else if ok {
+				group.log.Debug("Sent a direct message to another node", "node", node, "type", message.Type, "from", message.From, "to", message.To, "seq", message.Seq, payloadAttr(group.Config, message))
+				group.forward(node, message)
+			} else if message.Type == TypeDM && group.Offline != nil && !group.connected(message.To) {
+				group.queueOffline(message)
 			} else {
-				log.Printf("Failed to send DM to member with ID %s as it doesn't exist.", message.ID)
+				group.log.Info("Could not send a direct message to a member that is not in the group", "from", message.From, "to", message.To)
+				group.reply(message, nackEnvelope(message, CodeUnknownRecipient, fmt.Sprintf("member %s is not in room %s", message.To, group.Name)))
 			}
+		case message := <-group.Moderate:
+			message.Room = group.Name
+			group.handleModeration(message)
+		case data := <-remote:
+			group.receive(data)
+		case ref := <-group.unanswered:
+			if message, ok := group.awaiting[ref]; ok {
+				group.log.Warn("Another node did not answer a direct message in time", "to", message.To, "seq", message.Seq)
+				group.answered(ref, CodeUndeliverable)
+			}
+		case <-group.probe:
+			// getting here is all a readiness probe or settle wants to know
+		case <-idle:
+			// nobody can hand us a new member while we are in here so it is safe to exit once the registry forgot us
+			group.log.Info("Room has been empty for too long", "room_idle_timeout", group.Config.RoomIdleTimeout)
+			group.rooms.release(group)
+			return
+		case <-group.stopping:
+			group.log.Info("Stopping the group", "members", len(group.members))
+			if group.rooms != nil {
+				group.rooms.release(group)
+			}
+			return
 		}
 	}
 }
-
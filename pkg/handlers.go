@@ -3,58 +3,253 @@ package pkg
 import (
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
-
-const SECRET_KEY string = "thisIsTheSecret"
-
 func ServerHome(w http.ResponseWriter, _ *http.Request) {
 	fmt.Fprint(w, "This is home!")
 }
 
-func ServerPingPong(group *Group, w http.ResponseWriter, r *http.Request) {
-    upgrader := websocket.Upgrader{}
+// authenticate returns who is behind the request, which is the identity the authenticator found or one with a random
+// subject without an authenticator. Requests the authenticator refuses are answered with 401.
+func authenticate(authenticator Authenticator, w http.ResponseWriter, r *http.Request) (Identity, bool) {
+	if authenticator == nil {
+		return Identity{Subject: uuid.NewString()}, true
+	}
+	identity, err := authenticator.Authenticate(r)
+	if err != nil {
+		slog.Info("Refusing to upgrade an unauthenticated connection", "remote_addr", r.RemoteAddr, "error", err)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return Identity{}, false
+	}
+	return identity, true
+}
+
+// upgrade upgrades the request to a websocket connection and wraps it in a new member for the identity. The member
+// still has to be added to a group before it is activated.
+func upgrade(config *Config, identity Identity, w http.ResponseWriter, r *http.Request) (*Member, error) {
+	upgrader := websocket.Upgrader{
+		Subprotocols:      subprotocols(),
+		CheckOrigin:       checkOrigin(config),
+		EnableCompression: config.Compression,
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
-    if err != nil {
-        fmt.Fprintf(w, "%+v\n", err)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetCompressionLevel(config.CompressionLevel); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	member := NewMember(identity.Subject, conn, config)
+	if len(identity.Roles) > 0 {
+		member.Roles = identity.Roles
+	}
+	if codec, ok := CodecFor(conn.Subprotocol()); ok {
+		member.Codec = limitDepth(codec, config.MaxJSONDepth)
+	}
+	return member, nil
+}
+
+// goAway closes the connection of a member that could not be added to a group because the server is shutting down.
+func goAway(member *Member) {
+	// stops the writer
+	member.closeOnce.Do(func() { close(member.closed) })
+	member.Connection.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, member.Config.ShutdownReason),
+		time.Now().Add(member.Config.ReadDeadline),
+	)
+	member.Connection.Close()
+}
+
+func ServerPingPong(group *Group, w http.ResponseWriter, r *http.Request) {
+	if group.Stopping() {
+		UpgradesTotal.Inc("unavailable")
+		http.Error(w, group.Config.ShutdownReason, http.StatusServiceUnavailable)
+		return
+	}
+	if full(group.Config, group) {
+		UpgradesTotal.Inc("full")
+		http.Error(w, fmt.Sprintf("at the cap of %d connections", group.Config.MaxConnections), http.StatusServiceUnavailable)
+		return
+	}
+	if !allowUpgrade(group.upgrades, w, r) {
+		UpgradesTotal.Inc("rate_limited")
+		return
+	}
+	identity, ok := authenticate(group.Authenticator, w, r)
+	if !ok {
+		UpgradesTotal.Inc("unauthorized")
+		return
+	}
+	if group.Banned(identity.Subject) {
+		UpgradesTotal.Inc("forbidden")
+		http.Error(w, fmt.Sprintf("member %s is banned", identity.Subject), http.StatusForbidden)
+		return
+	}
+	if group.Has(identity.Subject) {
+		UpgradesTotal.Inc("conflict")
+		http.Error(w, fmt.Sprintf("member %s is already connected", identity.Subject), http.StatusConflict)
+		return
+	}
+	member, err := upgrade(group.Config, identity, w, r)
+	if err != nil {
+		UpgradesTotal.Inc("failed")
+		fmt.Fprintf(w, "%+v\n", err)
+		return
+	}
+
+	member.Group = group
+	member.log = member.log.With("group", group.Name)
+	member.joined(group)
+	go member.writeMessages()
+	if !group.add(member) {
+		UpgradesTotal.Inc("unavailable")
+		goAway(member)
 		return
-    }
+	}
+	UpgradesTotal.Inc("accepted")
+	member.Activate()
+}
 
-    member := &Member{
-		ID: uuid.NewString(),
-        Connection: conn,
-        Group: group,
-        IsActive: true,
-    }
+// roomName returns the room requested either through the {name} path value (/rooms/{name}/ws) or the 'room'
+// query parameter (/pingpong?room=name) and falls back to the configured default room.
+func roomName(config *Config, r *http.Request) string {
+	if name := r.PathValue("name"); name != "" {
+		return name
+	}
+	if name := r.URL.Query().Get("room"); name != "" {
+		return name
+	}
+	return config.DefaultRoom
+}
+
+// ServerRoom upgrades the connection and adds the member to the requested room, creating it if needed.
+func ServerRoom(rooms *Rooms, w http.ResponseWriter, r *http.Request) {
+	if rooms.Stopping() {
+		UpgradesTotal.Inc("unavailable")
+		http.Error(w, rooms.Config.ShutdownReason, http.StatusServiceUnavailable)
+		return
+	}
+	if full(rooms.Config, rooms) {
+		UpgradesTotal.Inc("full")
+		http.Error(w, fmt.Sprintf("at the cap of %d connections", rooms.Config.MaxConnections), http.StatusServiceUnavailable)
+		return
+	}
+	if !allowUpgrade(rooms.upgrades, w, r) {
+		UpgradesTotal.Inc("rate_limited")
+		return
+	}
+	identity, ok := authenticate(rooms.Authenticator, w, r)
+	if !ok {
+		UpgradesTotal.Inc("unauthorized")
+		return
+	}
+	if rooms.Offline != nil && rooms.Authenticator != nil {
+		// DMs are only kept for members that exist
+		rooms.Offline.Seen(identity.Subject)
+	}
+	previous, lastSeq := rooms.resumption(identity, r)
+	id, name := identity.Subject, roomName(rooms.Config, r)
+	if previous != nil {
+		// the session goes on as it was, in the room it connected to
+		identity = Identity{Subject: previous.ID, Roles: previous.Roles}
+		id, name = previous.ID, previous.Group.Name
+	}
+	if rooms.banned(name, id) {
+		UpgradesTotal.Inc("forbidden")
+		http.Error(w, fmt.Sprintf("member %s is banned from room %s", id, name), http.StatusForbidden)
+		if previous != nil {
+			previous.leaveAll()
+		}
+		return
+	}
+	if !rooms.claim(id) {
+		UpgradesTotal.Inc("conflict")
+		http.Error(w, fmt.Sprintf("member %s is already connected", id), http.StatusConflict)
+		if previous != nil {
+			previous.leaveAll()
+		}
+		return
+	}
+	if previous == nil {
+		// a parked session of the ID is over once the member connects without resuming it
+		rooms.expireParked(id)
+	}
+	member, err := upgrade(rooms.Config, identity, w, r)
+	if err != nil {
+		UpgradesTotal.Inc("failed")
+		rooms.unclaim(id)
+		if previous != nil {
+			previous.leaveAll()
+		}
+		fmt.Fprintf(w, "%+v\n", err)
+		return
+	}
 
-    group.AddMember <- member
-    member.Activate()
+	member.Rooms = rooms
+	member.resumed.Store(previous)
+	member.lastSeq = lastSeq
+	if rooms.Config.ResumeGrace > 0 && member.Codec != nil {
+		member.resumeToken, member.sent = newResumeToken(), &ring{}
+	}
+	// the group may log about the member as soon as it joined
+	member.log = member.log.With("group", name)
+	// the writer runs before the member joins as the welcome message, a replay and the waiting DMs are queued right away
+	go member.writeMessages()
+	if rooms.Join(name, member) == nil {
+		UpgradesTotal.Inc("unavailable")
+		rooms.unclaim(id)
+		goAway(member)
+		return
+	}
+	UpgradesTotal.Inc("accepted")
+	member.joined(member.Group)
+	if previous != nil {
+		member.rejoin()
+	}
+	member.Activate()
 }
 
 type ResponseData struct {
-    MemberIds []string
+	MemberIds []string
 }
 
 func ServerMemberIds(group *Group, w http.ResponseWriter, r *http.Request) {
-    secret := r.Header.Get("authorization")
-    if secret != SECRET_KEY {
-        w.WriteHeader(401)
-        fmt.Fprintf(w, "Unauthorized")
-        return
-    }
-
-    respData := &ResponseData{
-        MemberIds: make([]string, 0),
-    }
-    
-    for id := range group.Members {
-        respData.MemberIds = append(respData.MemberIds, id)
-    }
-    respDataBytes, _ := json.Marshal(respData)
-    w.Write(respDataBytes)
+	serveMemberIds(group.Config, group, w, r)
 }
 
+// serveMemberIds lists the members of the group, which is nil for a room that doesn't exist.
+func serveMemberIds(config *Config, group *Group, w http.ResponseWriter, r *http.Request) {
+	secret := r.Header.Get("authorization")
+	if secret != config.SecretKey {
+		w.WriteHeader(401)
+		fmt.Fprintf(w, "Unauthorized")
+		return
+	}
+
+	respData := &ResponseData{
+		MemberIds: make([]string, 0),
+	}
+
+	if group != nil {
+		respData.MemberIds = group.Roster()
+	}
+	respDataBytes, _ := json.Marshal(respData)
+	w.Write(respDataBytes)
+}
+
+// ServerRoomMemberIds is ServerMemberIds for the room requested the same way as in ServerRoom. A room that doesn't
+// exist has no members.
+func ServerRoomMemberIds(rooms *Rooms, w http.ResponseWriter, r *http.Request) {
+	group, _ := rooms.Lookup(roomName(rooms.Config, r))
+	serveMemberIds(rooms.Config, group, w, r)
+}
@@ -0,0 +1,146 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Version is the build version reported on /status. Release builds set it with
+// -ldflags "-X websocket-server.com/pkg.Version=v1.2.3", other builds report the VCS revision Go stamped into the binary.
+var Version string
+
+var started = time.Now()
+
+// version returns the Version or what the build info knows about the build.
+func version() string {
+	if Version != "" {
+		return Version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return info.Main.Version
+}
+
+// hub is what the health endpoints need to know about a standalone group or a room registry.
+type hub interface {
+	Stopping() bool
+	Connections() int
+	responsive(ctx context.Context) error
+	counts() map[string]int
+}
+
+// Connections returns the number of members of the group, which are all the connections of a standalone group.
+func (group *Group) Connections() int {
+	return group.Count()
+}
+
+func (group *Group) counts() map[string]int {
+	return map[string]int{group.Name: group.Count()}
+}
+
+func (rooms *Rooms) counts() map[string]int {
+	rooms.mu.Lock()
+	groups := make([]*Group, 0, len(rooms.groups))
+	for _, group := range rooms.groups {
+		groups = append(groups, group)
+	}
+	rooms.mu.Unlock()
+
+	counts := make(map[string]int, len(groups))
+	for _, group := range groups {
+		counts[group.Name] = group.Count()
+	}
+	return counts
+}
+
+// full reports whether the configured MaxConnections are connected, in which case no more members are let in.
+func full(config *Config, hub hub) bool {
+	return config.MaxConnections > 0 && hub.Connections() >= config.MaxConnections
+}
+
+// ServerHealth answers as long as the process is alive.
+func ServerHealth(w http.ResponseWriter, _ *http.Request) {
+	fmt.Fprint(w, "ok")
+}
+
+// ServerReady answers 200 while the group can take new members and 503 with the reason otherwise, that is when it is
+// shutting down, when its loop doesn't respond within the ReadinessTimeout or when it is at its MaxConnections.
+func ServerReady(group *Group, w http.ResponseWriter, r *http.Request) {
+	serveReady(group.Config, group, w, r)
+}
+
+// ServerRoomsReady is ServerReady for all the rooms of the registry.
+func ServerRoomsReady(rooms *Rooms, w http.ResponseWriter, r *http.Request) {
+	serveReady(rooms.Config, rooms, w, r)
+}
+
+func serveReady(config *Config, hub hub, w http.ResponseWriter, r *http.Request) {
+	if hub.Stopping() {
+		http.Error(w, config.ShutdownReason, http.StatusServiceUnavailable)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), config.ReadinessTimeout)
+	defer cancel()
+	if err := hub.responsive(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if full(config, hub) {
+		http.Error(w, fmt.Sprintf("at the cap of %d connections", config.MaxConnections), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprint(w, "ready")
+}
+
+// Status is what /status reports about the server. The rooms are only listed by name for requests with the secret key,
+// the same way as for /getMemberIds, everybody else only gets the totals.
+type Status struct {
+	Version       string         `json:"version"`
+	GoVersion     string         `json:"go_version"`
+	UptimeSeconds float64        `json:"uptime_seconds"`
+	Goroutines    int            `json:"goroutines"`
+	Connections   int            `json:"connections"`
+	Rooms         int            `json:"rooms"`
+	Members       map[string]int `json:"members,omitempty"` // the number of members of every room, only with the secret key
+	Draining      bool           `json:"draining"`
+}
+
+// ServerStatus writes the Status of the server with the group.
+func ServerStatus(group *Group, w http.ResponseWriter, r *http.Request) {
+	serveStatus(group.Config, group, w, r)
+}
+
+// ServerRoomsStatus writes the Status of the server with the room registry.
+func ServerRoomsStatus(rooms *Rooms, w http.ResponseWriter, r *http.Request) {
+	serveStatus(rooms.Config, rooms, w, r)
+}
+
+func serveStatus(config *Config, hub hub, w http.ResponseWriter, r *http.Request) {
+	counts := hub.counts()
+	status := Status{
+		Version:       version(),
+		GoVersion:     runtime.Version(),
+		UptimeSeconds: time.Since(started).Seconds(),
+		Goroutines:    runtime.NumGoroutine(),
+		Connections:   hub.Connections(),
+		Rooms:         len(counts),
+		Draining:      hub.Stopping(),
+	}
+	if r.Header.Get("authorization") == config.SecretKey {
+		status.Members = counts
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
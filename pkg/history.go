@@ -0,0 +1,77 @@
+package pkg
+
+import "encoding/json"
+
+// HistoryRequest is the optional payload of a history envelope sent by a member.
+type HistoryRequest struct {
+	Limit int `json:"limit"` // the most messages to return, at most and by default the HistoryPageSize
+}
+
+// HistoryPayload is the payload of the history envelope a member gets back. Messages are oldest first and Cursor is the
+// Seq to send in the next history envelope to get the messages before them, which is 0 once there are none.
+type HistoryPayload struct {
+	Messages []Envelope `json:"messages"`
+	Cursor   uint64     `json:"cursor,omitempty"`
+}
+
+// record keeps the message in the store of the group, if it has one. It is called by the loop right after routing.
+func (group *Group) record(message Envelope) {
+	if group.Store == nil {
+		return
+	}
+	if err := group.Store.Append(message); err != nil {
+		group.log.Error("Could not keep a message in the history", "seq", message.Seq, "error", err)
+	}
+}
+
+// history answers a history envelope of the member with a page of the broadcasts of the room or, with To, of its DMs
+// with that member in the room. Members can only read the rooms they are part of.
+func (member *Member) history(request Envelope) {
+	group := member.room(request.Room)
+	if request.Room != "" && request.Room != group.Name {
+		member.refuse(request, CodeInvalidRoom, "not part of room %s", request.Room)
+		return
+	}
+	if group.Store == nil {
+		member.refuse(request, CodeUnsupportedType, "the server doesn't keep a history")
+		return
+	}
+
+	limit := member.Config.HistoryPageSize
+	if request.Payload != nil {
+		var options HistoryRequest
+		// the payload was decoded by the codec of the member so it is brought into shape through JSON
+		data, err := json.Marshal(request.Payload)
+		if err == nil {
+			err = json.Unmarshal(data, &options)
+		}
+		if err != nil {
+			member.reject(request, CodeInvalidJSON, "history payload could not be decoded: %v", err)
+			return
+		}
+		if options.Limit > 0 {
+			limit = min(options.Limit, limit)
+		}
+	}
+
+	key := RoomConversation(group.Name)
+	if request.To != "" {
+		key = DMConversation(group.Name, member.ID, request.To)
+	}
+	// one more than asked for tells whether there is anything before the page
+	messages, err := group.Store.History(key, request.Seq, limit+1)
+	if err != nil {
+		member.log.Error("Could not read the history", "conversation", key, "error", err)
+		member.refuse(request, CodeUndeliverable, "the history could not be read")
+		return
+	}
+	payload := HistoryPayload{Messages: messages}
+	if messages == nil {
+		payload.Messages = []Envelope{}
+	}
+	if len(messages) > limit {
+		payload.Messages = messages[1:]
+		payload.Cursor = payload.Messages[0].Seq
+	}
+	member.deliver(Envelope{Type: TypeHistory, ID: request.ID, To: request.To, Room: group.Name, Payload: payload})
+}
@@ -0,0 +1,48 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// The formats the log can be written in.
+const (
+	LOG_FORMAT_TEXT string = "text" // logfmt style key=value pairs
+	LOG_FORMAT_JSON string = "json" // one JSON object per line
+)
+
+// NewLogger returns the logger the config asks for, writing to w. Every package logs through slog.Default so main
+// installs it with slog.SetDefault.
+func NewLogger(config *Config, w io.Writer) (*slog.Logger, error) {
+	options := &slog.HandlerOptions{Level: config.LogLevel}
+	switch config.LogFormat {
+	case LOG_FORMAT_TEXT:
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case LOG_FORMAT_JSON:
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	}
+	return nil, fmt.Errorf("log format must be text or json but is %q", config.LogFormat)
+}
+
+// payloadAttr is the attribute the payload of the envelope is logged as. With RedactPayloads only its size is logged
+// so that chat contents never end up in the log. The payload is only rendered once a record is written, so that it
+// costs nothing while debug logging is off.
+func payloadAttr(config *Config, envelope Envelope) slog.Attr {
+	// a group without a key is inlined, so this ends up as payload or payload_bytes
+	return slog.Any("", payloadValue{config.RedactPayloads, envelope})
+}
+
+// payloadValue renders the payload of an envelope for payloadAttr.
+type payloadValue struct {
+	redact   bool
+	envelope Envelope
+}
+
+func (payload payloadValue) LogValue() slog.Value {
+	text := payload.envelope.text()
+	if payload.redact {
+		return slog.GroupValue(slog.Int("payload_bytes", len(text)))
+	}
+	return slog.GroupValue(slog.String("payload", text))
+}
@@ -1,169 +1,511 @@
 package pkg
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
-	"encoding/json"
 
 	"github.com/gorilla/websocket"
 )
 
-
 // test cases
 // Test whether the server can maintain multiple connections or not
 // Test whether we recieve Ping message after every second from server or not
 // Test if an inactive client tries to send the connection is it able to
 // Test DM and test broadcase
 
-
-const PING_INTERVAL int = 15 // in seconds regularly ping members 
-const TIME_OUT_INTERVAL int = 240 // in seconds this is the time we will wait for client to send us messages before trying to gracefully shutdown the connection
-const READ_DEADLINE int = 10 // in millseconds this will set a read timeout on the ReadMessage so that we break out of the read message blocking call 
-const SOCKET_COOLDOWN_PERIOD int = 20 // in milliseconds use time.Sleep in order for read to timeout and then we can close the TCP connection
-
-
-// A Member can be thought of a websocket connection. It also contains ID (unique identified to identify the member), the pointer to 
-// corresponding websocket connection and pointer to the group that a particular member belong to. A group is initialized at the application
-// start. So currently this application supports a single group. 
+// A Member can be thought of a websocket connection. It also contains ID (unique identified to identify the member), the pointer to
+// corresponding websocket connection and pointer to the group that a particular member belong to. The Group is the room the member
+// connected to. When the member was created through a room registry (Rooms) it can join and leave further rooms over the same
+// socket, all of which are tracked in groups. Codec is negotiated through the websocket subprotocol on upgrade and is
+// nil for members speaking the legacy protocol of bare strings.
+//
+// Messages to a member are never written by the groups directly. They are put on a bounded send queue which is drained
+// by the member's own writer goroutine, and Overflow decides what happens when the member can't keep up.
+//
+// Roles decide which requests the member may send, see RolePermissions, and the rate limits of the config how many.
 type Member struct {
-	ID string
+	ID         string
 	Connection *websocket.Conn
-	Group *Group
-	IsActive bool
+	Group      *Group
+	Rooms      *Rooms
+	Codec      Codec
+	Config     *Config
+	Overflow   OverflowPolicy
+	Roles      Roles
+	active     atomic.Bool
+	mu         sync.Mutex
+	groups     map[string]*Group
+	queue      chan frame
+	dropped    atomic.Int64
+	dropping   atomic.Bool // the send queue overflowed and has not caught up since, see overflow
+	messages   *TokenBucket
+	bytes      *TokenBucket
+	limited    bool // the member was told that it is over its limits and is not told again until it is within them
+	closed     chan struct{}
+	closeOnce  sync.Once
+	evicted    chan struct{}
+	evictOnce  sync.Once
+	evictCode  int
+	evictText  string
+	evictFlush bool
+	peerCode   atomic.Int64 // the close code the member sent, zero when the server closed the connection
+	log        *slog.Logger // carries the member_id, remote_addr and group of the member
+	draining   chan struct{}
+	drainOnce  sync.Once
+	drained    chan struct{}
+	// session resumption, see session.go
+	resumeToken string
+	sent        *ring                  // the last broadcasts and DMs to the member, nil when the member can't resume
+	parked      atomic.Bool            // the connection is gone but the member stays in its rooms until it resumes
+	resumed     atomic.Pointer[Member] // the parked member this member took over
+	lastSeq     uint64                 // the last message of the resumed member that the client got
+}
+
+func NewMember(id string, connection *websocket.Conn, config *Config) *Member {
+	member := &Member{
+		ID:         id,
+		Connection: connection,
+		Config:     config,
+		Overflow:   config.SendQueueOverflow,
+		Roles:      slices.Clone(config.DefaultRoles),
+		queue:      make(chan frame, config.SendQueueSize),
+		messages:   NewTokenBucket(config.MemberMessageRate, config.MemberMessageBurst),
+		bytes:      NewTokenBucket(config.MemberByteRate, config.MemberByteBurst),
+		closed:     make(chan struct{}),
+		evicted:    make(chan struct{}),
+		draining:   make(chan struct{}),
+		drained:    make(chan struct{}),
+	}
+	member.log = slog.Default().With("member_id", id)
+	if connection != nil {
+		member.log = member.log.With("remote_addr", connection.RemoteAddr().String())
+	}
+	member.active.Store(true)
+	return member
+}
+
+// IsActive reports whether the connection to the member is still open. It is safe to call from any goroutine.
+func (member *Member) IsActive() bool {
+	return member.active.Load()
 }
 
 // This is package private intermediate object.
 type message struct {
-	MessageType int 
-	Body string
+	MessageType int
+	Body        []byte
 }
 
-// The Chat contains ID of the member to which we need to send the message to normally. But there are two special cases:
+// The Chat is the legacy message format which is still accepted next to the versioned Envelope. It is converted to
+// the equivalent envelope as soon as it is parsed.
+//
+// The Chat contains ID of the member to which we need to send the message to normally. But there are a few special cases:
 // 1. When ID is '0' the server returns the ID of the member which is trying to send.
 // 2. When ID is '-1' the server treats it as a request to broadcase the message to all the members of the group.
+// 3. When ID is '-2' the server adds the member to the room named in Room.
+// 4. When ID is '-3' the server removes the member from the room named in Room.
+// Broadcasts and DMs go to the room named in Room if the member has joined it and to the member's own group otherwise.
 type Chat struct {
-	ID string `json:"id"`
+	ID      string `json:"id"`
 	Message string `json:"message"`
+	Room    string `json:"room,omitempty"`
+}
+
+// joined records that the member is now part of the group.
+func (member *Member) joined(group *Group) {
+	member.mu.Lock()
+	defer member.mu.Unlock()
+	if member.groups == nil {
+		member.groups = make(map[string]*Group)
+	}
+	member.groups[group.Name] = group
+}
+
+// room returns the joined group with the given name and falls back to the member's own group.
+func (member *Member) room(name string) *Group {
+	member.mu.Lock()
+	defer member.mu.Unlock()
+	if group, ok := member.groups[name]; ok && name != "" {
+		return group
+	}
+	return member.Group
+}
+
+func (member *Member) join(name string) error {
+	if name == "" {
+		return errors.New("can't join a room without a name")
+	}
+	if member.Rooms == nil {
+		return fmt.Errorf("can't join room %s as the member didn't connect through a room", name)
+	}
+	member.mu.Lock()
+	_, ok := member.groups[name]
+	member.mu.Unlock()
+	if ok {
+		return fmt.Errorf("already part of room %s", name)
+	}
+	if member.Rooms.banned(name, member.ID) {
+		return fmt.Errorf("banned from room %s", name)
+	}
+	group := member.Rooms.Join(name, member)
+	if group == nil {
+		return fmt.Errorf("can't join room %s as the server is shutting down", name)
+	}
+	member.joined(group)
+	member.log.Info("Joined room", "room", name)
+	return nil
+}
+
+// forget drops the group from the rooms of the member after the member was removed from it by the group.
+func (member *Member) forget(group *Group) {
+	member.mu.Lock()
+	defer member.mu.Unlock()
+
+	if member.groups[group.Name] == group {
+		delete(member.groups, group.Name)
+	}
+}
+
+func (member *Member) leave(name string) error {
+	if name == member.Group.Name {
+		return fmt.Errorf("can't leave room %s as it is the room the member connected to", name)
+	}
+	member.mu.Lock()
+	group, ok := member.groups[name]
+	delete(member.groups, name)
+	member.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("can't leave room %s as the member is not part of it", name)
+	}
+	group.remove(member)
+	member.log.Info("Left room", "room", name)
+	return nil
+}
+
+// receive decodes a data message sent by the member and handles it. Text messages are always JSON (either an envelope
+// or the legacy Chat) while binary messages are decoded with the binary codec the member negotiated.
+func (member *Member) receive(message message) {
+	kind := "invalid"
+	defer func() { MessagesIn.Inc(kind) }()
+
+	// every message counts against the limits of the member, including the ones that turn out to be invalid
+	refused, ok := member.take(
+		rateLimit{"member_messages", member.messages, 1},
+		rateLimit{"member_bytes", member.bytes, float64(len(message.Body))},
+	)
+	if !ok && (refused == "" || member.Config.RateLimitAction == RateLimitDisconnect || member.limited) {
+		// closed, disconnected or already told that it is over its limits
+		return
+	}
+	member.limited = !ok
+
+	var codec Codec = JSONCodec{}
+	if message.MessageType == websocket.BinaryMessage {
+		if member.Codec == nil || member.Codec.MessageType() != websocket.BinaryMessage {
+			member.reject(Envelope{}, CodeUnsupportedType, "binary messages need a binary subprotocol")
+			return
+		}
+		codec = member.Codec
+	}
+
+	if len(message.Body) > member.Config.MaxPayloadSize {
+		member.reject(Envelope{}, CodePayloadTooLarge, "message of %d bytes is larger than %d bytes", len(message.Body), member.Config.MaxPayloadSize)
+		return
+	}
+	if message.MessageType == websocket.TextMessage && jsonDepth(message.Body) > member.Config.MaxJSONDepth {
+		member.reject(Envelope{}, CodeInvalidJSON, "message is nested deeper than %d levels", member.Config.MaxJSONDepth)
+		return
+	}
+	envelope, err := DecodeMessage(codec, message.Body)
+	if errors.Is(err, ErrNestedTooDeep) {
+		member.reject(envelope, CodeInvalidJSON, "message is nested deeper than %d levels", member.Config.MaxJSONDepth)
+		return
+	} else if errors.Is(err, ErrUnsupportedVersion) {
+		member.reject(envelope, CodeUnsupportedVersion, "only version %d is supported", PROTOCOL_VERSION)
+		return
+	} else if err != nil {
+		member.reject(envelope, CodeInvalidJSON, "message could not be decoded: %v", err)
+		return
+	}
+	// binary messages can only be measured once decoded, the envelope itself is the first level
+	if message.MessageType == websocket.BinaryMessage && 1+valueDepth(envelope.Payload, member.Config.MaxJSONDepth) > member.Config.MaxJSONDepth {
+		member.reject(envelope, CodeInvalidJSON, "message is nested deeper than %d levels", member.Config.MaxJSONDepth)
+		return
+	}
+	kind = inboundKind(envelope.Type)
+	if !ok {
+		member.refuse(envelope, CodeRateLimited, "%s rate limit exceeded", refused)
+		return
+	}
+	member.handle(envelope)
+}
+
+// handle acts on an envelope sent by the member.
+func (member *Member) handle(envelope Envelope) {
+	envelope.From = member.ID
+	switch envelope.Type {
+	case TypeBroadcast:
+		if !member.can(PermissionBroadcast) {
+			member.refuse(envelope, CodeForbidden, "broadcast needs the %s permission", PermissionBroadcast)
+			return
+		}
+		member.log.Debug("Received a broadcast", "id", envelope.ID, "room", envelope.Room, payloadAttr(member.Config, envelope))
+		member.room(envelope.Room).broadcast(envelope)
+	case TypeWhoami:
+		member.log.Debug("Received a whoami", "id", envelope.ID)
+		member.deliver(Envelope{Type: TypeWhoami, ID: envelope.ID, To: member.ID, Payload: member.ID})
+	case TypeJoin, TypeLeave:
+		change := member.join
+		if envelope.Type == TypeLeave {
+			change = member.leave
+		}
+		if err := change(envelope.Room); err != nil {
+			member.refuse(envelope, CodeInvalidRoom, "%v", err)
+			return
+		}
+		member.acknowledge(envelope)
+	case TypeDM, TypeRead:
+		if envelope.To == "" {
+			member.refuse(envelope, CodeUnknownRecipient, "%s without a recipient", envelope.Type)
+			return
+		}
+		if envelope.Type == TypeDM && !member.can(PermissionDM) {
+			member.refuse(envelope, CodeForbidden, "dm needs the %s permission", PermissionDM)
+			return
+		}
+		member.log.Debug("Received a direct message", "type", envelope.Type, "id", envelope.ID, "to", envelope.To, "room", envelope.Room, payloadAttr(member.Config, envelope))
+		member.room(envelope.Room).dm(envelope)
+	case TypeKick, TypeMute, TypeUnmute, TypeBan, TypeUnban:
+		if envelope.To == "" {
+			member.refuse(envelope, CodeUnknownRecipient, "%s without a member", envelope.Type)
+			return
+		}
+		if !member.can(PermissionModerate) {
+			member.refuse(envelope, CodeForbidden, "%s needs the %s permission", envelope.Type, PermissionModerate)
+			return
+		}
+		member.room(envelope.Room).moderate(envelope)
+	case TypeHistory:
+		member.history(envelope)
+	default:
+		member.reject(envelope, CodeUnsupportedType, "type %q is not supported", envelope.Type)
+	}
 }
 
+// leaveAll removes the member from all its groups.
+func (member *Member) leaveAll() {
+	member.mu.Lock()
+	groups := member.groups
+	member.groups = nil
+	member.mu.Unlock()
+	for _, group := range groups {
+		if group != member.Group {
+			group.remove(member)
+		}
+	}
+	member.Group.remove(member)
+}
 
 func (member *Member) GracefulClose() error {
-	member.Group.RemoveMember <- member
-	member.IsActive = false
-	deadline := time.Now().Add(time.Duration(READ_DEADLINE) * time.Millisecond)  
-    err := member.Connection.WriteControl(  
-        websocket.CloseMessage,  
-        websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),  
-        deadline,  
-    )  
-    if err != nil {  
-        return err  
-    }  
-    // Set deadline for reading the next message
-    err = member.Connection.SetReadDeadline(time.Now().Add(time.Duration(READ_DEADLINE) * time.Millisecond))  
-	time.Sleep(time.Duration(SOCKET_COOLDOWN_PERIOD) * time.Millisecond)
-    if err != nil {  
-        return err  
-    }  
-    // Close the TCP connection
-    err = member.Connection.Close()  
-    if err != nil {  
-        return err  
-    }  
-    return nil  
+	return member.close(websocket.CloseNormalClosure, "")
+}
+
+// drain lets the writer flush the messages that are still queued, waiting at most the configured DrainTimeout, and
+// then closes the connection with the given code.
+func (member *Member) drain(code int, text string) error {
+	member.drainOnce.Do(func() {
+		close(member.draining)
+	})
+	select {
+	case <-member.drained:
+	case <-time.After(member.Config.DrainTimeout):
+		member.log.Warn("Gave up flushing the send queue", "drain_timeout", member.Config.DrainTimeout)
+	}
+	return member.close(code, text)
+}
+
+// close removes the member from all its groups, unless it is parked to resume its session, stops its writer and closes
+// the connection with the given code.
+func (member *Member) close(code int, text string) error {
+	member.closeOnce.Do(func() {
+		// parked before the send queue is closed so that no message in between is lost for the replay
+		if member.Rooms != nil && member.resumable(code) {
+			member.Rooms.park(member)
+		}
+		close(member.closed)
+		if peerCode := member.peerCode.Load(); peerCode != 0 {
+			ClosesTotal.Inc(strconv.FormatInt(peerCode, 10), "client")
+		} else {
+			ClosesTotal.Inc(strconv.Itoa(code), "server")
+		}
+		if member.Rooms != nil {
+			member.Rooms.unclaim(member.ID)
+		}
+	})
+	if !member.parked.Load() {
+		member.leaveAll()
+	}
+	member.active.Store(false)
+	deadline := time.Now().Add(member.Config.ReadDeadline)
+	err := member.Connection.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, text),
+		deadline,
+	)
+	if err != nil {
+		// the connection is most likely broken already but the TCP connection still needs closing
+		member.Connection.Close()
+		return err
+	}
+	// Set deadline for reading the next message
+	err = member.Connection.SetReadDeadline(time.Now().Add(member.Config.ReadDeadline))
+	time.Sleep(member.Config.SocketCooldownPeriod)
+	if err != nil {
+		member.Connection.Close()
+		return err
+	}
+	// Close the TCP connection
+	err = member.Connection.Close()
+	if err != nil {
+		return err
+	}
+	return nil
 }
 
+// readMessage reads the messages of the member until reading fails. Messages larger than the MaxFrameSize are never
+// read into memory, the connection is closed with CloseMessageTooBig instead. When reading fails for any other reason
+// than the connection being closed the member's loop is asked to close the connection right away instead of waiting
+// for the timeout.
 func (member *Member) readMessage(channel chan<- message) {
 	for {
 		messageType, body, err := member.Connection.ReadMessage()
 		if err != nil {
-			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
-				log.Printf("Stopping reading from member with id %s as we got close error %v", member.ID, err)
+			select {
+			case <-member.closed:
+				member.log.Debug("Stopped reading as the connection is closed", "error", err)
 				return
+			default:
 			}
-			log.Printf("Error while reading message from connection with ID %s %v \n", member.ID, err)
+			if errors.Is(err, websocket.ErrReadLimit) {
+				member.log.Warn("Closing the connection as the member sent a message that is too large", "max_frame_size", member.Config.MaxFrameSize)
+				member.disconnect(websocket.CloseMessageTooBig, fmt.Sprintf("message larger than %d bytes", member.Config.MaxFrameSize), false)
+				return
+			}
+			member.log.Info("Could not read from the connection", "error", err)
+			// the member went away without a close frame
+			member.peerCode.CompareAndSwap(0, websocket.CloseAbnormalClosure)
+			member.disconnect(websocket.CloseNormalClosure, "", false)
 			return
 		}
 
-		message := message{messageType, string(body)}
-		channel <- message
+		message := message{messageType, body}
+		select {
+		case channel <- message:
+		case <-member.closed:
+			return
+		}
 	}
 }
 
 func (member *Member) Activate() {
 	messageChan := make(chan message)
-	go member.readMessage(messageChan)
 
-	ticker := time.NewTicker(time.Duration(PING_INTERVAL) * time.Second)
+	ticker := time.NewTicker(member.Config.PingInterval)
 	defer ticker.Stop()
 
-	timeoutChan := time.After(time.Duration(TIME_OUT_INTERVAL) * time.Second) 
+	timeoutChan := time.After(member.Config.TimeoutInterval)
+	// the control handlers run on the reader goroutine so they only signal the loop to reset the timeout
+	heartbeat := make(chan struct{}, 1)
+	beat := func() {
+		select {
+		case heartbeat <- struct{}{}:
+		default:
+		}
+	}
 
 	member.Connection.SetPingHandler(func(appData string) error {
-		timeoutChan = time.After(time.Duration(TIME_OUT_INTERVAL) * time.Second)
-		log.Printf("Recieved ping from member %s", member.ID)
-		err := member.Connection.WriteMessage(websocket.PongMessage, []byte{})
+		beat()
+		member.log.Debug("Received a ping")
+		err := member.Connection.WriteControl(websocket.PongMessage, []byte{}, time.Now().Add(member.Config.ReadDeadline))
 		if err != nil {
-			log.Printf("Failed to send pong to member %s and the error is %v", member.ID, err)
+			member.log.Warn("Could not send a pong", "error", err)
 		}
 		return err
 	})
 
+	// our pings carry the time they were sent, which the pong echoes back
 	member.Connection.SetPongHandler(func(appData string) error {
-		timeoutChan = time.After(time.Duration(TIME_OUT_INTERVAL) * time.Second)
-		log.Printf("Recieved pong from member %s", member.ID)
+		beat()
+		member.log.Debug("Received a pong")
+		if sent, err := strconv.ParseInt(appData, 10, 64); err == nil {
+			PingRTTSeconds.Observe(time.Since(time.Unix(0, sent)).Seconds())
+		}
 		return nil
 	})
 
 	member.Connection.SetCloseHandler(func(code int, text string) error {
-		log.Printf("Shutting down connection with Member %s as requested", member.ID)
+		member.log.Info("Closing the connection as the member asked for it", "code", code)
+		member.peerCode.Store(int64(code))
 		err := member.GracefulClose()
 		if err != nil {
-			log.Printf("Error occurred while closing the websocket connection %v with member %s", err, member.ID)
+			member.log.Warn("Could not close the connection", "error", err)
 		}
 		return err
 	})
 
-    for member.IsActive {
+	// the handlers and the limit have to be in place before we start reading
+	member.Connection.SetReadLimit(member.Config.MaxFrameSize)
+	go member.readMessage(messageChan)
+
+	for member.IsActive() {
 		select {
-		case <- ticker.C:
-			log.Printf("Sending scheduled PING to member %s", member.ID)
-			err := member.Connection.WriteMessage(websocket.PingMessage, []byte{})
+		case <-heartbeat:
+			timeoutChan = time.After(member.Config.TimeoutInterval)
+		case <-ticker.C:
+			member.log.Debug("Sending a ping")
+			ping := strconv.AppendInt(nil, time.Now().UnixNano(), 10)
+			err := member.Connection.WriteControl(websocket.PingMessage, ping, time.Now().Add(member.Config.ReadDeadline))
 			if err != nil {
-				log.Printf("Failed to send ping to member %s with error %v", member.ID, err)
+				member.log.Warn("Could not send a ping", "error", err)
 			}
 		case message := <-messageChan:
-			log.Printf("The message type recieved from Member %s is of type %d so resetting timeout", member.ID, message.MessageType)
-			timeoutChan = time.After(time.Duration(TIME_OUT_INTERVAL) * time.Second)
+			member.log.Debug("Received a message so resetting the timeout", "message_type", message.MessageType, "bytes", len(message.Body))
+			timeoutChan = time.After(member.Config.TimeoutInterval)
+			BytesIn.Add(float64(len(message.Body)))
 
 			// handle messages
 			switch message.MessageType {
-			case websocket.BinaryMessage:
-				log.Printf("Skipping the binary message recieved from member %s as it is not supported", member.ID)
-			case websocket.TextMessage:
-				var chat Chat
-				json.Unmarshal([]byte(message.Body), &chat)
-				if chat.ID == "-1" {
-					log.Printf("Recived a TEXT message %s from the member with ID %s to broadcast", chat.Message, member.ID)
-					member.Group.BroadcastMessage <- chat.Message
-				} else if chat.ID == "0" {
-					log.Printf("Recived a TEXT message %s from the member with ID %s to send back the member's ID", chat.Message, member.ID)
-					member.Connection.WriteMessage(1, []byte(member.ID))
-				} else {
-					log.Printf("Recived a TEXT message %s from the member with ID %s to DM to member %s", chat.Message, member.ID, chat.ID)
-					member.Group.DM <- chat
-				}
+			case websocket.BinaryMessage, websocket.TextMessage:
+				member.receive(message)
 			default:
-				log.Printf("Closing the connection as recieved unknown message type from the client with ID %s", member.ID)
+				member.log.Warn("Received a message of an unknown type", "message_type", message.MessageType)
 			}
+		// handle slow or broken consumers and members removed by an admin
+		case <-member.evicted:
+			member.log.Info("Closing the connection", "code", member.evictCode, "reason", member.evictText)
+			closeWith := member.close
+			if member.evictFlush {
+				closeWith = member.drain
+			}
+			err := closeWith(member.evictCode, member.evictText)
+			if err != nil {
+				member.log.Warn("Could not close the connection", "error", err)
+			}
+		// the connection was closed from outside of this loop, e.g. because the server is shutting down
+		case <-member.closed:
+			return
 		// handle time out
 		case <-timeoutChan:
-			log.Printf("Shutting down connection with Member %s due to inactivity.", member.ID)
+			member.log.Info("Closing the connection due to inactivity", "timeout", member.Config.TimeoutInterval)
 			err := member.GracefulClose()
 			if err != nil {
-				log.Printf("Error occurred while closing the websocket connection %v with member %s", err, member.ID)
+				member.log.Warn("Could not close the connection", "error", err)
 			}
 		}
-    }
+	}
 }
-
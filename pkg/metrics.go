@@ -0,0 +1,326 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The metrics are written in the Prometheus text format by ServeMetrics, so any Prometheus compatible scraper can
+// collect them, and they are plain values in memory otherwise, so tests can read them without any collector.
+var (
+	MembersGauge   = NewGauge("websocket_members", "Members currently in the rooms, once for every room they are in.")
+	UpgradesTotal  = NewCounter("websocket_upgrades_total", "Upgrade requests by result.", "result")
+	MessagesIn     = NewCounter("websocket_messages_in_total", "Messages received from members by type.", "type")
+	MessagesOut    = NewCounter("websocket_messages_out_total", "Messages written to members by type.", "type")
+	BytesIn        = NewCounter("websocket_bytes_in_total", "Bytes received from members.")
+	BytesOut       = NewCounter("websocket_bytes_out_total", "Bytes written to members before compression.")
+	FanOutSeconds  = NewHistogram("websocket_broadcast_fanout_seconds", "Time to queue a broadcast for every member of a room.", []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1})
+	SendQueueDepth = NewHistogram("websocket_send_queue_depth", "Messages pending in the send queue of a member when a message is queued.", []float64{0, 1, 4, 16, 64, 256, 1024})
+	QueueOverflows = NewCounter("websocket_send_queue_overflows_total", "Messages that did not fit into the send queue of a member by overflow policy.", "policy")
+	BusDrops       = NewCounter("websocket_bus_dropped_total", "Messages that were not published on the bus as its queue was full or it failed.", "reason")
+	PingRTTSeconds = NewHistogram("websocket_ping_rtt_seconds", "Round trip time of the pings sent to members.", []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5})
+	ClosesTotal    = NewCounter("websocket_closes_total", "Closed connections by close code and by who closed them.", "code", "initiator")
+)
+
+// inboundKind is the type label of MessagesIn for an envelope sent by a member. Types the server doesn't handle are
+// counted together so that clients can't create series at will.
+func inboundKind(kind string) string {
+	switch kind {
+	case TypeBroadcast, TypeWhoami, TypeJoin, TypeLeave, TypeDM, TypeRead, TypeKick, TypeMute, TypeUnmute, TypeBan, TypeUnban, TypeHistory:
+		return kind
+	}
+	return "unsupported"
+}
+
+// metric is anything that can write itself in the Prometheus text format.
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	metricsMu sync.Mutex
+	metrics   []metric
+)
+
+func register[M metric](m M) M {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	metrics = append(metrics, m)
+	return m
+}
+
+// ServeMetrics writes all the metrics in the Prometheus text format.
+func ServeMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	WriteMetrics(w)
+}
+
+// WriteMetrics writes all the metrics in the Prometheus text format in the order they were created.
+func WriteMetrics(w io.Writer) {
+	metricsMu.Lock()
+	all := append([]metric(nil), metrics...)
+	metricsMu.Unlock()
+
+	for _, m := range all {
+		m.write(w)
+	}
+}
+
+// float is a float64 that can be changed atomically.
+type float struct {
+	bits atomic.Uint64
+}
+
+func (value *float) Add(delta float64) {
+	for {
+		old := value.bits.Load()
+		if value.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (value *float) Set(v float64) {
+	value.bits.Store(math.Float64bits(v))
+}
+
+func (value *float) Load() float64 {
+	return math.Float64frombits(value.bits.Load())
+}
+
+// family holds one series per combination of label values.
+type family[S any] struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	mu     sync.RWMutex
+	series map[string]*S
+	values map[string][]string
+	create func() *S
+}
+
+func newFamily[S any](name string, help string, kind string, labels []string, create func() *S) *family[S] {
+	return &family[S]{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*S), values: make(map[string][]string), create: create}
+}
+
+// with returns the series of the label values, creating it if needed.
+func (f *family[S]) with(values []string) *S {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s needs %d label values but got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	f.mu.RLock()
+	series, ok := f.series[key]
+	f.mu.RUnlock()
+	if ok {
+		return series
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if series, ok := f.series[key]; ok {
+		return series
+	}
+	series = f.create()
+	f.series[key] = series
+	f.values[key] = append([]string(nil), values...)
+	return series
+}
+
+func (f *family[S]) delete(values []string) {
+	key := strings.Join(values, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.series, key)
+	delete(f.values, key)
+}
+
+// each calls fn for every series sorted by label values so that the output is stable.
+func (f *family[S]) each(fn func(labels string, series *S)) {
+	f.mu.RLock()
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	type entry struct {
+		labels string
+		series *S
+	}
+	entries := make([]entry, 0, len(keys))
+	for _, key := range keys {
+		entries = append(entries, entry{formatLabels(f.labels, f.values[key]), f.series[key]})
+	}
+	f.mu.RUnlock()
+
+	for _, entry := range entries {
+		fn(entry.labels, entry.series)
+	}
+}
+
+func (f *family[S]) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+}
+
+// formatLabels renders the labels as {name="value",...}, escaping the values as the text format requires.
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var builder strings.Builder
+	builder.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			builder.WriteByte(',')
+		}
+		builder.WriteString(name)
+		builder.WriteString(`="`)
+		builder.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i]))
+		builder.WriteByte('"')
+	}
+	builder.WriteByte('}')
+	return builder.String()
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Counter is a value that only goes up, with one series per combination of label values.
+type Counter struct {
+	family *family[float]
+}
+
+func NewCounter(name string, help string, labels ...string) *Counter {
+	return register(&Counter{newFamily(name, help, "counter", labels, func() *float { return &float{} })})
+}
+
+// Inc adds one to the series of the label values.
+func (counter *Counter) Inc(values ...string) {
+	counter.family.with(values).Add(1)
+}
+
+// Add adds the delta to the series of the label values.
+func (counter *Counter) Add(delta float64, values ...string) {
+	counter.family.with(values).Add(delta)
+}
+
+// Value returns the value of the series of the label values.
+func (counter *Counter) Value(values ...string) float64 {
+	return counter.family.with(values).Load()
+}
+
+func (counter *Counter) write(w io.Writer) {
+	counter.family.header(w)
+	counter.family.each(func(labels string, value *float) {
+		fmt.Fprintf(w, "%s%s %s\n", counter.family.name, labels, formatFloat(value.Load()))
+	})
+}
+
+// Gauge is a value that goes up and down, with one series per combination of label values.
+type Gauge struct {
+	family *family[float]
+}
+
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	return register(&Gauge{newFamily(name, help, "gauge", labels, func() *float { return &float{} })})
+}
+
+// Set sets the series of the label values.
+func (gauge *Gauge) Set(value float64, values ...string) {
+	gauge.family.with(values).Set(value)
+}
+
+// Add adds the delta, which may be negative, to the series of the label values.
+func (gauge *Gauge) Add(delta float64, values ...string) {
+	gauge.family.with(values).Add(delta)
+}
+
+// Value returns the value of the series of the label values.
+func (gauge *Gauge) Value(values ...string) float64 {
+	return gauge.family.with(values).Load()
+}
+
+// Delete drops the series of the label values, e.g. when the room it is about is torn down.
+func (gauge *Gauge) Delete(values ...string) {
+	gauge.family.delete(values)
+}
+
+func (gauge *Gauge) write(w io.Writer) {
+	gauge.family.header(w)
+	gauge.family.each(func(labels string, value *float) {
+		fmt.Fprintf(w, "%s%s %s\n", gauge.family.name, labels, formatFloat(value.Load()))
+	})
+}
+
+// Histogram counts observations in cumulative buckets with the given upper bounds.
+type Histogram struct {
+	family *family[histogramSeries]
+	bounds []float64
+}
+
+type histogramSeries struct {
+	buckets []atomic.Uint64 // not cumulative, the last one is +Inf
+	count   atomic.Uint64
+	sum     float
+}
+
+func NewHistogram(name string, help string, bounds []float64, labels ...string) *Histogram {
+	histogram := &Histogram{bounds: bounds}
+	histogram.family = newFamily(name, help, "histogram", labels, func() *histogramSeries {
+		return &histogramSeries{buckets: make([]atomic.Uint64, len(bounds)+1)}
+	})
+	return register(histogram)
+}
+
+// Observe records the value in the series of the label values.
+func (histogram *Histogram) Observe(value float64, values ...string) {
+	series := histogram.family.with(values)
+	series.buckets[sort.SearchFloat64s(histogram.bounds, value)].Add(1)
+	series.count.Add(1)
+	series.sum.Add(value)
+}
+
+// Count returns the number of observations in the series of the label values.
+func (histogram *Histogram) Count(values ...string) uint64 {
+	return histogram.family.with(values).count.Load()
+}
+
+func (histogram *Histogram) write(w io.Writer) {
+	name := histogram.family.name
+	histogram.family.header(w)
+	histogram.family.each(func(labels string, series *histogramSeries) {
+		// the le label goes last, after the labels of the series
+		prefix := "{"
+		if labels != "" {
+			prefix = strings.TrimSuffix(labels, "}") + ","
+		}
+		var cumulative uint64
+		for i := range series.buckets {
+			cumulative += series.buckets[i].Load()
+			bound := math.Inf(1)
+			if i < len(histogram.bounds) {
+				bound = histogram.bounds[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%sle=\"%s\"} %d\n", name, prefix, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(series.sum.Load()))
+		fmt.Fprintf(w, "%s_count%s %d\n", name, labels, series.count.Load())
+	})
+}
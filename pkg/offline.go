@@ -0,0 +1,327 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrOfflineQueueFull is returned by OfflineQueue.Push when the recipient already has OfflineQueueSize DMs waiting.
+var ErrOfflineQueueFull = errors.New("offline queue is full")
+
+// ErrOfflineQueuesFull is returned by OfflineQueue.Push when OfflineRecipients members or OfflineMessages DMs are
+// waiting already.
+var ErrOfflineQueuesFull = errors.New("offline queues are full")
+
+// ErrUnknownRecipient is returned by OfflineQueue.Push for recipients that were never seen to authenticate.
+var ErrUnknownRecipient = errors.New("recipient never connected")
+
+// OfflineQueue holds the DMs sent to members that are not connected until they connect again, when they get them in
+// order right after their welcome message. DMs are only kept for members that were seen to authenticate, so that
+// nobody can make the server keep DMs for made up IDs. Every member has at most OfflineQueueSize DMs waiting, at most
+// OfflineRecipients members have DMs waiting and at most OfflineMessages DMs wait altogether. DMs waiting longer than the
+// OfflineTTL are dropped.
+//
+// With an OfflineFile every change is appended to the file as a JSON line, either a member that was seen, a DM that was
+// queued or the queue of a member that was taken, so that the queues survive restarts. The file is compacted to the
+// members seen and the DMs still waiting whenever it is opened.
+type OfflineQueue struct {
+	size       int
+	recipients int
+	messages   int
+	ttl        time.Duration
+	mu         sync.Mutex
+	queues     map[string][]offlineMessage
+	queued     int                 // the DMs in all the queues
+	seen       map[string]struct{} // the members that authenticated
+	swept      time.Time
+	file       *os.File // nil keeps the queues in memory only
+}
+
+type offlineMessage struct {
+	Message Envelope  `json:"message"`
+	At      time.Time `json:"at"`
+}
+
+// offlineRecord is a line of the offline file.
+type offlineRecord struct {
+	To     string          `json:"to"`
+	Seen   bool            `json:"seen,omitempty"`
+	Queued *offlineMessage `json:"queued,omitempty"`
+	Taken  bool            `json:"taken,omitempty"`
+}
+
+// NewOfflineQueue returns the offline queue the config asks for. It is nil when the OfflineQueueSize is 0 or when
+// there is no authentication, as members get a new random ID on every connection without it and would never get
+// their DMs.
+func NewOfflineQueue(config *Config) (*OfflineQueue, error) {
+	if config.OfflineQueueSize == 0 || config.AuthMode == AUTH_MODE_NONE || config.AuthMode == "" {
+		return nil, nil
+	}
+	queue := &OfflineQueue{
+		size:       config.OfflineQueueSize,
+		recipients: config.OfflineRecipients,
+		messages:   config.OfflineMessages,
+		ttl:        config.OfflineTTL,
+		queues:     make(map[string][]offlineMessage),
+		seen:       make(map[string]struct{}),
+		swept:      time.Now(),
+	}
+	if config.OfflineFile != "" {
+		if err := queue.open(config.OfflineFile); err != nil {
+			return nil, err
+		}
+	}
+	return queue, nil
+}
+
+// open replays the file at the path and replaces it with one that only has the DMs that are still waiting.
+func (queue *OfflineQueue) open(path string) error {
+	file, err := os.Open(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not open the offline file: %w", err)
+	}
+	if file != nil {
+		err := queue.replay(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	queue.sweep(time.Now())
+
+	compacted, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("could not compact the offline file: %w", err)
+	}
+	queue.file = compacted
+	for id := range queue.seen {
+		if err := queue.write(offlineRecord{To: id, Seen: true}); err != nil {
+			compacted.Close()
+			return err
+		}
+	}
+	for to, messages := range queue.queues {
+		for _, message := range messages {
+			if err := queue.write(offlineRecord{To: to, Queued: &message}); err != nil {
+				compacted.Close()
+				return err
+			}
+		}
+	}
+	if err := compacted.Sync(); err != nil {
+		compacted.Close()
+		return fmt.Errorf("could not compact the offline file: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		compacted.Close()
+		return fmt.Errorf("could not compact the offline file: %w", err)
+	}
+	return nil
+}
+
+func (queue *OfflineQueue) replay(file io.Reader) error {
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		var record offlineRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// most likely a line that was only partly written when the server died
+			slog.Warn("Skipping a line of the offline file that can't be decoded", "error", err)
+			continue
+		}
+		switch {
+		case record.Seen:
+			queue.seen[record.To] = struct{}{}
+		case record.Taken:
+			delete(queue.queues, record.To)
+		case record.Queued != nil:
+			queue.queues[record.To] = append(queue.queues[record.To], *record.Queued)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("could not read the offline file: %w", err)
+	}
+	return nil
+}
+
+// write appends the record to the offline file, if there is one.
+func (queue *OfflineQueue) write(record offlineRecord) error {
+	if queue.file == nil {
+		return nil
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := queue.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("could not write to the offline file: %w", err)
+	}
+	return nil
+}
+
+// sweep drops the DMs that waited longer than the TTL. The file only forgets them the next time it is compacted.
+func (queue *OfflineQueue) sweep(now time.Time) {
+	queue.queued = 0
+	for to, messages := range queue.queues {
+		if live := queue.live(messages, now); len(live) > 0 {
+			queue.queues[to] = live
+			queue.queued += len(live)
+		} else {
+			delete(queue.queues, to)
+		}
+	}
+	queue.swept = now
+}
+
+// live returns the messages that didn't expire yet, which are at the end as they are queued in order.
+func (queue *OfflineQueue) live(messages []offlineMessage, now time.Time) []offlineMessage {
+	for i, message := range messages {
+		if now.Sub(message.At) < queue.ttl {
+			return messages[i:]
+		}
+	}
+	return nil
+}
+
+// Seen records that the member with the ID authenticated, which lets others leave DMs for it from then on.
+func (queue *OfflineQueue) Seen(id string) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if _, ok := queue.seen[id]; ok {
+		return
+	}
+	queue.seen[id] = struct{}{}
+	if err := queue.write(offlineRecord{To: id, Seen: true}); err != nil {
+		slog.Error("Could not record that a member was seen", "member_id", id, "error", err)
+	}
+}
+
+// Push queues the DM for its recipient. It fails with ErrUnknownRecipient if the recipient was never seen, with
+// ErrOfflineQueueFull if the recipient has too many DMs waiting and with ErrOfflineQueuesFull if too many members or DMs
+// are waiting altogether.
+func (queue *OfflineQueue) Push(message Envelope) error {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if _, ok := queue.seen[message.To]; !ok {
+		return ErrUnknownRecipient
+	}
+	now := time.Now()
+	if now.Sub(queue.swept) >= min(queue.ttl, time.Minute) {
+		queue.sweep(now)
+	}
+	waiting, ok := queue.queues[message.To]
+	// drop the expired DMs for good before anything is refused, as the counts must match what is kept
+	messages := queue.live(waiting, now)
+	queue.queued -= len(waiting) - len(messages)
+	if ok && len(messages) == 0 {
+		delete(queue.queues, message.To)
+		ok = false
+	} else if ok {
+		queue.queues[message.To] = messages
+	}
+	if len(messages) >= queue.size {
+		return ErrOfflineQueueFull
+	}
+	if (!ok && len(queue.queues) >= queue.recipients) || queue.queued >= queue.messages {
+		return ErrOfflineQueuesFull
+	}
+	queued := offlineMessage{Message: message, At: now}
+	if err := queue.write(offlineRecord{To: message.To, Queued: &queued}); err != nil {
+		return err
+	}
+	queue.queues[message.To] = append(messages, queued)
+	queue.queued++
+	return nil
+}
+
+// Take removes and returns the DMs waiting for the member, oldest first.
+func (queue *OfflineQueue) Take(id string) []Envelope {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	waiting, ok := queue.queues[id]
+	if !ok {
+		return nil
+	}
+	messages := queue.live(waiting, time.Now())
+	delete(queue.queues, id)
+	queue.queued -= len(waiting)
+	if err := queue.write(offlineRecord{To: id, Taken: true}); err != nil {
+		slog.Error("Could not record that the offline queue was taken", "member_id", id, "error", err)
+	}
+	taken := make([]Envelope, 0, len(messages))
+	for _, message := range messages {
+		taken = append(taken, message.Message)
+	}
+	return taken
+}
+
+// Close closes the offline file, if there is one.
+func (queue *OfflineQueue) Close() error {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if queue.file == nil {
+		return nil
+	}
+	return queue.file.Close()
+}
+
+// connected reports whether the member with the ID is connected. For a group of a room registry that is any room of
+// the registry, as members connected elsewhere get their DMs there and not the next time they connect. With a presence
+// registry that includes the other nodes.
+func (group *Group) connected(id string) bool {
+	if group.Presence != nil {
+		if node, ok := group.Presence.Locate(id); ok && node != group.Node {
+			return true
+		}
+	}
+	if group.rooms != nil {
+		return group.rooms.connected(id)
+	}
+	_, ok := group.members[id]
+	return ok
+}
+
+// queueOffline keeps the DM for its recipient, who is not connected, and acks it. It is called by the loop.
+func (group *Group) queueOffline(message Envelope) {
+	if err := group.Offline.Push(message); err != nil {
+		group.log.Warn("Could not queue a direct message for a member that is not connected", "from", message.From, "to", message.To, "seq", message.Seq, "error", err)
+		code, text := CodeUndeliverable, fmt.Sprintf("member %s is not connected and the message could not be kept", message.To)
+		switch {
+		case errors.Is(err, ErrUnknownRecipient):
+			code, text = CodeUnknownRecipient, fmt.Sprintf("member %s is not in room %s", message.To, group.Name)
+		case errors.Is(err, ErrOfflineQueueFull):
+			text = fmt.Sprintf("member %s is not connected and has too many messages waiting", message.To)
+		case errors.Is(err, ErrOfflineQueuesFull):
+			text = fmt.Sprintf("member %s is not connected and too many messages are waiting", message.To)
+		}
+		group.reply(message, nackEnvelope(message, code, text))
+		return
+	}
+	group.log.Debug("Queued a direct message for a member that is not connected", "from", message.From, "to", message.To, "seq", message.Seq, payloadAttr(group.Config, message))
+	group.record(message)
+	group.reply(message, ackEnvelope(message))
+}
+
+// deliverOffline sends the member the DMs that were waiting for it. It is called by the loop right after the welcome
+// message, so the DMs come before anything else the member gets.
+func (group *Group) deliverOffline(member *Member) {
+	if group.Offline == nil {
+		return
+	}
+	for _, message := range group.Offline.Take(member.ID) {
+		if !member.deliver(message) {
+			group.log.Warn("Could not queue a direct message that was waiting", "member_id", member.ID, "seq", message.Seq)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package pkg
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// OriginRejections counts the requests refused because of their Origin header, by where they were refused: "upgrade"
+// for websocket upgrades and "cors" for the HTTP endpoints.
+var OriginRejections = NewCounter("websocket_origin_rejections_total", "Requests refused because of their origin by where they were refused.", "where")
+
+// originPattern is an entry of an origin allowlist split into its parts. An empty scheme matches http and https,
+// a host starting with "*." matches every subdomain (but not the domain itself) and "*" alone matches every origin.
+type originPattern struct {
+	scheme string
+	host   string
+	port   string
+}
+
+func parseOriginPattern(pattern string) (originPattern, error) {
+	if pattern == "*" {
+		return originPattern{host: "*"}, nil
+	}
+	var parsed originPattern
+	rest := pattern
+	if scheme, host, ok := strings.Cut(pattern, "://"); ok {
+		if scheme != "http" && scheme != "https" {
+			return parsed, fmt.Errorf("origin %q must be http or https", pattern)
+		}
+		parsed.scheme, rest = scheme, host
+	}
+	if strings.ContainsAny(rest, "/?#@") {
+		return parsed, fmt.Errorf("origin %q must not have a path, query or user", pattern)
+	}
+	if host, port, ok := strings.Cut(rest, ":"); ok {
+		rest, parsed.port = host, port
+	}
+	parsed.host = strings.ToLower(rest)
+	if parsed.host == "" || strings.Contains(strings.TrimPrefix(parsed.host, "*."), "*") {
+		return parsed, fmt.Errorf("origin %q needs a host and may only have a wildcard as its first label", pattern)
+	}
+	return parsed, nil
+}
+
+func (pattern originPattern) matches(origin *url.URL) bool {
+	if pattern.host == "*" {
+		return true
+	}
+	if pattern.scheme != "" && pattern.scheme != origin.Scheme {
+		return false
+	}
+	if pattern.port != origin.Port() {
+		return false
+	}
+	host := strings.ToLower(origin.Hostname())
+	if suffix, ok := strings.CutPrefix(pattern.host, "*"); ok {
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return host == pattern.host
+}
+
+// originAllowed reports whether the origin matches any of the patterns.
+func originAllowed(patterns []string, origin string) bool {
+	parsed, err := url.Parse(origin)
+	if err != nil || parsed.Host == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		if compiled, err := parseOriginPattern(pattern); err == nil && compiled.matches(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrigin is the origin check of the upgrader. Requests without an Origin header don't come from a browser and
+// are always allowed. Without AllowedOrigins only same origin requests are allowed, like the default of the upgrader.
+func checkOrigin(config *Config) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		var allowed bool
+		if len(config.AllowedOrigins) == 0 {
+			parsed, err := url.Parse(origin)
+			allowed = err == nil && strings.EqualFold(parsed.Host, r.Host)
+		} else {
+			allowed = originAllowed(config.AllowedOrigins, origin)
+		}
+		if !allowed {
+			OriginRejections.Inc("upgrade")
+			slog.Info("Refusing to upgrade a connection from an origin that is not allowed", "remote_addr", r.RemoteAddr, "origin", origin)
+		}
+		return allowed
+	}
+}
+
+// CORS wraps a handler of the HTTP endpoints with the CORS policy of the config. Requests from an origin in
+// CORSOrigins get the CORS headers and their preflight requests are answered right away. Requests from any other
+// origin are served without the headers, so that the browser doesn't hand the response to the page, and their
+// preflight requests are refused.
+func CORS(config *Config, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !originAllowed(config.CORSOrigins, origin) {
+			OriginRejections.Inc("cors")
+			slog.Info("Refusing a CORS request from an origin that is not allowed", "path", r.URL.Path, "origin", origin)
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next(w, r)
+	}
+}
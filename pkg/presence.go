@@ -0,0 +1,255 @@
+package pkg
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// presenceTopic is the topic of the presence registry on the bus.
+const presenceTopic = "presence"
+
+// The kinds of messages the presence registries publish on the bus.
+const (
+	presenceHeartbeat = "heartbeat" // all the members connected to the node, renews its lease
+	presenceLeave     = "leave"     // the node is shutting down and its members are gone
+	presenceSync      = "sync"      // asks the other nodes for a heartbeat right away
+)
+
+// presenceMessage is what the presence registries publish on the bus.
+type presenceMessage struct {
+	Node    string        `json:"node"`
+	Number  int           `json:"number"` // the node number in the message IDs of the node
+	Kind    string        `json:"kind"`
+	Lease   time.Duration `json:"lease,omitempty"`
+	Members []string      `json:"members,omitempty"`
+}
+
+// lease is what a node told about itself in its last heartbeat.
+type lease struct {
+	expires time.Time
+	members map[string]struct{}
+}
+
+// Presence is a registry of which node every member is connected to across the nodes of a cluster. Every node publishes
+// the members connected to it on the bus whenever they change and at least every PresenceHeartbeat, which renews its
+// lease for the PresenceLease it asks for. The members of a node whose lease ran out, because it crashed or lost its
+// connection to the bus, are forgotten until it sends a heartbeat again. A node that shuts down tells the others right
+// away.
+type Presence struct {
+	node         string
+	number       int
+	bus          Bus
+	heartbeat    time.Duration
+	lease        time.Duration
+	mu           sync.RWMutex
+	local        map[string]struct{} // the members connected to this node
+	nodes        map[string]*lease   // the leases of the other nodes by node ID
+	changed      chan struct{}       // asks for a heartbeat as the local members changed
+	subscription *Subscription
+	stop         chan struct{}
+	done         chan struct{}
+	once         sync.Once
+}
+
+// StartPresence starts the presence registry of the node on the bus and asks the other nodes who is connected to them.
+func StartPresence(node string, bus Bus, config *Config) (*Presence, error) {
+	subscription, err := bus.Subscribe(presenceTopic)
+	if err != nil {
+		return nil, err
+	}
+	presence := &Presence{
+		node:         node,
+		number:       config.NodeNumber,
+		bus:          bus,
+		heartbeat:    config.PresenceHeartbeat,
+		lease:        config.PresenceLease,
+		local:        make(map[string]struct{}),
+		nodes:        make(map[string]*lease),
+		changed:      make(chan struct{}, 1),
+		subscription: subscription,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	presence.publish(presenceMessage{Kind: presenceSync})
+	presence.beat()
+	go presence.run()
+	return presence, nil
+}
+
+// run sends the heartbeats, expires the leases of the other nodes and takes in their messages until Stop is called.
+func (presence *Presence) run() {
+	defer close(presence.done)
+	ticker := time.NewTicker(presence.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-presence.stop:
+			presence.publish(presenceMessage{Kind: presenceLeave})
+			return
+		case <-ticker.C:
+			presence.beat()
+			presence.expire()
+		case <-presence.changed:
+			presence.beat()
+		case data := <-presence.subscription.C:
+			presence.receive(data)
+		}
+	}
+}
+
+// publish sends the message to the other nodes.
+func (presence *Presence) publish(message presenceMessage) {
+	message.Node, message.Number = presence.node, presence.number
+	data, err := json.Marshal(message)
+	if err == nil {
+		err = presence.bus.Publish(presenceTopic, data)
+	}
+	if err != nil {
+		slog.Error("Could not publish the presence of the node", "node", presence.node, "kind", message.Kind, "error", err)
+	}
+}
+
+// beat publishes all the members connected to this node. Heartbeats carry all of them rather than the changes so that a
+// lost or late heartbeat is made good by the next one.
+func (presence *Presence) beat() {
+	presence.mu.RLock()
+	members := make([]string, 0, len(presence.local))
+	for id := range presence.local {
+		members = append(members, id)
+	}
+	presence.mu.RUnlock()
+	presence.publish(presenceMessage{Kind: presenceHeartbeat, Lease: presence.lease, Members: members})
+}
+
+// expire forgets the other nodes whose lease ran out.
+func (presence *Presence) expire() {
+	presence.mu.Lock()
+	defer presence.mu.Unlock()
+
+	now := time.Now()
+	for node, lease := range presence.nodes {
+		if now.After(lease.expires) {
+			delete(presence.nodes, node)
+			slog.Warn("Node missed its heartbeats, forgetting its members", "node", node, "members", len(lease.members))
+		}
+	}
+}
+
+// receive acts on a message of another node.
+func (presence *Presence) receive(data []byte) {
+	var message presenceMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		slog.Warn("Could not decode a presence message of the bus", "error", err)
+		return
+	}
+	if message.Node == presence.node {
+		return
+	}
+
+	switch message.Kind {
+	case presenceHeartbeat:
+		members := make(map[string]struct{}, len(message.Members))
+		for _, id := range message.Members {
+			members[id] = struct{}{}
+		}
+		presence.mu.Lock()
+		if _, ok := presence.nodes[message.Node]; !ok {
+			slog.Info("Node joined the cluster", "node", message.Node, "members", len(members))
+			if message.Number == presence.number {
+				slog.Error("Node hands out the same message IDs as this one, give one of them another node number", "node", message.Node, "node_number", message.Number)
+			}
+		}
+		presence.nodes[message.Node] = &lease{expires: time.Now().Add(message.Lease), members: members}
+		presence.mu.Unlock()
+	case presenceLeave:
+		presence.mu.Lock()
+		delete(presence.nodes, message.Node)
+		presence.mu.Unlock()
+		slog.Info("Node left the cluster", "node", message.Node)
+	case presenceSync:
+		presence.beat()
+	}
+}
+
+// notify asks for a heartbeat without blocking, a pending one already carries the change.
+func (presence *Presence) notify() {
+	select {
+	case presence.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Online records that the member with the ID is connected to this node.
+func (presence *Presence) Online(id string) {
+	presence.mu.Lock()
+	presence.local[id] = struct{}{}
+	presence.mu.Unlock()
+	presence.notify()
+}
+
+// Offline records that the member with the ID is not connected to this node anymore.
+func (presence *Presence) Offline(id string) {
+	presence.mu.Lock()
+	delete(presence.local, id)
+	presence.mu.Unlock()
+	presence.notify()
+}
+
+// Locate returns the node the member with the ID is connected to. It reports false if the member is neither connected
+// to this node nor to another node with a lease that is still running.
+func (presence *Presence) Locate(id string) (string, bool) {
+	presence.mu.RLock()
+	defer presence.mu.RUnlock()
+
+	if _, ok := presence.local[id]; ok {
+		return presence.node, true
+	}
+	now := time.Now()
+	for node, lease := range presence.nodes {
+		if _, ok := lease.members[id]; ok && now.Before(lease.expires) {
+			return node, true
+		}
+	}
+	return "", false
+}
+
+// Alive reports whether the node is this one or another one with a lease that is still running.
+func (presence *Presence) Alive(node string) bool {
+	if node == presence.node {
+		return true
+	}
+	presence.mu.RLock()
+	defer presence.mu.RUnlock()
+
+	lease, ok := presence.nodes[node]
+	return ok && time.Now().Before(lease.expires)
+}
+
+// Nodes returns the sorted IDs of this node and the other nodes with a lease that is still running.
+func (presence *Presence) Nodes() []string {
+	presence.mu.RLock()
+	defer presence.mu.RUnlock()
+
+	now := time.Now()
+	nodes := []string{presence.node}
+	for node, lease := range presence.nodes {
+		if now.Before(lease.expires) {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// Stop tells the other nodes that the members of this node are gone and stops the registry.
+func (presence *Presence) Stop() {
+	presence.once.Do(func() {
+		close(presence.stop)
+		<-presence.done
+		presence.subscription.Close()
+	})
+}
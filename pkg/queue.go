@@ -0,0 +1,176 @@
+package pkg
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// OverflowPolicy decides what happens when a message is sent to a member whose send queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowDropOldest discards the oldest pending message to make room for the new one.
+	OverflowDropOldest OverflowPolicy = iota
+	// OverflowDropNewest discards the new message and keeps the pending ones.
+	OverflowDropNewest
+	// OverflowDisconnect disconnects the member as it is not able to keep up.
+	OverflowDisconnect
+)
+
+func (policy OverflowPolicy) String() string {
+	switch policy {
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowDropNewest:
+		return "drop-newest"
+	case OverflowDisconnect:
+		return "disconnect"
+	}
+	return "unknown"
+}
+
+func (policy OverflowPolicy) MarshalText() ([]byte, error) {
+	return []byte(policy.String()), nil
+}
+
+func (policy *OverflowPolicy) UnmarshalText(text []byte) error {
+	for _, candidate := range []OverflowPolicy{OverflowDropOldest, OverflowDropNewest, OverflowDisconnect} {
+		if candidate.String() == string(text) {
+			*policy = candidate
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown overflow policy %q", text)
+}
+
+// frame is a single data message waiting in the send queue of a member. Frames shared by many members, see fanOut,
+// also carry the prepared message to write instead of the data. The kind is the envelope type it was encoded from,
+// which is what MessagesOut counts, or "raw" for messages sent with Send.
+type frame struct {
+	messageType int
+	data        []byte
+	prepared    *websocket.PreparedMessage
+	kind        string
+}
+
+// Send queues a text message for the member without blocking the caller. The group loops use this so that one slow
+// member never holds up the rest of the group. It reports false if the message was not queued, either because the
+// member is closed or because the overflow policy discarded it.
+func (member *Member) Send(data []byte) bool {
+	return member.send(frame{messageType: websocket.TextMessage, data: data, kind: "raw"})
+}
+
+func (member *Member) send(message frame) bool {
+	for {
+		select {
+		case <-member.closed:
+			return false
+		default:
+		}
+
+		select {
+		case member.queue <- message:
+			SendQueueDepth.Observe(float64(len(member.queue)))
+			if len(member.queue) < cap(member.queue)/2 && member.dropping.CompareAndSwap(true, false) {
+				member.log.Info("Send queue caught up again", "dropped", member.dropped.Load())
+			}
+			return true
+		default:
+		}
+
+		member.dropped.Add(1)
+		QueueOverflows.Inc(member.Overflow.String())
+		switch member.Overflow {
+		case OverflowDropNewest:
+			member.overflow("Send queue is full so dropping the newest messages")
+			return false
+		case OverflowDisconnect:
+			member.overflow("Send queue is full so disconnecting the member as a slow consumer")
+			member.evict()
+			return false
+		default:
+			select {
+			case <-member.queue:
+				member.overflow("Send queue is full so dropping the oldest messages")
+			default:
+			}
+		}
+	}
+}
+
+// overflow logs that the member started dropping messages. It logs once until the queue is down to half its size again
+// so that a slow consumer in a busy room doesn't flood the log, the drops are counted by QueueOverflows.
+func (member *Member) overflow(text string) {
+	if member.dropping.CompareAndSwap(false, true) {
+		member.log.Warn(text, "dropped", member.dropped.Load())
+	}
+}
+
+// Dropped returns the number of times the send queue of the member overflowed.
+func (member *Member) Dropped() int64 {
+	return member.dropped.Load()
+}
+
+// evict disconnects a member that can't keep up with its messages without trying to flush them.
+func (member *Member) evict() {
+	member.disconnect(websocket.CloseTryAgainLater, "send queue overflow", false)
+}
+
+// disconnect asks the member's own loop to close the connection with the code and text, after flushing the messages
+// that are still queued if flush is set. It is safe to call from any goroutine and more than once, the first call wins.
+func (member *Member) disconnect(code int, text string, flush bool) {
+	member.evictOnce.Do(func() {
+		member.evictCode, member.evictText, member.evictFlush = code, text, flush
+		close(member.evicted)
+	})
+}
+
+// writeMessages is the only goroutine writing data messages to the connection. It drains the send queue until the
+// member is closed or a write fails. When the member is drained it writes whatever is still pending and stops.
+func (member *Member) writeMessages() {
+	defer close(member.drained)
+	for {
+		select {
+		case message := <-member.queue:
+			if !member.writeFrame(message) {
+				return
+			}
+		case <-member.closed:
+			return
+		case <-member.draining:
+			for {
+				select {
+				case message := <-member.queue:
+					if !member.writeFrame(message) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// writeFrame writes a single frame and evicts the member if that fails. Frames below the CompressionThreshold are
+// written uncompressed even if the member negotiated compression.
+func (member *Member) writeFrame(message frame) bool {
+	member.Connection.SetWriteDeadline(time.Now().Add(member.Config.WriteDeadline))
+	member.Connection.EnableWriteCompression(member.Config.Compression && len(message.data) >= member.Config.CompressionThreshold)
+	var err error
+	if message.prepared != nil {
+		err = member.Connection.WritePreparedMessage(message.prepared)
+	} else {
+		err = member.Connection.WriteMessage(message.messageType, message.data)
+	}
+	if err != nil {
+		member.log.Info("Could not write to the member so disconnecting it", "error", err)
+		member.evict()
+		return false
+	}
+	MessagesOut.Inc(message.kind)
+	BytesOut.Add(float64(len(message.data)))
+	return true
+}
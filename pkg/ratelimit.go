@@ -0,0 +1,248 @@
+package pkg
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// RateLimited counts the requests that went over a rate limit, by limit: "member_messages", "member_bytes",
+// "room_broadcasts" and "upgrades".
+var RateLimited = NewCounter("websocket_rate_limited_total", "Requests over a rate limit by limit.", "limit")
+
+// RateLimitAction decides what happens when a member goes over one of its rate limits.
+type RateLimitAction int
+
+const (
+	// RateLimitDrop drops the message and replies with a rate_limited nack or error.
+	RateLimitDrop RateLimitAction = iota
+	// RateLimitThrottle waits until the member is within its limits again, which stops reading from the member.
+	RateLimitThrottle
+	// RateLimitDisconnect disconnects the member.
+	RateLimitDisconnect
+)
+
+func (action RateLimitAction) String() string {
+	switch action {
+	case RateLimitDrop:
+		return "drop"
+	case RateLimitThrottle:
+		return "throttle"
+	case RateLimitDisconnect:
+		return "disconnect"
+	}
+	return "unknown"
+}
+
+func (action RateLimitAction) MarshalText() ([]byte, error) {
+	return []byte(action.String()), nil
+}
+
+func (action *RateLimitAction) UnmarshalText(text []byte) error {
+	for _, candidate := range []RateLimitAction{RateLimitDrop, RateLimitThrottle, RateLimitDisconnect} {
+		if candidate.String() == string(text) {
+			*action = candidate
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown rate limit action %q", text)
+}
+
+// TokenBucket allows Rate tokens per second on average and up to Burst at once. A nil bucket is no limit at all so
+// that disabled limits need no special casing. It is safe to use from any goroutine.
+type TokenBucket struct {
+	Rate   float64
+	Burst  float64
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a full bucket, or nil when the rate is not positive.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &TokenBucket{Rate: rate, Burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (bucket *TokenBucket) refill(now time.Time) {
+	bucket.tokens = math.Min(bucket.Burst, bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.Rate)
+	bucket.last = now
+}
+
+// Allow takes n tokens if there are enough of them and reports whether it did.
+func (bucket *TokenBucket) Allow(n float64) bool {
+	if bucket == nil {
+		return true
+	}
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+
+	bucket.refill(time.Now())
+	if bucket.tokens < n {
+		return false
+	}
+	bucket.tokens -= n
+	return true
+}
+
+// Reserve takes n tokens even if there are not enough of them and returns how long to wait until the debt is paid.
+func (bucket *TokenBucket) Reserve(n float64) time.Duration {
+	if bucket == nil {
+		return 0
+	}
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+
+	bucket.refill(time.Now())
+	bucket.tokens -= n
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / bucket.Rate * float64(time.Second))
+}
+
+// full reports whether the bucket has refilled completely, which makes it the same as a new one.
+func (bucket *TokenBucket) full() bool {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+
+	bucket.refill(time.Now())
+	return bucket.tokens >= bucket.Burst
+}
+
+// keyedLimiter keeps a token bucket per key, e.g. per remote IP. Buckets that refilled completely are forgotten once
+// there are many of them so that the map doesn't grow with every IP ever seen. A nil limiter allows everything.
+type keyedLimiter struct {
+	rate    float64
+	burst   int
+	mu      sync.Mutex
+	buckets map[string]*TokenBucket
+}
+
+const keyedLimiterPruneSize int = 10000
+
+func newKeyedLimiter(rate float64, burst int) *keyedLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &keyedLimiter{rate: rate, burst: burst, buckets: make(map[string]*TokenBucket)}
+}
+
+func (limiter *keyedLimiter) Allow(key string) bool {
+	if limiter == nil {
+		return true
+	}
+	limiter.mu.Lock()
+	if len(limiter.buckets) >= keyedLimiterPruneSize {
+		for key, bucket := range limiter.buckets {
+			if bucket.full() {
+				delete(limiter.buckets, key)
+			}
+		}
+	}
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		bucket = NewTokenBucket(limiter.rate, limiter.burst)
+		limiter.buckets[key] = bucket
+	}
+	limiter.mu.Unlock()
+	return bucket.Allow(1)
+}
+
+// remoteIP returns the IP of the peer of the request without the port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// allowUpgrade applies the per IP upgrade limit and answers requests over it with 429.
+func allowUpgrade(limiter *keyedLimiter, w http.ResponseWriter, r *http.Request) bool {
+	if limiter.Allow(remoteIP(r)) {
+		return true
+	}
+	RateLimited.Inc("upgrades")
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Too many connections", http.StatusTooManyRequests)
+	return false
+}
+
+// rateLimit is a bucket a message takes tokens from, named like its counter in RateLimited.
+type rateLimit struct {
+	name   string
+	bucket *TokenBucket
+	tokens float64
+}
+
+// take charges the message against the limits. Either all of them have enough tokens and they are all taken or none is
+// taken, so that a limit refusing the message doesn't use up the others. When throttling it waits until the member is
+// within the limits instead. It reports whether the message may be handled and returns the name of the limit that
+// refused it otherwise, which is empty when the member was closed while throttled. Members over a limit are
+// disconnected when that is the configured action.
+func (member *Member) take(limits ...rateLimit) (string, bool) {
+	if member.Config.RateLimitAction == RateLimitThrottle {
+		var wait time.Duration
+		for _, limit := range limits {
+			if reserved := limit.bucket.Reserve(limit.tokens); reserved > 0 {
+				RateLimited.Inc(limit.name)
+				wait = max(wait, reserved)
+			}
+		}
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-member.closed:
+				return "", false
+			}
+		}
+		return "", true
+	}
+
+	refused := allowAll(limits)
+	if refused == nil {
+		return "", true
+	}
+	RateLimited.Inc(refused.name)
+	if member.Config.RateLimitAction == RateLimitDisconnect {
+		member.disconnect(websocket.ClosePolicyViolation, "rate limit exceeded", false)
+	}
+	return refused.name, false
+}
+
+// allowAll takes the tokens of every limit if all of them have enough. Otherwise it takes none and returns the first
+// limit without enough tokens. The buckets are locked together so that no other message gets in between.
+func allowAll(limits []rateLimit) *rateLimit {
+	for _, limit := range limits {
+		if limit.bucket != nil {
+			limit.bucket.mu.Lock()
+			defer limit.bucket.mu.Unlock()
+		}
+	}
+	now := time.Now()
+	for i, limit := range limits {
+		if limit.bucket == nil {
+			continue
+		}
+		limit.bucket.refill(now)
+		if limit.bucket.tokens < limit.tokens {
+			return &limits[i]
+		}
+	}
+	for _, limit := range limits {
+		if limit.bucket != nil {
+			limit.bucket.tokens -= limit.tokens
+		}
+	}
+	return nil
+}
@@ -0,0 +1,389 @@
+package pkg
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// redisMaxBulk is the largest bulk string Redis allows, anything larger is a broken stream.
+const redisMaxBulk = 512 * 1024 * 1024
+
+// RedisBus is a bus on Redis pub/sub, spoken with the RESP protocol over plain TCP. Messages are published on one
+// connection by their own goroutine and received on another one in subscribe mode, which is read by another goroutine.
+//
+// Publish only queues the message, so that a slow or unreachable Redis doesn't hold up the rooms. Once busBuffer
+// messages are waiting the further ones are dropped, and the ones that can't be published are dropped as well, both
+// counted by BusDrops. A broken publishing connection is dialed again for the next message.
+//
+// When the subscribing connection breaks it is dialed again, with a growing delay, and subscribed to all the topics.
+// The messages published in between are lost.
+type RedisBus struct {
+	address   string
+	password  string
+	timeout   time.Duration // for dialing, writing and waiting for replies
+	publishes chan redisPublish
+	stop      chan struct{} // closed by Close, the publisher sends what is queued and stops
+	stopped   chan struct{} // closed by the publisher once it stopped
+	mu        sync.Mutex    // guards everything below and the writes to sub
+	sub       *redisConn
+	topics    map[string]subscribers
+	pending   map[string]chan struct{} // closed once Redis confirmed the subscription to the topic
+	closed    bool
+}
+
+// redisPublish is a message waiting to be published.
+type redisPublish struct {
+	topic   string
+	message []byte
+}
+
+// redisError is an error reply of Redis.
+type redisError string
+
+func (err redisError) Error() string {
+	return "redis: " + string(err)
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialRedis connects to Redis and authenticates with the password, if there is one.
+func dialRedis(address string, password string, timeout time.Duration) (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to Redis: %w", err)
+	}
+	redis := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if password != "" {
+		if _, err := redis.do(timeout, "AUTH", password); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("could not authenticate with Redis: %w", err)
+		}
+	}
+	return redis, nil
+}
+
+// write sends the command as an array of bulk strings.
+func (redis *redisConn) write(timeout time.Duration, args ...string) error {
+	command := fmt.Appendf(nil, "*%d\r\n", len(args))
+	for _, arg := range args {
+		command = fmt.Appendf(command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	redis.conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err := redis.conn.Write(command)
+	return err
+}
+
+// do sends the command and reads its reply. Error replies are returned as a redisError.
+func (redis *redisConn) do(timeout time.Duration, args ...string) (any, error) {
+	if err := redis.write(timeout, args...); err != nil {
+		return nil, err
+	}
+	redis.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer redis.conn.SetReadDeadline(time.Time{})
+	reply, err := readRESP(redis.reader)
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := reply.(redisError); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// readRESP reads a reply, which is a string for simple strings, a redisError for errors, an int64 for integers,
+// a []byte for bulk strings, an []any for arrays and nil for null bulk strings and arrays.
+func readRESP(reader *bufio.Reader) (any, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return redisError(line), nil
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line)
+		if err != nil || length > redisMaxBulk {
+			return nil, fmt.Errorf("redis: malformed bulk string length %q", line)
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		bulk := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, bulk); err != nil {
+			return nil, err
+		}
+		return bulk[:length], nil
+	case '*':
+		length, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed array length %q", line)
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		array := make([]any, 0, min(length, 64))
+		for range length {
+			element, err := readRESP(reader)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, element)
+		}
+		return array, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
+
+// OpenRedisBus connects to the Redis server at the address. The timeout applies to dialing, writing and waiting for
+// replies.
+func OpenRedisBus(address string, password string, timeout time.Duration) (*RedisBus, error) {
+	sub, err := dialRedis(address, password, timeout)
+	if err != nil {
+		return nil, err
+	}
+	bus := &RedisBus{
+		address:   address,
+		password:  password,
+		timeout:   timeout,
+		publishes: make(chan redisPublish, busBuffer),
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+		sub:       sub,
+		topics:    make(map[string]subscribers),
+		pending:   make(map[string]chan struct{}),
+	}
+	go bus.listen(sub)
+	go bus.publish()
+	return bus, nil
+}
+
+// Publish queues the message for the publisher. It fails without waiting when the queue is full.
+func (bus *RedisBus) Publish(topic string, message []byte) error {
+	bus.mu.Lock()
+	closed := bus.closed
+	bus.mu.Unlock()
+	if closed {
+		return errors.New("redis bus is closed")
+	}
+	select {
+	case bus.publishes <- redisPublish{topic, message}:
+		return nil
+	default:
+		BusDrops.Inc("full")
+		return errors.New("redis publish queue is full")
+	}
+}
+
+// publish sends the queued messages to Redis until the bus is closed and then the ones that are still queued, as long
+// as Redis takes them.
+func (bus *RedisBus) publish() {
+	defer close(bus.stopped)
+	var pub *redisConn // nil until the first message and after it broke
+	defer func() {
+		if pub != nil {
+			pub.conn.Close()
+		}
+	}()
+	failing := false
+
+	for {
+		select {
+		case <-bus.stop:
+			if failing || len(bus.publishes) == 0 {
+				return
+			}
+		default:
+		}
+		var next redisPublish
+		select {
+		case next = <-bus.publishes:
+		case <-bus.stop:
+			continue
+		}
+
+		var err error
+		if pub == nil {
+			pub, err = dialRedis(bus.address, bus.password, bus.timeout)
+		}
+		if err == nil {
+			_, err = pub.do(bus.timeout, "PUBLISH", next.topic, string(next.message))
+			var replyErr redisError
+			if err != nil && !errors.As(err, &replyErr) {
+				// the connection is in an unknown state so the next message starts over
+				pub.conn.Close()
+				pub = nil
+			}
+		}
+		if err != nil {
+			BusDrops.Inc("failed")
+			if !failing {
+				slog.Warn("Could not publish on Redis, dropping messages until it takes them again", "topic", next.topic, "error", err)
+			}
+		} else if failing {
+			slog.Info("Publishing on Redis again")
+		}
+		failing = err != nil
+	}
+}
+
+// Subscribe subscribes to the topic and waits for Redis to confirm it, so that nothing published afterwards is missed.
+func (bus *RedisBus) Subscribe(topic string) (*Subscription, error) {
+	messages := make(chan []byte, busBuffer)
+	bus.mu.Lock()
+	if bus.closed {
+		bus.mu.Unlock()
+		return nil, errors.New("redis bus is closed")
+	}
+	confirmed, ok := bus.pending[topic]
+	if bus.topics[topic] == nil {
+		bus.topics[topic] = make(subscribers)
+		confirmed = make(chan struct{})
+		bus.pending[topic] = confirmed
+		// a broken connection is noticed by listen, which subscribes to all the topics again
+		if err := bus.sub.write(bus.timeout, "SUBSCRIBE", topic); err != nil {
+			slog.Warn("Could not subscribe to a topic on Redis", "topic", topic, "error", err)
+		}
+	} else if !ok {
+		confirmed = closedChannel
+	}
+	bus.topics[topic][messages] = struct{}{}
+	bus.mu.Unlock()
+
+	subscription := &Subscription{C: messages, cancel: func() {
+		bus.mu.Lock()
+		defer bus.mu.Unlock()
+
+		delete(bus.topics[topic], messages)
+		if len(bus.topics[topic]) == 0 {
+			delete(bus.topics, topic)
+			delete(bus.pending, topic)
+			if !bus.closed {
+				bus.sub.write(bus.timeout, "UNSUBSCRIBE", topic)
+			}
+		}
+	}}
+	select {
+	case <-confirmed:
+		return subscription, nil
+	case <-time.After(bus.timeout):
+		subscription.Close()
+		return nil, fmt.Errorf("redis did not confirm the subscription to %s", topic)
+	}
+}
+
+// closedChannel is the confirmation of topics that were already subscribed to.
+var closedChannel = func() chan struct{} {
+	channel := make(chan struct{})
+	close(channel)
+	return channel
+}()
+
+// listen reads the subscribing connection and hands the messages to the subscriptions until the bus is closed.
+func (bus *RedisBus) listen(sub *redisConn) {
+	for {
+		reply, err := readRESP(sub.reader)
+		if err != nil {
+			sub.conn.Close()
+			if sub = bus.redial(err); sub == nil {
+				return
+			}
+			continue
+		}
+		parts, ok := reply.([]any)
+		if !ok || len(parts) != 3 {
+			continue
+		}
+		kind, _ := parts[0].([]byte)
+		topic, _ := parts[1].([]byte)
+		bus.mu.Lock()
+		switch string(kind) {
+		case "message":
+			payload, _ := parts[2].([]byte)
+			bus.topics[string(topic)].deliver(string(topic), payload)
+		case "subscribe":
+			if confirmed, ok := bus.pending[string(topic)]; ok {
+				close(confirmed)
+				delete(bus.pending, string(topic))
+			}
+		}
+		bus.mu.Unlock()
+	}
+}
+
+// redial connects the subscribing connection again after reading failed and subscribes to all the topics. It returns
+// nil once the bus is closed.
+func (bus *RedisBus) redial(cause error) *redisConn {
+	for delay := 100 * time.Millisecond; ; delay = min(2*delay, 5*time.Second) {
+		bus.mu.Lock()
+		closed := bus.closed
+		bus.mu.Unlock()
+		if closed {
+			return nil
+		}
+		slog.Warn("Lost the subscribing connection to Redis, connecting again", "error", cause, "delay", delay)
+		time.Sleep(delay)
+
+		sub, err := dialRedis(bus.address, bus.password, bus.timeout)
+		if err != nil {
+			cause = err
+			continue
+		}
+		bus.mu.Lock()
+		if bus.closed {
+			bus.mu.Unlock()
+			sub.conn.Close()
+			return nil
+		}
+		if len(bus.topics) > 0 {
+			args := []string{"SUBSCRIBE"}
+			for topic := range bus.topics {
+				args = append(args, topic)
+			}
+			err = sub.write(bus.timeout, args...)
+		}
+		if err != nil {
+			bus.mu.Unlock()
+			sub.conn.Close()
+			cause = err
+			continue
+		}
+		bus.sub = sub
+		bus.mu.Unlock()
+		slog.Info("Connected to Redis again", "topics", len(bus.topics))
+		return sub
+	}
+}
+
+// Close publishes the messages that are still queued, unless Redis fails, and closes the connections.
+func (bus *RedisBus) Close() error {
+	bus.mu.Lock()
+	if bus.closed {
+		bus.mu.Unlock()
+		return nil
+	}
+	bus.closed = true
+	err := bus.sub.conn.Close()
+	bus.mu.Unlock()
+
+	close(bus.stop)
+	<-bus.stopped
+	return err
+}
@@ -0,0 +1,165 @@
+package pkg
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// A Permission allows a member to do one kind of request.
+type Permission string
+
+const (
+	PermissionBroadcast Permission = "broadcast" // send broadcasts to a room
+	PermissionDM        Permission = "dm"        // send DMs to other members
+	PermissionModerate  Permission = "moderate"  // kick, mute and ban other members
+)
+
+// RolePermissions maps every role a member can have to the permissions it grants. Members get their roles from their
+// credentials on upgrade, or the configured DefaultRoles when the credentials don't name any. Roles nobody knows
+// about grant nothing. Reading messages, read receipts, whoami and joining rooms need no permission.
+var RolePermissions = map[string][]Permission{
+	"admin":     {PermissionBroadcast, PermissionDM, PermissionModerate},
+	"member":    {PermissionBroadcast, PermissionDM},
+	"broadcast": {PermissionBroadcast},
+	"dm":        {PermissionDM},
+	"read-only": {},
+}
+
+// Roles is a list of role names. As text it is a comma separated list so that it can be given as a flag.
+type Roles []string
+
+func (roles Roles) MarshalText() ([]byte, error) {
+	return []byte(strings.Join(roles, ",")), nil
+}
+
+func (roles *Roles) UnmarshalText(text []byte) error {
+	*roles = Roles{}
+	for _, role := range strings.Split(string(text), ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			*roles = append(*roles, role)
+		}
+	}
+	return nil
+}
+
+// unknown returns the roles that are not in RolePermissions.
+func (roles Roles) unknown() []string {
+	var unknown []string
+	for _, role := range roles {
+		if _, ok := RolePermissions[role]; !ok {
+			unknown = append(unknown, role)
+		}
+	}
+	return unknown
+}
+
+// can reports whether any of the roles of the member grants the permission.
+func (member *Member) can(permission Permission) bool {
+	for _, role := range member.Roles {
+		if slices.Contains(RolePermissions[role], permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// moderate hands a kick, mute, unmute, ban or unban request to the group loop and reports false if the loop has
+// already exited.
+func (group *Group) moderate(envelope Envelope) bool {
+	select {
+	case group.Moderate <- envelope:
+		return true
+	case <-group.done:
+		return false
+	}
+}
+
+// Banned reports whether the member with the ID is banned from the group.
+func (group *Group) Banned(id string) bool {
+	group.mu.RLock()
+	defer group.mu.RUnlock()
+
+	_, ok := group.banned[id]
+	return ok
+}
+
+// Muted reports whether the member with the ID is muted in the group.
+func (group *Group) Muted(id string) bool {
+	group.mu.RLock()
+	defer group.mu.RUnlock()
+
+	_, ok := group.muted[id]
+	return ok
+}
+
+// expel removes the member from the group. A member expelled from the room it connected to is disconnected, from any
+// other room it just loses the room. It must only be called from the group loop.
+func (group *Group) expel(member *Member, reason string) {
+	group.mu.Lock()
+	if current, ok := group.members[member.ID]; ok && current == member {
+		delete(group.members, member.ID)
+		MembersGauge.Add(-1)
+	}
+	group.mu.Unlock()
+	group.announce(busLeft, member.ID)
+	if member.Group == group {
+		member.disconnect(websocket.ClosePolicyViolation, reason, true)
+	} else {
+		member.forget(group)
+	}
+}
+
+// handleModeration carries out a moderation request of an admin. It must only be called from the group loop.
+func (group *Group) handleModeration(message Envelope) {
+	admin, ok := group.members[message.From]
+	if !ok || !admin.can(PermissionModerate) {
+		group.reply(message, nackEnvelope(message, CodeForbidden, fmt.Sprintf("%s needs the %s permission", message.Type, PermissionModerate)))
+		return
+	}
+	if message.To == message.From {
+		group.reply(message, nackEnvelope(message, CodeForbidden, fmt.Sprintf("members can't %s themselves", message.Type)))
+		return
+	}
+	reason, _ := message.Payload.(string)
+	if reason == "" {
+		reason = fmt.Sprintf("%s by %s", message.Type, message.From)
+	}
+	if _, ok := group.locate(message.To); !ok && (message.Type == TypeKick || message.Type == TypeMute) {
+		group.reply(message, nackEnvelope(message, CodeUnknownRecipient, fmt.Sprintf("member %s is not in room %s", message.To, group.Name)))
+		return
+	}
+
+	group.log.Info("Moderated a member", "type", message.Type, "from", message.From, "member_id", message.To, payloadAttr(group.Config, Envelope{Payload: reason}))
+	group.applyModeration(message, reason)
+	// the other nodes apply it as well, to their members and to the ones that join them later
+	group.publish(busMessage{Kind: busModerated, Message: &Envelope{Type: message.Type, From: message.From, To: message.To, Payload: reason}})
+	group.reply(message, ackEnvelope(message))
+}
+
+// applyModeration applies the moderation of an admin of this or another node to the room and tells the target, if it is
+// a member of this node. It must only be called from the group loop.
+func (group *Group) applyModeration(message Envelope, reason string) {
+	group.mu.Lock()
+	switch message.Type {
+	case TypeMute:
+		group.muted[message.To] = struct{}{}
+	case TypeUnmute:
+		delete(group.muted, message.To)
+	case TypeBan:
+		group.banned[message.To] = struct{}{}
+	case TypeUnban:
+		delete(group.banned, message.To)
+	}
+	group.mu.Unlock()
+
+	if target, ok := group.members[message.To]; ok {
+		// the target is told what happened to it before it is possibly disconnected
+		target.deliver(Envelope{Type: message.Type, To: target.ID, From: message.From, Room: group.Name, Payload: reason})
+		if message.Type == TypeKick || message.Type == TypeBan {
+			group.expel(target, reason)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package pkg
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log/slog"
+	"sort"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Rooms is a registry of named groups. A group is created lazily the first time somebody asks for its name and
+// it is torn down by its own loop once it has been empty for the configured RoomIdleTimeout. This lets a single server host many
+// independent channels instead of the single group we used to create at startup.
+//
+// The registry only guards the name -> group mapping with a mutex. Everything that happens inside a group is still
+// synchronized by the group's own 'select' loop.
+//
+// Once Stop was called the registry is draining and doesn't create or hand out rooms anymore.
+//
+// The registry also keeps track of the IDs of all the connected members. With authentication the ID of a member is the
+// subject of its credentials, so a second connection with the same credentials is refused while the first is open.
+type Rooms struct {
+	Config        *Config
+	Authenticator Authenticator // nil lets every caller in under a random ID
+	Store         MessageStore  // handed to every room, nil keeps no history
+	Offline       *OfflineQueue // handed to every room, nil refuses DMs to members that are not connected
+	Bus           Bus           // handed to every room, nil keeps the rooms to this node
+	Node          string        // the ID of this node on the bus, the NodeID of the config or a random one
+	Presence      *Presence     // handed to every room and told about the members connecting, nil without a bus
+	mu            sync.Mutex
+	groups        map[string]*Group
+	members       map[string]struct{}
+	bans          map[string]map[string]struct{} // the bans of rooms that were torn down, restored when they come back
+	upgrades      *keyedLimiter                  // limits the new connections per IP
+	sessions      map[string]*session            // the parked members by resume token, see session.go
+	parked        map[string]string              // the resume tokens of the parked members by ID
+	draining      bool
+}
+
+func NewRooms(config *Config) *Rooms {
+	return &Rooms{
+		Config:   config,
+		Node:     cmp.Or(config.NodeID, uuid.NewString()),
+		groups:   make(map[string]*Group),
+		members:  make(map[string]struct{}),
+		bans:     make(map[string]map[string]struct{}),
+		sessions: make(map[string]*session),
+		parked:   make(map[string]string),
+		upgrades: newKeyedLimiter(config.UpgradeRate, config.UpgradeBurst),
+	}
+}
+
+// Get returns the group registered under the name and creates (and starts) it if it doesn't exist yet. It returns nil
+// once the registry is stopping.
+func (rooms *Rooms) Get(name string) *Group {
+	rooms.mu.Lock()
+	defer rooms.mu.Unlock()
+
+	if rooms.draining {
+		return nil
+	}
+	if group, ok := rooms.groups[name]; ok {
+		return group
+	}
+	group := NewGroup(rooms.Config)
+	group.Name = name
+	group.rooms = rooms
+	group.Authenticator = rooms.Authenticator
+	group.Store = rooms.Store
+	group.Offline = rooms.Offline
+	group.Bus, group.Node = rooms.Bus, rooms.Node
+	group.Presence = rooms.Presence
+	if banned, ok := rooms.bans[name]; ok {
+		group.banned = banned
+		delete(rooms.bans, name)
+	}
+	rooms.groups[name] = group
+	go group.Create()
+	slog.Info("Created room", "group", name)
+	return group
+}
+
+// Lookup returns the group registered under the name without creating it.
+func (rooms *Rooms) Lookup(name string) (*Group, bool) {
+	rooms.mu.Lock()
+	defer rooms.mu.Unlock()
+
+	group, ok := rooms.groups[name]
+	return group, ok
+}
+
+// Names returns the sorted names of all the rooms that are currently alive.
+func (rooms *Rooms) Names() []string {
+	rooms.mu.Lock()
+	defer rooms.mu.Unlock()
+
+	names := make([]string, 0, len(rooms.groups))
+	for name := range rooms.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Join adds the member to the room with the given name. A room can be torn down between looking it up and
+// handing the member to its loop, in which case we simply look it up again and get a fresh one. It returns nil when
+// the registry is stopping. A member without a room yet gets the room as the one it connected to before the loop of the
+// room can act on it.
+func (rooms *Rooms) Join(name string, member *Member) *Group {
+	connecting := member.Group == nil
+	for {
+		group := rooms.Get(name)
+		if group == nil {
+			return nil
+		}
+		if connecting {
+			member.Group = group
+		}
+		if group.add(member) {
+			return group
+		}
+		if connecting {
+			member.Group = nil
+		}
+	}
+}
+
+// banned reports whether the member with the ID is banned from the room with the given name.
+func (rooms *Rooms) banned(name string, id string) bool {
+	rooms.mu.Lock()
+	group, ok := rooms.groups[name]
+	_, saved := rooms.bans[name][id]
+	rooms.mu.Unlock()
+
+	if ok {
+		return group.Banned(id)
+	}
+	return saved
+}
+
+// claim reserves the member ID for a new connection. It reports false if a member with the ID is already connected.
+func (rooms *Rooms) claim(id string) bool {
+	rooms.mu.Lock()
+	defer rooms.mu.Unlock()
+
+	if _, ok := rooms.members[id]; ok {
+		return false
+	}
+	rooms.members[id] = struct{}{}
+	if rooms.Presence != nil {
+		rooms.Presence.Online(id)
+	}
+	return true
+}
+
+// unclaim frees the member ID once its connection is closed. A parked member stays present on this node until its
+// session expires.
+func (rooms *Rooms) unclaim(id string) {
+	rooms.mu.Lock()
+	defer rooms.mu.Unlock()
+
+	delete(rooms.members, id)
+	rooms.absent(id)
+}
+
+// absent tells the presence registry that the member with the ID is gone, unless it is connected or parked. It is
+// called with the mutex held.
+func (rooms *Rooms) absent(id string) {
+	_, connected := rooms.members[id]
+	_, parked := rooms.parked[id]
+	if rooms.Presence != nil && !connected && !parked {
+		rooms.Presence.Offline(id)
+	}
+}
+
+// connected reports whether a member with the ID is connected to any room.
+func (rooms *Rooms) connected(id string) bool {
+	rooms.mu.Lock()
+	defer rooms.mu.Unlock()
+
+	_, ok := rooms.members[id]
+	return ok
+}
+
+// Connections returns the number of members connected through the registry.
+func (rooms *Rooms) Connections() int {
+	rooms.mu.Lock()
+	defer rooms.mu.Unlock()
+
+	return len(rooms.members)
+}
+
+// responsive probes the loops of all the rooms at the same time and reports the ones that are wedged.
+func (rooms *Rooms) responsive(ctx context.Context) error {
+	rooms.mu.Lock()
+	groups := make([]*Group, 0, len(rooms.groups))
+	for _, group := range rooms.groups {
+		groups = append(groups, group)
+	}
+	rooms.mu.Unlock()
+
+	errs := make([]error, len(groups))
+	var wg sync.WaitGroup
+	for i, group := range groups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = group.responsive(ctx)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Stopping reports whether Stop was called on the registry.
+func (rooms *Rooms) Stopping() bool {
+	rooms.mu.Lock()
+	defer rooms.mu.Unlock()
+
+	return rooms.draining
+}
+
+// Stop stops every room at the same time and waits for all of them to drain their members or for the context to be
+// done. No rooms are created after Stop was called.
+func (rooms *Rooms) Stop(ctx context.Context) error {
+	rooms.mu.Lock()
+	rooms.draining = true
+	// the parked members are closed along with their rooms
+	for token, session := range rooms.sessions {
+		session.timer.Stop()
+		delete(rooms.sessions, token)
+		delete(rooms.parked, session.member.ID)
+		rooms.absent(session.member.ID)
+	}
+	groups := make([]*Group, 0, len(rooms.groups))
+	for _, group := range rooms.groups {
+		groups = append(groups, group)
+	}
+	rooms.mu.Unlock()
+
+	errs := make([]error, len(groups))
+	var wg sync.WaitGroup
+	for i, group := range groups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = group.Stop(ctx)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// release is called by the loop of a group right before it exits. It removes the group from the registry if it is
+// still the one registered under its name.
+func (rooms *Rooms) release(group *Group) {
+	rooms.mu.Lock()
+	defer rooms.mu.Unlock()
+
+	if current, ok := rooms.groups[group.Name]; ok && current == group {
+		delete(rooms.groups, group.Name)
+		// the loop has exited so nobody changes the bans anymore
+		if len(group.banned) > 0 {
+			rooms.bans[group.Name] = group.banned
+		}
+		slog.Info("Tearing down room", "group", group.Name)
+	}
+}
@@ -0,0 +1,201 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"maps"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Members connected through a room registry with a versioned protocol get a resume token in their welcome message when
+// the ResumeGrace is set. When their connection drops the member is parked: it stays in all its rooms for the
+// ResumeGrace and the broadcasts and DMs it gets in the meantime are kept instead of sent. A new connection with
+// ?resume=<token>&last_seq=<seq> within the grace takes over the ID, roles and rooms of the parked member and every room
+// replays the messages after last_seq right after its welcome message. The last ResumeBufferSize messages are kept for
+// a replay, including the ones that were sent but may not have made it to the member before the connection dropped.
+//
+// Members that closed the connection themselves or were closed by the server on purpose (kicked, banned, shut down)
+// are not parked.
+
+// session is a parked member waiting to be resumed.
+type session struct {
+	member *Member
+	timer  *time.Timer // expires the session after the ResumeGrace
+}
+
+// newResumeToken returns a random token, which is all it takes to resume a session without authentication.
+func newResumeToken() string {
+	token := make([]byte, 32)
+	rand.Read(token)
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+// resumable reports whether the member can resume its session after its connection was closed with the code, which
+// is the case when the connection dropped or timed out but not when either side closed it on purpose.
+func (member *Member) resumable(code int) bool {
+	if member.resumeToken == "" {
+		return false
+	}
+	switch member.peerCode.Load() {
+	case websocket.CloseAbnormalClosure:
+		// the connection went away without a close frame
+		return true
+	case 0:
+		// closed for inactivity or because writing failed
+		return code == websocket.CloseNormalClosure || code == websocket.CloseTryAgainLater
+	}
+	return false
+}
+
+// remember keeps broadcasts and DMs to the member for a replay when it resumes its session. It reports whether the
+// member is parked, in which case the message must not be sent.
+func (member *Member) remember(envelope Envelope) bool {
+	if member.sent == nil {
+		return false
+	}
+	member.mu.Lock()
+	defer member.mu.Unlock()
+
+	if envelope.Type == TypeBroadcast || envelope.Type == TypeDM {
+		member.sent.add(envelope, member.Config.ResumeBufferSize)
+	}
+	return member.parked.Load()
+}
+
+// missed returns the kept messages of the room after the seq, oldest first.
+func (member *Member) missed(room string, after uint64) []Envelope {
+	member.mu.Lock()
+	defer member.mu.Unlock()
+
+	var missed []Envelope
+	for i := range len(member.sent.messages) {
+		if message := member.sent.at(i); message.Room == room && message.Seq > after {
+			missed = append(missed, message)
+		}
+	}
+	return missed
+}
+
+// replay sends the member the messages of the group that the session it resumed missed. It is called by the loop right
+// after the welcome message, when the resumed member has just been replaced in the group and gets nothing anymore.
+func (group *Group) replay(member *Member) {
+	resumed := member.resumed.Load()
+	if resumed == nil {
+		return
+	}
+	missed := resumed.missed(group.Name, member.lastSeq)
+	for _, message := range missed {
+		if !member.deliver(message) {
+			group.log.Warn("Could not queue a message to replay", "member_id", member.ID, "seq", message.Seq)
+		}
+	}
+	group.log.Info("Resumed a session", "member_id", member.ID, "last_seq", member.lastSeq, "replayed", len(missed))
+}
+
+// park keeps the member in its rooms for the ResumeGrace after its connection was closed. Once the registry is
+// stopping members are not parked anymore.
+func (rooms *Rooms) park(member *Member) {
+	rooms.mu.Lock()
+	defer rooms.mu.Unlock()
+
+	if rooms.draining {
+		return
+	}
+	member.parked.Store(true)
+	rooms.sessions[member.resumeToken] = &session{
+		member: member,
+		timer:  time.AfterFunc(rooms.Config.ResumeGrace, func() { rooms.expire(member) }),
+	}
+	rooms.parked[member.ID] = member.resumeToken
+	member.log.Info("Parked the member until it resumes", "resume_grace", rooms.Config.ResumeGrace)
+}
+
+// expire forgets the session of the parked member and removes the member from its rooms, unless it was resumed.
+func (rooms *Rooms) expire(member *Member) {
+	rooms.mu.Lock()
+	current, ok := rooms.sessions[member.resumeToken]
+	if ok && current.member == member {
+		current.timer.Stop()
+		delete(rooms.sessions, member.resumeToken)
+		delete(rooms.parked, member.ID)
+		rooms.absent(member.ID)
+	}
+	rooms.mu.Unlock()
+
+	if ok && current.member == member {
+		member.log.Info("Session expired")
+		member.leaveAll()
+	}
+}
+
+// expireParked expires the session of the parked member with the ID, if there is one. It is used when the member
+// connects again without resuming.
+func (rooms *Rooms) expireParked(id string) {
+	rooms.mu.Lock()
+	token, ok := rooms.parked[id]
+	session := rooms.sessions[token]
+	rooms.mu.Unlock()
+
+	if ok {
+		rooms.expire(session.member)
+	}
+}
+
+// resume takes the session of the token off the registry and returns its parked member. With authentication the
+// subject has to be the one of the session. It reports false for tokens that are unknown or expired.
+func (rooms *Rooms) resume(token string, subject string) (*Member, bool) {
+	rooms.mu.Lock()
+	defer rooms.mu.Unlock()
+
+	session, ok := rooms.sessions[token]
+	if !ok || (rooms.Authenticator != nil && session.member.ID != subject) {
+		return nil, false
+	}
+	session.timer.Stop()
+	delete(rooms.sessions, token)
+	delete(rooms.parked, session.member.ID)
+	rooms.absent(session.member.ID)
+	// only the last session is needed for a replay
+	session.member.resumed.Store(nil)
+	return session.member, true
+}
+
+// resumption returns the member whose session the request resumes with its resume parameter and the last_seq the
+// client got. It returns nil if there is no such session, in which case the client simply gets a new one.
+func (rooms *Rooms) resumption(identity Identity, r *http.Request) (*Member, uint64) {
+	token := r.URL.Query().Get("resume")
+	if token == "" || rooms.Config.ResumeGrace <= 0 {
+		return nil, 0
+	}
+	previous, ok := rooms.resume(token, identity.Subject)
+	if !ok {
+		return nil, 0
+	}
+	lastSeq, _ := strconv.ParseUint(r.URL.Query().Get("last_seq"), 10, 64)
+	return previous, lastSeq
+}
+
+// rejoin adds the member that resumes a session to the other rooms of the parked member and takes the parked member out
+// of the rooms it can't rejoin. The room the member connected to goes first, so that its welcome message and replay
+// come before the ones of the other rooms.
+func (member *Member) rejoin() {
+	member.Group.settle()
+	resumed := member.resumed.Load()
+	resumed.mu.Lock()
+	groups := maps.Clone(resumed.groups)
+	resumed.mu.Unlock()
+
+	for name, group := range groups {
+		if group == resumed.Group {
+			continue
+		}
+		if err := member.join(name); err != nil {
+			member.log.Info("Could not rejoin a room", "room", name, "error", err)
+			group.remove(resumed)
+		}
+	}
+}
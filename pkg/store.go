@@ -0,0 +1,172 @@
+package pkg
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The kinds of message stores, see NewMessageStore.
+const (
+	HISTORY_STORE_NONE   string = "none"   // messages are not kept and history requests are refused
+	HISTORY_STORE_MEMORY string = "memory" // the last HistorySize messages of every conversation are kept in memory
+	HISTORY_STORE_FILE   string = "file"   // every message is appended to HistoryFile and survives restarts
+)
+
+// A MessageStore keeps the broadcasts and DMs routed by the groups so that members can page back through them with
+// history requests. Messages are grouped into conversations, which are the broadcasts of a room (see RoomConversation)
+// or the DMs between two members in a room (see DMConversation).
+//
+// Every conversation is only appended to by the loop of its room, but the messages of other nodes can arrive after newer
+// ones of this node, so stores keep every conversation in the order of the Seq. Stores are used by many groups and members at once and have to be safe for concurrent use.
+type MessageStore interface {
+	// Append keeps the message, which has been stamped by its group.
+	Append(message Envelope) error
+	// History returns at most limit messages of the conversation with a Seq below before, or the newest ones when
+	// before is 0, oldest first.
+	History(conversation string, before uint64, limit int) ([]Envelope, error)
+	Close() error
+}
+
+// NewMessageStore returns the store the config asks for, which is nil for HISTORY_STORE_NONE.
+func NewMessageStore(config *Config) (MessageStore, error) {
+	switch config.HistoryStore {
+	case HISTORY_STORE_NONE:
+		return nil, nil
+	case HISTORY_STORE_MEMORY:
+		return NewMemoryStore(config.HistorySize), nil
+	case HISTORY_STORE_FILE:
+		return OpenFileStore(config.HistoryFile)
+	}
+	return nil, fmt.Errorf("history store must be none, memory or file but is %q", config.HistoryStore)
+}
+
+// RoomConversation is the conversation of the broadcasts in the room.
+func RoomConversation(room string) string {
+	return conversationKey("room", room)
+}
+
+// DMConversation is the conversation of the DMs between the two members in the room, the same either way round.
+func DMConversation(room string, member string, other string) string {
+	if other < member {
+		member, other = other, member
+	}
+	return conversationKey("dm", room, member, other)
+}
+
+// conversationKey joins the kind and the length-prefixed parts of a conversation, so that names with slashes in them
+// can not make two conversations share a key.
+func conversationKey(kind string, parts ...string) string {
+	var key strings.Builder
+	key.WriteString(kind)
+	for _, part := range parts {
+		fmt.Fprintf(&key, "/%d:%s", len(part), part)
+	}
+	return key.String()
+}
+
+// conversation returns the conversation the message belongs to and reports false for messages that are not kept.
+func conversation(message Envelope) (string, bool) {
+	switch message.Type {
+	case TypeBroadcast:
+		return RoomConversation(message.Room), true
+	case TypeDM:
+		return DMConversation(message.Room, message.From, message.To), true
+	}
+	return "", false
+}
+
+// page returns at most limit of the seqs below before (or the last ones when before is 0) as the range [from, to) of
+// the sorted seqs.
+func page(seqs func(i int) uint64, n int, before uint64, limit int) (int, int) {
+	to := n
+	if before > 0 {
+		to = sort.Search(n, func(i int) bool { return seqs(i) >= before })
+	}
+	return max(to-limit, 0), to
+}
+
+// MemoryStore keeps the last messages of every conversation in a ring buffer. Nothing survives a restart.
+type MemoryStore struct {
+	size          int
+	mu            sync.RWMutex
+	conversations map[string]*ring
+}
+
+// ring holds the last messages of a conversation in the order of their Seq. Once it is full the oldest message is
+// overwritten by the next one.
+type ring struct {
+	messages []Envelope
+	next     int // where the next message goes once the ring is full, which is also where the oldest one is
+}
+
+func (ring *ring) add(message Envelope, size int) {
+	if len(ring.messages) < size {
+		ring.messages = append(ring.messages, message)
+	} else if message.Seq > ring.at(0).Seq {
+		ring.messages[ring.next] = message
+		ring.next = (ring.next + 1) % size
+	} else {
+		// older than every message kept
+		return
+	}
+	// a late message of another node moves back to where its Seq belongs
+	for i := len(ring.messages) - 1; i > 0 && ring.at(i-1).Seq > ring.at(i).Seq; i-- {
+		previous, current := ring.index(i-1), ring.index(i)
+		ring.messages[previous], ring.messages[current] = ring.messages[current], ring.messages[previous]
+	}
+}
+
+// index returns where the i-th oldest message is.
+func (ring *ring) index(i int) int {
+	return (ring.next + i) % len(ring.messages)
+}
+
+// at returns the i-th oldest message.
+func (ring *ring) at(i int) Envelope {
+	return ring.messages[ring.index(i)]
+}
+
+// NewMemoryStore returns a store that keeps the last size messages of every conversation.
+func NewMemoryStore(size int) *MemoryStore {
+	return &MemoryStore{size: size, conversations: make(map[string]*ring)}
+}
+
+func (store *MemoryStore) Append(message Envelope) error {
+	key, ok := conversation(message)
+	if !ok {
+		return fmt.Errorf("%s messages are not kept", message.Type)
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	messages, ok := store.conversations[key]
+	if !ok {
+		messages = &ring{}
+		store.conversations[key] = messages
+	}
+	messages.add(message, store.size)
+	return nil
+}
+
+func (store *MemoryStore) History(conversation string, before uint64, limit int) ([]Envelope, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	messages, ok := store.conversations[conversation]
+	if !ok {
+		return nil, nil
+	}
+	n := len(messages.messages)
+	from, to := page(func(i int) uint64 { return messages.at(i).Seq }, n, before, limit)
+	history := make([]Envelope, 0, to-from)
+	for i := from; i < to; i++ {
+		history = append(history, messages.at(i))
+	}
+	return history, nil
+}
+
+func (store *MemoryStore) Close() error {
+	return nil
+}
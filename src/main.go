@@ -1,32 +1,142 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"websocket-server.com/pkg"
 )
 
-func initRoutes() {
-    group := pkg.NewGroup()
-    go group.Create()
+func initRoutes(config *pkg.Config, authenticator pkg.Authenticator, store pkg.MessageStore, offline *pkg.OfflineQueue, bus pkg.Bus) *pkg.Rooms {
+	rooms := pkg.NewRooms(config)
+	rooms.Authenticator = authenticator
+	rooms.Store = store
+	rooms.Offline = offline
+	rooms.Bus = bus
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		pkg.ServerHome(w, r)
 	})
 
-    http.HandleFunc("/pingpong", func(w http.ResponseWriter, r *http.Request) {
-        pkg.ServerPingPong(group, w, r)
-    })
+	http.HandleFunc("/pingpong", func(w http.ResponseWriter, r *http.Request) {
+		pkg.ServerRoom(rooms, w, r)
+	})
+
+	http.HandleFunc("/rooms/{name}/ws", func(w http.ResponseWriter, r *http.Request) {
+		pkg.ServerRoom(rooms, w, r)
+	})
+
+	http.HandleFunc("/getMemberIds", pkg.CORS(config, func(w http.ResponseWriter, r *http.Request) {
+		pkg.ServerRoomMemberIds(rooms, w, r)
+	}))
+
+	http.HandleFunc("/metrics", pkg.ServeMetrics)
+
+	http.HandleFunc("/healthz", pkg.ServerHealth)
+
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		pkg.ServerRoomsReady(rooms, w, r)
+	})
 
-	http.HandleFunc("/getMemberIds", func(w http.ResponseWriter, r *http.Request) {
-		pkg.ServerMemberIds(group, w, r)
+	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		pkg.ServerRoomsStatus(rooms, w, r)
 	})
+	return rooms
 }
 
 func main() {
-    initRoutes()
-	log.Println("Starting server on http://localhost:8080")
-    log.Fatal(http.ListenAndServe(":8080", nil))
-}
+	config, err := pkg.LoadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	logger, err := pkg.NewLogger(config, os.Stderr)
+	if err != nil {
+		slog.Error("Invalid logging setup", "error", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+
+	authenticator, err := pkg.NewAuthenticator(config)
+	if err != nil {
+		slog.Error("Invalid authentication setup", "error", err)
+		os.Exit(1)
+	}
+
+	store, err := pkg.NewMessageStore(config)
+	if err != nil {
+		slog.Error("Invalid history setup", "error", err)
+		os.Exit(1)
+	}
 
+	offline, err := pkg.NewOfflineQueue(config)
+	if err != nil {
+		slog.Error("Invalid offline queue setup", "error", err)
+		os.Exit(1)
+	}
 
+	bus, err := pkg.NewBus(config)
+	if err != nil {
+		slog.Error("Invalid bus setup", "error", err)
+		os.Exit(1)
+	}
+
+	rooms := initRoutes(config, authenticator, store, offline, bus)
+	if bus != nil {
+		presence, err := pkg.StartPresence(rooms.Node, bus, config)
+		if err != nil {
+			slog.Error("Invalid presence setup", "error", err)
+			os.Exit(1)
+		}
+		rooms.Presence = presence
+	}
+	server := &http.Server{Addr: config.ListenAddress}
+	go func() {
+		slog.Info("Starting server", "listen_address", config.ListenAddress)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Server failed", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	slog.Info("Shutting down", "signal", <-signals)
+
+	// the members are drained first as the hijacked websocket connections are not tracked by the http server
+	ctx, cancel := context.WithTimeout(context.Background(), config.DrainTimeout)
+	defer cancel()
+	if err := rooms.Stop(ctx); err != nil {
+		slog.Warn("Not every room drained in time", "error", err)
+	}
+	// the drain may have used up its time, the http server gets its own
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), config.DrainTimeout)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Could not shut down the server", "error", err)
+	}
+	if rooms.Presence != nil {
+		rooms.Presence.Stop()
+	}
+	if store != nil {
+		if err := store.Close(); err != nil {
+			slog.Error("Could not close the history store", "error", err)
+		}
+	}
+	if offline != nil {
+		if err := offline.Close(); err != nil {
+			slog.Error("Could not close the offline queue", "error", err)
+		}
+	}
+	if bus != nil {
+		if err := bus.Close(); err != nil {
+			slog.Error("Could not close the bus", "error", err)
+		}
+	}
+	slog.Info("Server stopped")
+}
@@ -0,0 +1,214 @@
+package test
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"websocket-server.com/pkg"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// signToken builds a JWT with the given header and claims signed with an HMAC secret or an RSA private key.
+func signToken(t *testing.T, header map[string]any, claims map[string]any, key any) string {
+	segment := func(value any) string {
+		data, err := json.Marshal(value)
+		if err != nil {
+			t.Fatalf("could not encode token segment %v", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := segment(header) + "." + segment(claims)
+
+	var signature []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatalf("could not sign token %v", err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func tokenRequest(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/pingpong", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestAuthenticators(t *testing.T) {
+
+	secret := []byte("the shared secret")
+	hs256 := map[string]any{"alg": "HS256", "typ": "JWT"}
+	valid := func() map[string]any {
+		return map[string]any{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}
+	}
+
+	t.Run("Test HS256 tokens are verified", func(t *testing.T) {
+		authenticator := pkg.NewHS256Authenticator(secret)
+
+		identity, err := authenticator.Authenticate(tokenRequest(signToken(t, hs256, valid(), secret)))
+		assert.NoError(t, err)
+		assert.Equal(t, "alice", identity.Subject)
+
+		r := httptest.NewRequest(http.MethodGet, "/pingpong?access_token="+signToken(t, hs256, valid(), secret), nil)
+		identity, err = authenticator.Authenticate(r)
+		assert.NoError(t, err, "The token should also be accepted as a query parameter")
+		assert.Equal(t, "alice", identity.Subject)
+
+		expired := valid()
+		expired["exp"] = time.Now().Add(-time.Hour).Unix()
+		noSubject := valid()
+		delete(noSubject, "sub")
+		for name, token := range map[string]string{
+			"missing":           "",
+			"malformed":         "not.a-token",
+			"wrong secret":      signToken(t, hs256, valid(), []byte("another secret")),
+			"expired":           signToken(t, hs256, expired, secret),
+			"without a subject": signToken(t, hs256, noSubject, secret),
+			"unsigned":          signToken(t, map[string]any{"alg": "none"}, valid(), []byte{}),
+		} {
+			_, err := authenticator.Authenticate(tokenRequest(token))
+			assert.ErrorIs(t, err, pkg.ErrUnauthenticated, "A %s token should be refused", name)
+		}
+	})
+
+	t.Run("Test issuer and audience are checked when configured", func(t *testing.T) {
+		authenticator := pkg.NewHS256Authenticator(secret)
+		authenticator.Issuer = "https://issuer.example"
+		authenticator.Audience = "chat"
+
+		claims := valid()
+		claims["iss"] = "https://issuer.example"
+		claims["aud"] = []string{"billing", "chat"}
+		_, err := authenticator.Authenticate(tokenRequest(signToken(t, hs256, claims, secret)))
+		assert.NoError(t, err)
+
+		claims["aud"] = "billing"
+		_, err = authenticator.Authenticate(tokenRequest(signToken(t, hs256, claims, secret)))
+		assert.ErrorIs(t, err, pkg.ErrUnauthenticated, "A token for another audience should be refused")
+	})
+
+	t.Run("Test RS256 tokens are verified with the keys of a JWKS file", func(t *testing.T) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		assert.NoError(t, err)
+		jwks, _ := json.Marshal(map[string]any{"keys": []map[string]any{{
+			"kty": "RSA",
+			"kid": "key-1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+		path := filepath.Join(t.TempDir(), "jwks.json")
+		os.WriteFile(path, jwks, 0o600)
+
+		authenticator, err := pkg.LoadJWTAuthenticator("", "", path)
+		assert.NoError(t, err)
+
+		identity, err := authenticator.Authenticate(tokenRequest(signToken(t, map[string]any{"alg": "RS256", "kid": "key-1"}, valid(), key)))
+		assert.NoError(t, err)
+		assert.Equal(t, "alice", identity.Subject)
+
+		_, err = authenticator.Authenticate(tokenRequest(signToken(t, map[string]any{"alg": "RS256", "kid": "key-2"}, valid(), key)))
+		assert.ErrorIs(t, err, pkg.ErrUnauthenticated, "A token signed with an unknown key should be refused")
+
+		// an attacker signing with the public key as HMAC secret must not get in
+		forged := signToken(t, map[string]any{"alg": "HS256", "kid": "key-1"}, valid(), key.N.Bytes())
+		_, err = authenticator.Authenticate(tokenRequest(forged))
+		assert.ErrorIs(t, err, pkg.ErrUnauthenticated, "The algorithm of the token has to match the key")
+	})
+
+	t.Run("Test static API keys map to their subject", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "keys.yaml")
+		os.WriteFile(path, []byte("key-of-bob: bob\n"), 0o600)
+		authenticator, err := pkg.LoadAPIKeyAuthenticator(path)
+		assert.NoError(t, err)
+
+		r := httptest.NewRequest(http.MethodGet, "/pingpong", nil)
+		r.Header.Set("X-API-Key", "key-of-bob")
+		identity, err := authenticator.Authenticate(r)
+		assert.NoError(t, err)
+		assert.Equal(t, "bob", identity.Subject)
+
+		_, err = authenticator.Authenticate(httptest.NewRequest(http.MethodGet, "/pingpong?api_key=guess", nil))
+		assert.ErrorIs(t, err, pkg.ErrUnauthenticated)
+	})
+}
+
+func TestAuthenticatedUpgrade(t *testing.T) {
+
+	secret := []byte("the shared secret")
+	rooms := pkg.NewRooms(pkg.DefaultConfig())
+	rooms.Authenticator = pkg.NewHS256Authenticator(secret)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pkg.ServerRoom(rooms, w, r)
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	dial := func(subject string) (*websocket.Conn, *http.Response, error) {
+		token := signToken(t, map[string]any{"alg": "HS256"}, map[string]any{"sub": subject}, secret)
+		return websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer " + token}})
+	}
+
+	t.Run("Test requests without a token are not upgraded", func(t *testing.T) {
+		_, response, err := websocket.DefaultDialer.Dial(url, nil)
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+	})
+
+	t.Run("Test the member ID is the subject of the token", func(t *testing.T) {
+		conn, _, err := dial("alice")
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer drop(conn)
+		conn.ReadMessage() // ignore the welcome message
+
+		whoami, _ := json.Marshal(pkg.Chat{ID: "0"})
+		conn.WriteMessage(websocket.TextMessage, whoami)
+		_, id, _ := conn.ReadMessage()
+		assert.Equal(t, "alice", string(id))
+
+		_, response, err := dial("alice")
+		assert.Error(t, err, "A second connection with the same subject should be refused")
+		assert.Equal(t, http.StatusConflict, response.StatusCode)
+	})
+
+	t.Run("Test the subject can connect again once its connection is closed", func(t *testing.T) {
+		conn, _, err := dial("bob")
+		if !assert.NoError(t, err) {
+			return
+		}
+		conn.ReadMessage() // ignore the welcome message
+		drop(conn)
+
+		conn, _, err = dial("bob")
+		assert.NoError(t, err, fmt.Sprintf("bob should be able to reconnect %v", err))
+		if conn != nil {
+			conn.Close()
+		}
+	})
+}
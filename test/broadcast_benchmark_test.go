@@ -0,0 +1,116 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"websocket-server.com/pkg"
+)
+
+// pipeListener hands out in-memory connections so that thousands of members can be connected without running out
+// of file descriptors.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (listener *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.conns:
+		return conn, nil
+	case <-listener.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (listener *pipeListener) Close() error {
+	listener.once.Do(func() { close(listener.closed) })
+	return nil
+}
+
+func (listener *pipeListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func (listener *pipeListener) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	server, client := net.Pipe()
+	select {
+	case listener.conns <- server:
+		return client, nil
+	case <-listener.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func BenchmarkBroadcast(b *testing.B) {
+	for _, members := range []int{1000, 10000} {
+		b.Run(fmt.Sprintf("%d members", members), func(b *testing.B) {
+			benchmarkBroadcast(b, members)
+		})
+	}
+}
+
+func benchmarkBroadcast(b *testing.B, members int) {
+	config := pkg.DefaultConfig()
+	config.UpgradeRate = 0
+	group := pkg.NewGroup(config)
+	go group.Create()
+
+	listener := newPipeListener()
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pkg.ServerPingPong(group, w, r)
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	// every broadcast has to reach every member before the next one is sent
+	var received sync.WaitGroup
+	for i := 0; i < members; i++ {
+		// half of the members speak the legacy protocol and half JSON envelopes
+		dialer := websocket.Dialer{NetDialContext: listener.dial}
+		if i%2 == 0 {
+			dialer.Subprotocols = []string{pkg.SUBPROTOCOL_V1}
+		}
+		conn, _, err := dialer.Dial("ws://pipe/", nil)
+		if err != nil {
+			b.Fatalf("could not connect member %d %v", i, err)
+		}
+		defer conn.Close()
+		conn.ReadMessage() // ignore the welcome message
+		go func() {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+				received.Done()
+			}
+		}()
+	}
+	for group.Count() < members {
+		time.Sleep(time.Millisecond)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		received.Add(members)
+		group.BroadcastMessage <- pkg.Envelope{Type: pkg.TypeBroadcast, From: "benchmark", Payload: `{"instrument": "EURUSD", "bid": 1.0842, "ask": 1.0843}`}
+		received.Wait()
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(b.N*members)/b.Elapsed().Seconds(), "deliveries/s")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	group.Stop(ctx)
+}
@@ -0,0 +1,496 @@
+package test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"websocket-server.com/pkg"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRedis is a stand-in for a Redis server which only knows about AUTH, PING and pub/sub.
+type fakeRedis struct {
+	listener net.Listener
+	password string
+	mu       sync.Mutex
+	conns    map[*fakeRedisConn]struct{}
+}
+
+type fakeRedisConn struct {
+	net.Conn
+	mu     sync.Mutex
+	topics map[string]struct{}
+}
+
+func (conn *fakeRedisConn) reply(format string, args ...any) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	fmt.Fprintf(conn, format, args...)
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen %v", err)
+	}
+	redis := &fakeRedis{listener: listener, password: password, conns: make(map[*fakeRedisConn]struct{})}
+	t.Cleanup(func() {
+		listener.Close()
+		redis.drop()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			fake := &fakeRedisConn{Conn: conn, topics: make(map[string]struct{})}
+			redis.mu.Lock()
+			redis.conns[fake] = struct{}{}
+			redis.mu.Unlock()
+			go redis.serve(fake)
+		}
+	}()
+	return redis
+}
+
+// drop closes all the connections to the stand-in as if the server restarted.
+func (redis *fakeRedis) drop() {
+	redis.mu.Lock()
+	defer redis.mu.Unlock()
+	for conn := range redis.conns {
+		conn.Close()
+		delete(redis.conns, conn)
+	}
+}
+
+// command reads a command, which is an array of bulk strings.
+func (redis *fakeRedis) command(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		length, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		arg := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, arg); err != nil {
+			return nil, err
+		}
+		args[i] = string(arg[:length])
+	}
+	return args, nil
+}
+
+func (redis *fakeRedis) serve(conn *fakeRedisConn) {
+	reader := bufio.NewReader(conn)
+	authenticated := redis.password == ""
+	for {
+		args, err := redis.command(reader)
+		if err != nil {
+			return
+		}
+		switch command := strings.ToUpper(args[0]); {
+		case command == "AUTH":
+			if args[1] != redis.password {
+				conn.reply("-WRONGPASS invalid password\r\n")
+				continue
+			}
+			authenticated = true
+			conn.reply("+OK\r\n")
+		case !authenticated:
+			conn.reply("-NOAUTH Authentication required.\r\n")
+		case command == "PING":
+			conn.reply("+PONG\r\n")
+		case command == "SUBSCRIBE" || command == "UNSUBSCRIBE":
+			for _, topic := range args[1:] {
+				redis.mu.Lock()
+				if command == "SUBSCRIBE" {
+					conn.topics[topic] = struct{}{}
+				} else {
+					delete(conn.topics, topic)
+				}
+				count := len(conn.topics)
+				redis.mu.Unlock()
+				conn.reply("*3\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n:%d\r\n", len(command), strings.ToLower(command), len(topic), topic, count)
+			}
+		case command == "PUBLISH":
+			topic, message := args[1], args[2]
+			redis.mu.Lock()
+			receivers := 0
+			for other := range redis.conns {
+				if _, ok := other.topics[topic]; ok {
+					receivers++
+					other.reply("*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(topic), topic, len(message), message)
+				}
+			}
+			redis.mu.Unlock()
+			conn.reply(":%d\r\n", receivers)
+		default:
+			conn.reply("-ERR unknown command '%s'\r\n", args[0])
+		}
+	}
+}
+
+func TestRedisBus(t *testing.T) {
+
+	receive := func(t *testing.T, subscription *pkg.Subscription) string {
+		select {
+		case message := <-subscription.C:
+			return string(message)
+		case <-time.After(time.Second):
+			t.Fatal("no message on the subscription")
+			return ""
+		}
+	}
+
+	t.Run("Test messages reach the subscribers of their topic only", func(t *testing.T) {
+		redis := newFakeRedis(t, "")
+		bus, err := pkg.OpenRedisBus(redis.listener.Addr().String(), "", time.Second)
+		assert.NoError(t, err)
+		defer bus.Close()
+		other, _ := pkg.OpenRedisBus(redis.listener.Addr().String(), "", time.Second)
+		defer other.Close()
+
+		lobby, err := bus.Subscribe("room/lobby")
+		assert.NoError(t, err)
+		side, _ := bus.Subscribe("room/side")
+		assert.NoError(t, other.Publish("room/lobby", []byte("hello\r\nlobby")))
+		assert.Equal(t, "hello\r\nlobby", receive(t, lobby))
+
+		side.Close()
+		other.Publish("room/side", []byte("nobody listens"))
+		other.Publish("room/lobby", []byte("still there"))
+		assert.Equal(t, "still there", receive(t, lobby))
+		assert.Empty(t, side.C)
+	})
+
+	t.Run("Test the bus authenticates and subscribes again after the connection broke", func(t *testing.T) {
+		redis := newFakeRedis(t, "secret")
+		_, err := pkg.OpenRedisBus(redis.listener.Addr().String(), "wrong", time.Second)
+		assert.ErrorContains(t, err, "WRONGPASS")
+
+		bus, err := pkg.OpenRedisBus(redis.listener.Addr().String(), "secret", time.Second)
+		assert.NoError(t, err)
+		defer bus.Close()
+		subscription, err := bus.Subscribe("room/lobby")
+		assert.NoError(t, err)
+
+		redis.drop()
+		assert.Eventually(t, func() bool {
+			// the first message after the drop is lost as the connection it had is gone
+			bus.Publish("room/lobby", []byte("again"))
+			select {
+			case message := <-subscription.C:
+				return string(message) == "again"
+			case <-time.After(50 * time.Millisecond):
+				return false
+			}
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Test publishing doesn't wait for a Redis that stopped answering", func(t *testing.T) {
+		// takes the connections but never answers
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer listener.Close()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+
+		bus, err := pkg.OpenRedisBus(listener.Addr().String(), "", time.Second)
+		assert.NoError(t, err)
+		dropped := pkg.BusDrops.Value("full")
+		start := time.Now()
+		for range 2000 {
+			bus.Publish("room/lobby", []byte("hello"))
+		}
+		assert.Less(t, time.Since(start), 500*time.Millisecond, "Publishing should only queue the messages")
+		assert.Greater(t, pkg.BusDrops.Value("full"), dropped, "The messages that don't fit into the queue should be counted")
+		assert.Error(t, bus.Publish("room/lobby", []byte("hello")))
+
+		start = time.Now()
+		bus.Close()
+		assert.Less(t, time.Since(start), 3*time.Second, "Closing should give up on the queued messages once Redis fails")
+	})
+}
+
+func TestCluster(t *testing.T) {
+
+	buses := map[string]func(t *testing.T) (pkg.Bus, pkg.Bus){
+		"memory": func(t *testing.T) (pkg.Bus, pkg.Bus) {
+			bus := pkg.NewMemoryBus()
+			return bus, bus
+		},
+		"redis": func(t *testing.T) (pkg.Bus, pkg.Bus) {
+			redis := newFakeRedis(t, "")
+			first, err := pkg.OpenRedisBus(redis.listener.Addr().String(), "", time.Second)
+			assert.NoError(t, err)
+			second, _ := pkg.OpenRedisBus(redis.listener.Addr().String(), "", time.Second)
+			t.Cleanup(func() {
+				first.Close()
+				second.Close()
+			})
+			return first, second
+		},
+	}
+	node := func(t *testing.T, bus pkg.Bus, number int) (*pkg.Rooms, string) {
+		config := pkg.DefaultConfig()
+		config.NodeNumber = number
+		rooms := pkg.NewRooms(config)
+		rooms.Bus = bus
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/getMemberIds" {
+				pkg.ServerRoomMemberIds(rooms, w, r)
+				return
+			}
+			pkg.ServerRoom(rooms, w, r)
+		}))
+		t.Cleanup(server.Close)
+		return rooms, server.URL
+	}
+	roster := func(rooms *pkg.Rooms) []string {
+		group, ok := rooms.Lookup(pkg.DefaultConfig().DefaultRoom)
+		if !ok {
+			return nil
+		}
+		return group.Roster()
+	}
+
+	for name, newBuses := range buses {
+		t.Run("Test members on different nodes share the room over the "+name+" bus", func(t *testing.T) {
+			first, second := newBuses(t)
+			roomsA, urlA := node(t, first, 1)
+			roomsB, urlB := node(t, second, 2)
+
+			alice := getV1WebSocketConnection(t, "ws"+strings.TrimPrefix(urlA, "http"))
+			aliceID := readEnvelope(t, alice)["payload"].(map[string]any)["id"].(string)
+			bob := getV1WebSocketConnection(t, "ws"+strings.TrimPrefix(urlB, "http"))
+			defer bob.Close()
+			bobID := readEnvelope(t, bob)["payload"].(map[string]any)["id"].(string)
+
+			both := []string{aliceID, bobID}
+			if bobID < aliceID {
+				both = []string{bobID, aliceID}
+			}
+			assert.Eventually(t, func() bool {
+				return assert.ObjectsAreEqual(both, roster(roomsA)) && assert.ObjectsAreEqual(both, roster(roomsB))
+			}, time.Second, 10*time.Millisecond, "Both nodes should know both members")
+
+			request, _ := http.NewRequest(http.MethodGet, urlB+"/getMemberIds", nil)
+			request.Header.Set("authorization", pkg.DefaultConfig().SecretKey)
+			response, err := http.DefaultClient.Do(request)
+			if assert.NoError(t, err) {
+				var data pkg.ResponseData
+				json.NewDecoder(response.Body).Decode(&data)
+				response.Body.Close()
+				assert.Equal(t, both, data.MemberIds, "/getMemberIds should list the members of every node")
+			}
+
+			alice.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, Payload: "hello from A"})
+			own := readEnvelope(t, alice)
+			broadcast := readEnvelope(t, bob)
+			assert.Equal(t, "hello from A", broadcast["payload"])
+			assert.Equal(t, aliceID, broadcast["from"])
+			assert.Equal(t, own["seq"], broadcast["seq"])
+
+			bob.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeDM, ID: "dm-1", To: aliceID, Payload: "hi alice"})
+			assert.Equal(t, pkg.TypeAck, readEnvelope(t, bob)["type"])
+			dm := readEnvelope(t, alice)
+			assert.Equal(t, pkg.TypeDM, dm["type"])
+			assert.Equal(t, bobID, dm["from"])
+			assert.Equal(t, "hi alice", dm["payload"])
+
+			alice.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			alice.Close()
+			assert.Eventually(t, func() bool {
+				return assert.ObjectsAreEqual([]string{bobID}, roster(roomsB))
+			}, time.Second, 10*time.Millisecond, "Members leaving on one node should leave on all of them")
+			bob.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeDM, ID: "dm-2", To: aliceID, Payload: "still there?"})
+			nack := readEnvelope(t, bob)
+			assert.Equal(t, pkg.TypeNack, nack["type"])
+			assert.Equal(t, pkg.CodeUnknownRecipient, nack["code"])
+		})
+	}
+}
+
+func TestClusterDMs(t *testing.T) {
+
+	bus := pkg.NewMemoryBus()
+	config := pkg.DefaultConfig()
+	config.NodeID = "a"
+	config.WriteDeadline = 200 * time.Millisecond
+	rooms := pkg.NewRooms(config)
+	rooms.Bus = bus
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pkg.ServerRoom(rooms, w, r)
+	}))
+	defer server.Close()
+
+	bob := getV1WebSocketConnection(t, "ws"+strings.TrimPrefix(server.URL, "http"))
+	defer bob.Close()
+	readEnvelope(t, bob)
+
+	// a node that claims carol and dave but only answers that carol is gone
+	topic := "room/" + config.DefaultRoom
+	ghost, err := bus.Subscribe(topic)
+	assert.NoError(t, err)
+	defer ghost.Close()
+	bus.Publish(topic, []byte(`{"node": "ghost", "kind": "joined", "members": ["carol", "dave"]}`))
+	go func() {
+		for data := range ghost.C {
+			var message struct {
+				Node    string       `json:"node"`
+				Kind    string       `json:"kind"`
+				To      string       `json:"to"`
+				Ref     uint64       `json:"ref"`
+				Message pkg.Envelope `json:"message"`
+			}
+			json.Unmarshal(data, &message)
+			if message.Kind == "dm" && message.To == "ghost" && message.Message.To == "carol" {
+				bus.Publish(topic, fmt.Appendf(nil, `{"node": "ghost", "kind": "undelivered", "to": %q, "ref": %d, "code": %q}`, message.Node, message.Ref, pkg.CodeUnknownRecipient))
+			}
+		}
+	}()
+	assert.Eventually(t, func() bool {
+		group, ok := rooms.Lookup(config.DefaultRoom)
+		return ok && len(group.Roster()) == 3
+	}, time.Second, 10*time.Millisecond)
+
+	t.Run("Test a DM is nacked when the other node no longer has the member", func(t *testing.T) {
+		bob.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeDM, ID: "dm-1", To: "carol", Payload: "hi carol"})
+		nack := readEnvelope(t, bob)
+		assert.Equal(t, pkg.TypeNack, nack["type"])
+		assert.Equal(t, "dm-1", nack["id"])
+		assert.Equal(t, pkg.CodeUnknownRecipient, nack["code"])
+	})
+
+	t.Run("Test a DM is nacked when the other node doesn't answer in time", func(t *testing.T) {
+		start := time.Now()
+		bob.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeDM, ID: "dm-2", To: "dave", Payload: "hi dave"})
+		nack := readEnvelope(t, bob)
+		assert.Equal(t, pkg.TypeNack, nack["type"])
+		assert.Equal(t, "dm-2", nack["id"])
+		assert.Equal(t, pkg.CodeUndeliverable, nack["code"])
+		assert.GreaterOrEqual(t, time.Since(start), config.WriteDeadline, "The sender should only get an answer once the node had its time")
+	})
+}
+
+func TestClusterModeration(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "keys.yaml")
+	os.WriteFile(path, []byte(strings.Join([]string{
+		"key-of-admin: {subject: admin, roles: [admin]}",
+		"key-of-alice: alice",
+		"key-of-bob: bob",
+	}, "\n")), 0o600)
+	authenticator, err := pkg.LoadAPIKeyAuthenticator(path)
+	assert.NoError(t, err)
+
+	bus := pkg.NewMemoryBus()
+	node := func(id string, number int) (*pkg.Rooms, string) {
+		config := pkg.DefaultConfig()
+		config.NodeID, config.NodeNumber = id, number
+		rooms := pkg.NewRooms(config)
+		rooms.Bus = bus
+		rooms.Authenticator = authenticator
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pkg.ServerRoom(rooms, w, r)
+		}))
+		t.Cleanup(server.Close)
+		return rooms, "ws" + strings.TrimPrefix(server.URL, "http")
+	}
+	roomsA, urlA := node("a", 1)
+	_, urlB := node("b", 2)
+	connect := func(t *testing.T, url string, key string) *websocket.Conn {
+		dialer := websocket.Dialer{Subprotocols: []string{pkg.SUBPROTOCOL_V1}}
+		conn, _, err := dialer.Dial(url, http.Header{"X-API-Key": {key}})
+		if err != nil {
+			t.Fatalf("could not connect with %s %v", key, err)
+		}
+		readEnvelope(t, conn)
+		return conn
+	}
+	expectClose := func(t *testing.T, conn *websocket.Conn) {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), "The connection should be closed with %d but got %v", websocket.ClosePolicyViolation, err)
+				return
+			}
+		}
+	}
+
+	admin := connect(t, urlA, "key-of-admin")
+	defer admin.Close()
+	alice := connect(t, urlB, "key-of-alice")
+	defer alice.Close()
+	bob := connect(t, urlB, "key-of-bob")
+	defer bob.Close()
+	assert.Eventually(t, func() bool {
+		group, ok := roomsA.Lookup(pkg.DefaultConfig().DefaultRoom)
+		return ok && len(group.Roster()) == 3
+	}, time.Second, 10*time.Millisecond, "Node a should know the members of node b")
+
+	t.Run("Test a member muted on another node can't send messages until it is unmuted", func(t *testing.T) {
+		admin.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeMute, ID: "m-1", To: "alice"})
+		assert.Equal(t, pkg.TypeAck, readEnvelope(t, admin)["type"])
+		assert.Equal(t, pkg.TypeMute, readEnvelope(t, alice)["type"], "The member should be told on its own node")
+
+		alice.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, ID: "b-1", Payload: "hello"})
+		nack := readEnvelope(t, alice)
+		assert.Equal(t, pkg.TypeNack, nack["type"])
+		assert.Equal(t, pkg.CodeMuted, nack["code"])
+
+		admin.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeUnmute, ID: "m-2", To: "alice"})
+		assert.Equal(t, pkg.TypeAck, readEnvelope(t, admin)["type"])
+		assert.Equal(t, pkg.TypeUnmute, readEnvelope(t, alice)["type"])
+		alice.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, ID: "b-2", Payload: "hello again"})
+		assert.Equal(t, "hello again", readEnvelope(t, alice)["payload"])
+		assert.Equal(t, pkg.TypeAck, readEnvelope(t, alice)["type"])
+		assert.Equal(t, "hello again", readEnvelope(t, admin)["payload"])
+		assert.Equal(t, "hello again", readEnvelope(t, bob)["payload"])
+	})
+
+	t.Run("Test a member banned on another node is disconnected and can't come back", func(t *testing.T) {
+		admin.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeBan, ID: "m-3", To: "alice"})
+		assert.Equal(t, pkg.TypeAck, readEnvelope(t, admin)["type"])
+		expectClose(t, alice)
+
+		dialer := websocket.Dialer{Subprotocols: []string{pkg.SUBPROTOCOL_V1}}
+		_, response, err := dialer.Dial(urlB, http.Header{"X-API-Key": {"key-of-alice"}})
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusForbidden, response.StatusCode)
+	})
+
+	t.Run("Test a member on another node can be kicked", func(t *testing.T) {
+		admin.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeKick, ID: "m-4", To: "bob"})
+		assert.Equal(t, pkg.TypeAck, readEnvelope(t, admin)["type"])
+		expectClose(t, bob)
+	})
+}
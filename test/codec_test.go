@@ -0,0 +1,93 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"websocket-server.com/pkg"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodecs(t *testing.T) {
+
+	t.Run("Test every codec round trips an envelope", func(t *testing.T) {
+		for _, codec := range pkg.Codecs {
+			data, err := codec.Marshal(pkg.Envelope{V: 1, Type: pkg.TypeDM, ID: "c-1", To: "abc", Payload: map[string]any{"text": "hi"}})
+			assert.NoError(t, err, codec.Name())
+
+			envelope, err := pkg.DecodeMessage(codec, data)
+			assert.NoError(t, err, codec.Name())
+			assert.Equal(t, pkg.TypeDM, envelope.Type, codec.Name())
+			assert.Equal(t, "c-1", envelope.ID, codec.Name())
+			assert.Equal(t, "abc", envelope.To, codec.Name())
+			assert.Equal(t, "hi", envelope.Payload.(map[string]any)["text"], codec.Name())
+		}
+	})
+
+	t.Run("Test clients with different codecs can talk to each other", func(t *testing.T) {
+		group := pkg.NewGroup(pkg.DefaultConfig())
+		go group.Create()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/pingpong", func(w http.ResponseWriter, r *http.Request) {
+			pkg.ServerPingPong(group, w, r)
+		})
+		server := httptest.NewServer(mux)
+		defer server.Close()
+		webSocketUrl := "ws" + strings.TrimPrefix(server.URL, "http") + "/pingpong"
+
+		connect := func(codec pkg.Codec) (*websocket.Conn, string) {
+			dialer := websocket.Dialer{Subprotocols: []string{codec.Name()}}
+			conn, _, err := dialer.Dial(webSocketUrl, nil)
+			if err != nil {
+				t.Fatalf("could not open a ws connection on %s %v", webSocketUrl, err)
+			}
+			assert.Equal(t, codec.Name(), conn.Subprotocol())
+			welcome := read(t, conn, codec)
+			assert.Equal(t, pkg.TypeWelcome, welcome.Type)
+			return conn, welcome.To
+		}
+
+		msgpackCodec, cborCodec := pkg.MessagePackCodec{}, pkg.CBORCodec{}
+		msgpackConn, msgpackId := connect(msgpackCodec)
+		defer msgpackConn.Close()
+		cborConn, cborId := connect(cborCodec)
+		defer cborConn.Close()
+
+		data, _ := msgpackCodec.Marshal(pkg.Envelope{V: 1, Type: pkg.TypeDM, To: cborId, Payload: map[string]any{"price": 101.5}})
+		msgpackConn.WriteMessage(websocket.BinaryMessage, data)
+		dm := read(t, cborConn, cborCodec)
+		assert.Equal(t, pkg.TypeDM, dm.Type)
+		assert.Equal(t, msgpackId, dm.From)
+		assert.Equal(t, 101.5, dm.Payload.(map[string]any)["price"])
+
+		data, _ = cborCodec.Marshal(pkg.Envelope{V: 1, Type: pkg.TypeDM, To: msgpackId, Payload: "hello"})
+		cborConn.WriteMessage(websocket.BinaryMessage, data)
+		dm = read(t, msgpackConn, msgpackCodec)
+		assert.Equal(t, cborId, dm.From)
+		assert.Equal(t, "hello", dm.Payload)
+
+		// text frames are always JSON no matter which codec was negotiated
+		msgpackConn.WriteMessage(websocket.TextMessage, []byte(`{"v":1,"type":"whoami","id":"c-1"}`))
+		whoami := read(t, msgpackConn, msgpackCodec)
+		assert.Equal(t, pkg.TypeWhoami, whoami.Type)
+		assert.Equal(t, msgpackId, whoami.Payload)
+	})
+}
+
+func read(t *testing.T, conn *websocket.Conn, codec pkg.Codec) pkg.Envelope {
+	messageType, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("could not read a message %v", err)
+	}
+	assert.Equal(t, codec.MessageType(), messageType)
+	var envelope pkg.Envelope
+	if err := codec.Unmarshal(data, &envelope); err != nil {
+		t.Fatalf("could not decode a message %v", err)
+	}
+	return envelope
+}
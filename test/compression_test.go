@@ -0,0 +1,104 @@
+package test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"websocket-server.com/pkg"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingConn counts the bytes read from the network, which are the compressed ones.
+type countingConn struct {
+	net.Conn
+	read *atomic.Int64
+}
+
+func (conn countingConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	conn.read.Add(int64(n))
+	return n, err
+}
+
+func TestCompression(t *testing.T) {
+
+	newServer := func(config *pkg.Config) string {
+		rooms := pkg.NewRooms(config)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pkg.ServerRoom(rooms, w, r)
+		}))
+		t.Cleanup(server.Close)
+		return "ws" + strings.TrimPrefix(server.URL, "http")
+	}
+	dial := func(t *testing.T, url string, compress bool) (*websocket.Conn, *http.Response, *atomic.Int64) {
+		read := &atomic.Int64{}
+		dialer := websocket.Dialer{
+			EnableCompression: compress,
+			NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				return countingConn{conn, read}, nil
+			},
+		}
+		conn, response, err := dialer.Dial(url, nil)
+		if err != nil {
+			t.Fatalf("could not open a ws connection on %s %v", url, err)
+		}
+		conn.ReadMessage() // ignore the welcome message
+		return conn, response, read
+	}
+	// the broadcast is verbose and repetitive like our JSON payloads
+	verbose := strings.Repeat(`{"instrument": "EURUSD", "bid": 1.0842, "ask": 1.0843}`, 200)
+
+	t.Run("Test large broadcasts are sent compressed to members that negotiated it", func(t *testing.T) {
+		url := newServer(pkg.DefaultConfig())
+		compressed, response, compressedRead := dial(t, url, true)
+		defer compressed.Close()
+		assert.Contains(t, response.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+		plain, _, plainRead := dial(t, url, false)
+		defer plain.Close()
+
+		compressedBefore, plainBefore := compressedRead.Load(), plainRead.Load()
+		plain.WriteJSON(pkg.Chat{ID: "-1", Message: verbose})
+		_, message, err := compressed.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, verbose, string(message), "The compressed broadcast should arrive unchanged")
+		_, message, err = plain.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, verbose, string(message))
+
+		assert.Less(t, compressedRead.Load()-compressedBefore, int64(len(verbose)/10), "The broadcast should have been compressed")
+		assert.Greater(t, plainRead.Load()-plainBefore, int64(len(verbose)), "Members without compression should get it uncompressed")
+	})
+
+	t.Run("Test messages below the threshold are sent uncompressed", func(t *testing.T) {
+		config := pkg.DefaultConfig()
+		config.CompressionThreshold = len(verbose) + 1
+		url := newServer(config)
+		conn, _, read := dial(t, url, true)
+		defer conn.Close()
+
+		before := read.Load()
+		conn.WriteJSON(pkg.Chat{ID: "-1", Message: verbose})
+		_, message, _ := conn.ReadMessage()
+		assert.Equal(t, verbose, string(message))
+		assert.Greater(t, read.Load()-before, int64(len(verbose)), "A message below the threshold should not be compressed")
+	})
+
+	t.Run("Test compression is not offered when it is turned off", func(t *testing.T) {
+		config := pkg.DefaultConfig()
+		config.Compression = false
+		conn, response, _ := dial(t, newServer(config), true)
+		defer conn.Close()
+		assert.Empty(t, response.Header.Get("Sec-WebSocket-Extensions"))
+	})
+}
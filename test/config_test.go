@@ -0,0 +1,81 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"websocket-server.com/pkg"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig(t *testing.T) {
+
+	env := func(values map[string]string) func(string) string {
+		return func(name string) string {
+			return values[name]
+		}
+	}
+
+	t.Run("Test defaults are used when nothing is given", func(t *testing.T) {
+		config, err := pkg.LoadConfig(nil, env(nil))
+		assert.NoError(t, err)
+		assert.Equal(t, pkg.DefaultConfig(), config)
+	})
+
+	t.Run("Test the file, the environment and the flags override each other in order", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		os.WriteFile(path, []byte("listen_address: \":9000\"\nping_interval: 5s\nsend_queue_size: 16\nsend_queue_overflow: disconnect\ndefault_room: file-room\n"), 0o600)
+
+		config, err := pkg.LoadConfig(
+			[]string{"-config", path, "-default-room", "flag-room"},
+			env(map[string]string{"WS_SEND_QUEUE_SIZE": "32", "WS_DEFAULT_ROOM": "env-room"}),
+		)
+		assert.NoError(t, err)
+		assert.Equal(t, ":9000", config.ListenAddress, "The file should override the defaults")
+		assert.Equal(t, 5*time.Second, config.PingInterval, "The file should override the defaults")
+		assert.Equal(t, pkg.OverflowDisconnect, config.SendQueueOverflow, "The file should override the defaults")
+		assert.Equal(t, 32, config.SendQueueSize, "The environment should override the file")
+		assert.Equal(t, "flag-room", config.DefaultRoom, "The flags should override the environment")
+		assert.Equal(t, pkg.DefaultConfig().TimeoutInterval, config.TimeoutInterval, "Settings given nowhere should keep their default")
+	})
+
+	t.Run("Test the config file can be given through the environment", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		os.WriteFile(path, []byte("secret_key: fromTheFile\n"), 0o600)
+
+		config, err := pkg.LoadConfig(nil, env(map[string]string{"WS_CONFIG": path}))
+		assert.NoError(t, err)
+		assert.Equal(t, "fromTheFile", config.SecretKey)
+	})
+
+	t.Run("Test invalid settings are rejected", func(t *testing.T) {
+		_, err := pkg.LoadConfig([]string{"-send-queue-size", "0", "-ping-interval", "10m"}, env(nil))
+		assert.ErrorContains(t, err, "send queue size must be positive")
+		assert.ErrorContains(t, err, "ping interval 10m0s must be shorter than the timeout interval")
+
+		_, err = pkg.LoadConfig([]string{"-auth-mode", "jwt", "-offline-queue-size", "256"}, env(nil))
+		assert.ErrorContains(t, err, "jwt auth mode needs a JWT key file or a JWKS file")
+		assert.ErrorContains(t, err, "offline queue size must be below the send queue size")
+
+		_, err = pkg.LoadConfig([]string{"-resume-grace", "30s", "-resume-buffer-size", "256"}, env(nil))
+		assert.ErrorContains(t, err, "resume buffer size plus offline queue size must be below the send queue size")
+
+		_, err = pkg.LoadConfig([]string{"-bus", "redis", "-presence-heartbeat", "20s"}, env(nil))
+		assert.ErrorContains(t, err, "presence heartbeat 20s must be shorter than the presence lease 15s")
+		assert.ErrorContains(t, err, "redis bus needs a node number between 0 and 1023", "The nodes should not pick their numbers themselves")
+
+		_, err = pkg.LoadConfig([]string{"-bus", "redis", "-node-number", "1024"}, env(nil))
+		assert.ErrorContains(t, err, "node number must be between 0 and 1023 but is 1024")
+		_, err = pkg.LoadConfig([]string{"-bus", "redis"}, env(map[string]string{"WS_NODE_NUMBER": "1023"}))
+		assert.NoError(t, err)
+
+		_, err = pkg.LoadConfig(nil, env(map[string]string{"WS_SEND_QUEUE_OVERFLOW": "explode"}))
+		assert.ErrorContains(t, err, "WS_SEND_QUEUE_OVERFLOW")
+
+		_, err = pkg.LoadConfig([]string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}, env(nil))
+		assert.ErrorContains(t, err, "could not read the config file")
+	})
+}
@@ -0,0 +1,230 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"websocket-server.com/pkg"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getV1WebSocketConnection(t testing.TB, url string) *websocket.Conn {
+	dialer := websocket.Dialer{Subprotocols: []string{pkg.SUBPROTOCOL_V1}}
+	ws, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("could not open a ws connection on %s %v", url, err)
+	}
+	return ws
+}
+
+func readEnvelope(t *testing.T, conn *websocket.Conn) map[string]any {
+	var envelope map[string]any
+	if err := conn.ReadJSON(&envelope); err != nil {
+		t.Fatalf("could not read an envelope %v", err)
+	}
+	return envelope
+}
+
+func TestParseMessage(t *testing.T) {
+
+	t.Run("Test legacy chats are converted to envelopes", func(t *testing.T) {
+		cases := map[string]pkg.Envelope{
+			`{"id":"0"}`:                        {V: 1, Type: pkg.TypeWhoami},
+			`{"id":"-1","message":"hi"}`:        {V: 1, Type: pkg.TypeBroadcast, Payload: "hi"},
+			`{"id":"-2","room":"trading-desk"}`: {V: 1, Type: pkg.TypeJoin, Room: "trading-desk"},
+			`{"id":"-3","room":"trading-desk"}`: {V: 1, Type: pkg.TypeLeave, Room: "trading-desk"},
+			`{"id":"abc","message":"hi"}`:       {V: 1, Type: pkg.TypeDM, To: "abc", Payload: "hi"},
+		}
+		for body, expected := range cases {
+			envelope, err := pkg.ParseMessage([]byte(body))
+			assert.NoError(t, err, body)
+			assert.Equal(t, expected, envelope, body)
+		}
+	})
+
+	t.Run("Test versioned envelopes are parsed", func(t *testing.T) {
+		envelope, err := pkg.ParseMessage([]byte(`{"v":1,"type":"dm","id":"c-1","to":"abc","payload":{"text":"hi"}}`))
+		assert.NoError(t, err)
+		assert.Equal(t, pkg.Envelope{V: 1, Type: pkg.TypeDM, ID: "c-1", To: "abc", Payload: map[string]any{"text": "hi"}}, envelope)
+
+		_, err = pkg.ParseMessage([]byte(`{"v":2,"type":"dm"}`))
+		assert.ErrorIs(t, err, pkg.ErrUnsupportedVersion)
+
+		_, err = pkg.ParseMessage([]byte(`not json`))
+		assert.Error(t, err)
+	})
+}
+
+func TestEnvelopeProtocol(t *testing.T) {
+	group := pkg.NewGroup(pkg.DefaultConfig())
+	go group.Create()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pingpong", func(w http.ResponseWriter, r *http.Request) {
+		pkg.ServerPingPong(group, w, r)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	webSocketUrl := "ws" + strings.TrimPrefix(server.URL, "http") + "/pingpong"
+
+	legacy := getWebSocketConnection(t, webSocketUrl)
+	defer legacy.Close()
+	_, welcomeMessage, _ := legacy.ReadMessage()
+	assert.True(t, strings.HasPrefix(string(welcomeMessage), "Welcome!"), "Legacy clients should still get the legacy welcome message")
+
+	v1 := getV1WebSocketConnection(t, webSocketUrl)
+	defer v1.Close()
+	assert.Equal(t, pkg.SUBPROTOCOL_V1, v1.Subprotocol())
+	welcome := readEnvelope(t, v1)
+	assert.Equal(t, float64(1), welcome["v"])
+	assert.Equal(t, pkg.TypeWelcome, welcome["type"])
+	v1Id := welcome["to"].(string)
+	legacyId := welcome["payload"].(map[string]any)["members"].([]any)[0].(string)
+
+	v1.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeWhoami, ID: "c-1"})
+	whoami := readEnvelope(t, v1)
+	assert.Equal(t, pkg.TypeWhoami, whoami["type"])
+	assert.Equal(t, "c-1", whoami["id"], "Replies should carry the ID of the request")
+	assert.Equal(t, v1Id, whoami["payload"])
+
+	v1.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeDM, To: legacyId, Payload: "hello legacy"})
+	_, dm, _ := legacy.ReadMessage()
+	assert.Equal(t, "hello legacy", string(dm), "Legacy clients should get the bare message")
+
+	chat, _ := json.Marshal(pkg.Chat{ID: v1Id, Message: "hello v1"})
+	legacy.WriteMessage(websocket.TextMessage, chat)
+	received := readEnvelope(t, v1)
+	assert.Equal(t, pkg.TypeDM, received["type"])
+	assert.Equal(t, legacyId, received["from"])
+	assert.Equal(t, "hello v1", received["payload"])
+	assert.Greater(t, received["seq"], float64(0), "Delivered DMs should carry a server message ID")
+	assert.InDelta(t, float64(time.Now().UnixMilli()), received["ts"], 5000, "Delivered DMs should carry the server time")
+
+	v1.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, Payload: "hello everybody"})
+	broadcast := readEnvelope(t, v1)
+	assert.Equal(t, pkg.TypeBroadcast, broadcast["type"])
+	assert.Equal(t, v1Id, broadcast["from"])
+	assert.Greater(t, broadcast["seq"], received["seq"], "Server message IDs should be monotonic")
+	assert.InDelta(t, float64(time.Now().UnixMilli()), broadcast["ts"], 5000, "Delivered broadcasts should carry the server time")
+	_, message, _ := legacy.ReadMessage()
+	assert.Equal(t, "hello everybody", string(message))
+}
+
+func TestErrorReplies(t *testing.T) {
+	group := pkg.NewGroup(pkg.DefaultConfig())
+	go group.Create()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pingpong", func(w http.ResponseWriter, r *http.Request) {
+		pkg.ServerPingPong(group, w, r)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	webSocketUrl := "ws" + strings.TrimPrefix(server.URL, "http") + "/pingpong"
+
+	v1 := getV1WebSocketConnection(t, webSocketUrl)
+	defer v1.Close()
+	readEnvelope(t, v1) // ignore the welcome message
+
+	expectReply := func(kind string, code string, id string) {
+		reply := readEnvelope(t, v1)
+		assert.Equal(t, kind, reply["type"])
+		assert.Equal(t, code, reply["code"])
+		if id != "" {
+			assert.Equal(t, id, reply["id"], "The error should carry the ID of the offending request")
+		}
+		assert.NotEmpty(t, reply["payload"], "The error should carry a reason")
+	}
+	expectError := func(code string, id string) {
+		expectReply(pkg.TypeError, code, id)
+	}
+
+	v1.WriteMessage(websocket.TextMessage, []byte("this is not json"))
+	expectError(pkg.CodeInvalidJSON, "")
+
+	v1.WriteMessage(websocket.TextMessage, []byte(`{"v":2,"type":"dm","id":"c-1"}`))
+	expectError(pkg.CodeUnsupportedVersion, "c-1")
+
+	v1.WriteJSON(pkg.Envelope{V: 1, Type: "shout", ID: "c-2"})
+	expectError(pkg.CodeUnsupportedType, "c-2")
+
+	v1.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeDM, ID: "c-3", To: "nobody", Payload: "hello?"})
+	expectReply(pkg.TypeNack, pkg.CodeUnknownRecipient, "c-3")
+
+	v1.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeDM, ID: "c-4", Payload: "hello?"})
+	expectReply(pkg.TypeNack, pkg.CodeUnknownRecipient, "c-4")
+
+	v1.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeDM, To: "nobody", Payload: "hello?"})
+	expectError(pkg.CodeUnknownRecipient, "")
+
+	v1.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, ID: "c-5", Payload: strings.Repeat("a", pkg.DefaultConfig().MaxPayloadSize)})
+	expectError(pkg.CodePayloadTooLarge, "")
+
+	v1.WriteMessage(websocket.BinaryMessage, []byte{1, 2, 3})
+	expectError(pkg.CodeUnsupportedType, "")
+}
+
+func TestAcknowledgements(t *testing.T) {
+	rooms := pkg.NewRooms(pkg.DefaultConfig())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pingpong", func(w http.ResponseWriter, r *http.Request) {
+		pkg.ServerRoom(rooms, w, r)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	webSocketUrl := "ws" + strings.TrimPrefix(server.URL, "http") + "/pingpong"
+
+	sender := getV1WebSocketConnection(t, webSocketUrl)
+	defer sender.Close()
+	senderId := readEnvelope(t, sender)["to"].(string)
+
+	recipient := getV1WebSocketConnection(t, webSocketUrl)
+	defer recipient.Close()
+	recipientId := readEnvelope(t, recipient)["to"].(string)
+
+	sender.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeDM, ID: "c-1", To: recipientId, Payload: "hello"})
+	dm := readEnvelope(t, recipient)
+	assert.Equal(t, pkg.TypeDM, dm["type"])
+	ack := readEnvelope(t, sender)
+	assert.Equal(t, pkg.TypeAck, ack["type"])
+	assert.Equal(t, "c-1", ack["id"], "The ack should carry the ID of the request")
+	assert.Equal(t, dm["seq"], ack["seq"], "The ack should carry the message ID of the delivered DM")
+
+	recipient.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeRead, To: senderId, Seq: uint64(dm["seq"].(float64))})
+	receipt := readEnvelope(t, sender)
+	assert.Equal(t, pkg.TypeRead, receipt["type"])
+	assert.Equal(t, recipientId, receipt["from"])
+	assert.Equal(t, dm["seq"], receipt["seq"], "The read receipt should name the DM that was read")
+
+	sender.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, ID: "c-2", Payload: "hello everybody"})
+	assert.Equal(t, pkg.TypeBroadcast, readEnvelope(t, sender)["type"])
+	ack = readEnvelope(t, sender)
+	assert.Equal(t, pkg.TypeAck, ack["type"])
+	assert.Equal(t, "c-2", ack["id"])
+	assert.Equal(t, pkg.TypeBroadcast, readEnvelope(t, recipient)["type"])
+
+	sender.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeDM, ID: "c-3", To: "nobody", Payload: "hello?"})
+	nack := readEnvelope(t, sender)
+	assert.Equal(t, pkg.TypeNack, nack["type"])
+	assert.Equal(t, "c-3", nack["id"])
+	assert.Equal(t, pkg.CodeUnknownRecipient, nack["code"])
+
+	sender.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeLeave, ID: "c-4", Room: "never-joined"})
+	nack = readEnvelope(t, sender)
+	assert.Equal(t, pkg.TypeNack, nack["type"])
+	assert.Equal(t, pkg.CodeInvalidRoom, nack["code"])
+
+	sender.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeJoin, ID: "c-5", Room: "trading-desk"})
+	replies := map[string]string{}
+	for i := 0; i < 2; i++ {
+		reply := readEnvelope(t, sender)
+		replies[reply["type"].(string)] = reply["room"].(string)
+	}
+	assert.Equal(t, map[string]string{pkg.TypeAck: "trading-desk", pkg.TypeWelcome: "trading-desk"}, replies, "Joining a room should be acked next to the welcome")
+}
@@ -0,0 +1,190 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"websocket-server.com/pkg"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// seeds are the messages the fuzz tests start from, covering both protocols and the usual ways to get them wrong.
+var seeds = []string{
+	`{"id": "0"}`,
+	`{"id": "-1", "message": "hello"}`,
+	`{"id": "-2", "room": "trading-desk"}`,
+	`{"v": 1, "type": "broadcast", "id": "c-1", "payload": "hello"}`,
+	`{"v": 1, "type": "dm", "to": "somebody", "payload": {"nested": [1, 2, {"deeper": null}]}}`,
+	`{"v": 2, "type": "dm"}`,
+	`{"v": "1", "type": 1}`,
+	`{"v": 1, "type": "read", "seq": -1}`,
+	`{"v": 1, "type": "kick", "to": ""}`,
+	`[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[]]]]]]]]]]]]]]]]]]]]]]]]]]]]]]]]]]]]]]]]`,
+	`{"payload": "\u0000\ud800"}`,
+	`{"id": `,
+	`null`,
+	``,
+}
+
+func FuzzParseMessage(f *testing.F) {
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, body []byte) {
+		envelope, err := pkg.ParseMessage(body)
+		if err != nil {
+			return
+		}
+		// whatever was accepted has to survive the way back to a client
+		if _, err := json.Marshal(envelope); err != nil {
+			t.Fatalf("accepted %q but could not encode it again %v", body, err)
+		}
+	})
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	for _, seed := range seeds {
+		envelope, err := pkg.ParseMessage([]byte(seed))
+		if err != nil {
+			continue
+		}
+		for _, codec := range pkg.Codecs {
+			if data, err := codec.Marshal(envelope); err == nil {
+				f.Add(codec.Name(), data)
+			}
+		}
+	}
+	f.Fuzz(func(t *testing.T, name string, body []byte) {
+		codec, ok := pkg.CodecFor(name)
+		if !ok {
+			return
+		}
+		pkg.DecodeMessage(codec, body)
+	})
+}
+
+// FuzzReceive pushes the inputs through a live connection, which is what the loop of Member.Activate reads, and makes
+// sure that the server still answers afterwards.
+func FuzzReceive(f *testing.F) {
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	config := pkg.DefaultConfig()
+	config.MemberMessageRate, config.MemberByteRate, config.RoomBroadcastRate, config.UpgradeRate = 0, 0, 0, 0
+	rooms := pkg.NewRooms(config)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pkg.ServerRoom(rooms, w, r)
+	}))
+	defer server.Close()
+	conn := getV1WebSocketConnection(f, "ws"+strings.TrimPrefix(server.URL, "http"))
+	defer conn.Close()
+
+	f.Fuzz(func(t *testing.T, body string) {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(body)); err != nil {
+			t.Fatalf("could not send %q %v", body, err)
+		}
+		conn.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeWhoami, ID: "still-alive"})
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			var envelope pkg.Envelope
+			if err := conn.ReadJSON(&envelope); err != nil {
+				t.Fatalf("the server stopped answering after %q %v", body, err)
+			}
+			if envelope.Type == pkg.TypeWhoami && envelope.ID == "still-alive" {
+				return
+			}
+		}
+	})
+}
+
+func TestReadLimits(t *testing.T) {
+
+	config := pkg.DefaultConfig()
+	config.MaxFrameSize = int64(config.MaxPayloadSize) * 2
+	config.MaxJSONDepth = 8
+	rooms := pkg.NewRooms(config)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pkg.ServerRoom(rooms, w, r)
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	t.Run("Test documents nested too deeply are rejected", func(t *testing.T) {
+		conn := getV1WebSocketConnection(t, url)
+		defer conn.Close()
+		readEnvelope(t, conn) // ignore the welcome message
+
+		deep := `{"v": 1, "type": "broadcast", "payload": ` + strings.Repeat("[", 10) + strings.Repeat("]", 10) + `}`
+		conn.WriteMessage(websocket.TextMessage, []byte(deep))
+		reply := readEnvelope(t, conn)
+		assert.Equal(t, pkg.TypeError, reply["type"])
+		assert.Equal(t, pkg.CodeInvalidJSON, reply["code"])
+
+		shallow := `{"v": 1, "type": "whoami", "payload": "[[[[[[[[[[ in a string doesn't count"}`
+		conn.WriteMessage(websocket.TextMessage, []byte(shallow))
+		assert.Equal(t, pkg.TypeWhoami, readEnvelope(t, conn)["type"])
+	})
+
+	t.Run("Test binary messages nested too deeply are rejected", func(t *testing.T) {
+		nested := func(depth int) any {
+			var value any = "bottom"
+			for range depth {
+				value = []any{value}
+			}
+			return value
+		}
+		for _, codec := range []pkg.Codec{pkg.MessagePackCodec{}, pkg.CBORCodec{}} {
+			dialer := websocket.Dialer{Subprotocols: []string{codec.Name()}}
+			conn, _, err := dialer.Dial(url, nil)
+			if !assert.NoError(t, err) {
+				continue
+			}
+			read(t, conn, codec) // ignore the welcome message
+
+			for _, depth := range []int{9, 60000} {
+				data, _ := codec.Marshal(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, ID: "deep", Payload: nested(depth)})
+				conn.WriteMessage(websocket.BinaryMessage, data)
+				reply := read(t, conn, codec)
+				assert.Equal(t, pkg.TypeError, reply.Type, "%s messages %d levels deep should be rejected", codec.Name(), depth)
+				assert.Equal(t, pkg.CodeInvalidJSON, reply.Code)
+				assert.Contains(t, reply.Payload, "nested deeper than 8 levels")
+			}
+
+			data, _ := codec.Marshal(pkg.Envelope{V: 1, Type: pkg.TypeWhoami, Payload: nested(7)})
+			conn.WriteMessage(websocket.BinaryMessage, data)
+			assert.Equal(t, pkg.TypeWhoami, read(t, conn, codec).Type, "%s messages within the depth should be accepted", codec.Name())
+			conn.Close()
+		}
+
+		for _, codec := range []pkg.Codec{pkg.MessagePackCodec{MaxDepth: 40}, pkg.CBORCodec{MaxDepth: 40}} {
+			data, _ := codec.Marshal(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, Payload: nested(60000)})
+			var envelope pkg.Envelope
+			assert.ErrorIs(t, codec.Unmarshal(data, &envelope), pkg.ErrNestedTooDeep, "%s should refuse the message before decoding it", codec.Name())
+
+			data, _ = codec.Marshal(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, Payload: nested(39)})
+			assert.NoError(t, codec.Unmarshal(data, &envelope), "%s should take messages as deep as its limit", codec.Name())
+		}
+	})
+
+	t.Run("Test messages over the frame size close the connection", func(t *testing.T) {
+		conn := getV1WebSocketConnection(t, url)
+		defer conn.Close()
+		readEnvelope(t, conn) // ignore the welcome message
+
+		conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", int(config.MaxFrameSize)+1)))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, _, err := conn.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig), "The connection should be closed with 1009 but got %v", err)
+
+		time.Sleep(100 * time.Millisecond)
+		group, _ := rooms.Lookup(config.DefaultRoom)
+		assert.Equal(t, 0, group.Count(), "The member should be removed right away instead of after the timeout")
+	})
+}
@@ -0,0 +1,135 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"websocket-server.com/pkg"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// get calls the handler and returns the status code and body of the response.
+func get(t *testing.T, handler http.HandlerFunc) (int, string) {
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	body, _ := io.ReadAll(recorder.Body)
+	return recorder.Code, string(body)
+}
+
+func TestHealth(t *testing.T) {
+
+	newRooms := func(config *pkg.Config) (*pkg.Rooms, string) {
+		rooms := pkg.NewRooms(config)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pkg.ServerRoom(rooms, w, r)
+		}))
+		t.Cleanup(server.Close)
+		return rooms, "ws" + strings.TrimPrefix(server.URL, "http")
+	}
+	ready := func(rooms *pkg.Rooms) (int, string) {
+		return get(t, func(w http.ResponseWriter, r *http.Request) { pkg.ServerRoomsReady(rooms, w, r) })
+	}
+
+	t.Run("Test the server is healthy while the process is alive", func(t *testing.T) {
+		code, body := get(t, pkg.ServerHealth)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "ok", body)
+	})
+
+	t.Run("Test the rooms are ready while their loops respond", func(t *testing.T) {
+		rooms, url := newRooms(pkg.DefaultConfig())
+		conn := getV1WebSocketConnection(t, url)
+		defer conn.Close()
+		readEnvelope(t, conn) // ignore the welcome message
+
+		code, body := ready(rooms)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "ready", body)
+	})
+
+	t.Run("Test a group whose loop is wedged is not ready", func(t *testing.T) {
+		config := pkg.DefaultConfig()
+		config.ReadinessTimeout = 50 * time.Millisecond
+		group := pkg.NewGroup(config) // the loop never runs
+
+		start := time.Now()
+		code, body := get(t, func(w http.ResponseWriter, r *http.Request) { pkg.ServerReady(group, w, r) })
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Contains(t, body, "did not respond")
+		assert.Less(t, time.Since(start), time.Second, "The probe should give up after the readiness timeout")
+
+		go group.Create()
+		defer group.Stop(context.Background())
+		code, _ = get(t, func(w http.ResponseWriter, r *http.Request) { pkg.ServerReady(group, w, r) })
+		assert.Equal(t, http.StatusOK, code, "The group should be ready once its loop runs")
+	})
+
+	t.Run("Test rooms at their connection cap are not ready and refuse new members", func(t *testing.T) {
+		config := pkg.DefaultConfig()
+		config.MaxConnections = 1
+		rooms, url := newRooms(config)
+		conn := getV1WebSocketConnection(t, url)
+		defer conn.Close()
+		readEnvelope(t, conn) // ignore the welcome message
+
+		code, body := ready(rooms)
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Contains(t, body, "at the cap of 1 connections")
+
+		_, response, err := websocket.DefaultDialer.Dial(url, nil)
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode)
+	})
+
+	t.Run("Test draining rooms are not ready", func(t *testing.T) {
+		rooms, _ := newRooms(pkg.DefaultConfig())
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		rooms.Stop(ctx)
+
+		code, body := ready(rooms)
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Contains(t, body, pkg.DefaultConfig().ShutdownReason)
+	})
+
+	t.Run("Test the status reports the server and its members", func(t *testing.T) {
+		pkg.Version = "v1.2.3"
+		defer func() { pkg.Version = "" }()
+		rooms, url := newRooms(pkg.DefaultConfig())
+		for i := 0; i < 2; i++ {
+			conn := getV1WebSocketConnection(t, url+"?room=status")
+			defer conn.Close()
+			readEnvelope(t, conn) // ignore the welcome message
+		}
+
+		code, body := get(t, func(w http.ResponseWriter, r *http.Request) { pkg.ServerRoomsStatus(rooms, w, r) })
+		assert.Equal(t, http.StatusOK, code)
+		var status pkg.Status
+		assert.NoError(t, json.Unmarshal([]byte(body), &status))
+		assert.Equal(t, "v1.2.3", status.Version)
+		assert.Equal(t, runtime.Version(), status.GoVersion)
+		assert.Greater(t, status.UptimeSeconds, 0.0)
+		assert.Greater(t, status.Goroutines, 0)
+		assert.Equal(t, 2, status.Connections)
+		assert.Equal(t, 1, status.Rooms)
+		assert.Nil(t, status.Members, "The rooms should not be listed without the secret key")
+		assert.False(t, status.Draining)
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/status", nil)
+		request.Header.Set("authorization", pkg.DefaultConfig().SecretKey)
+		pkg.ServerRoomsStatus(rooms, recorder, request)
+		status = pkg.Status{}
+		assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&status))
+		assert.Equal(t, map[string]int{"status": 2}, status.Members)
+	})
+}
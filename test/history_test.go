@@ -0,0 +1,237 @@
+package test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"websocket-server.com/pkg"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// seqs returns the Seq of every message.
+func seqs(messages []pkg.Envelope) []uint64 {
+	seqs := make([]uint64, 0, len(messages))
+	for _, message := range messages {
+		seqs = append(seqs, message.Seq)
+	}
+	return seqs
+}
+
+func TestMessageStores(t *testing.T) {
+
+	fill := func(t *testing.T, store pkg.MessageStore) {
+		for seq := uint64(1); seq <= 6; seq++ {
+			message := pkg.Envelope{Type: pkg.TypeBroadcast, From: "alice", Room: "lobby", Seq: seq, Payload: fmt.Sprintf("message %d", seq)}
+			if seq%2 == 0 {
+				message.Type, message.To = pkg.TypeDM, "bob"
+			}
+			assert.NoError(t, store.Append(message))
+		}
+		assert.Error(t, store.Append(pkg.Envelope{Type: pkg.TypeRead, From: "bob", To: "alice", Room: "lobby", Seq: 2}), "Read receipts are not kept")
+	}
+	check := func(t *testing.T, store pkg.MessageStore) {
+		room := pkg.RoomConversation("lobby")
+		messages, err := store.History(room, 0, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{3, 5}, seqs(messages), "The newest messages should come first, oldest first")
+		assert.Equal(t, "message 5", messages[1].Payload)
+
+		messages, _ = store.History(room, 3, 2)
+		assert.Equal(t, []uint64{1}, seqs(messages), "The cursor should page backwards")
+
+		messages, _ = store.History(pkg.DMConversation("lobby", "bob", "alice"), 0, 10)
+		assert.Equal(t, []uint64{2, 4, 6}, seqs(messages), "A DM thread should be the same either way round")
+
+		messages, _ = store.History(pkg.RoomConversation("elsewhere"), 0, 10)
+		assert.Empty(t, messages)
+	}
+
+	t.Run("Test the memory store pages through the conversations", func(t *testing.T) {
+		store := pkg.NewMemoryStore(10)
+		fill(t, store)
+		check(t, store)
+	})
+
+	t.Run("Test the memory store keeps only the last messages", func(t *testing.T) {
+		store := pkg.NewMemoryStore(3)
+		for seq := uint64(1); seq <= 5; seq++ {
+			store.Append(pkg.Envelope{Type: pkg.TypeBroadcast, Room: "lobby", Seq: seq})
+		}
+		messages, _ := store.History(pkg.RoomConversation("lobby"), 0, 10)
+		assert.Equal(t, []uint64{3, 4, 5}, seqs(messages))
+		messages, _ = store.History(pkg.RoomConversation("lobby"), 5, 1)
+		assert.Equal(t, []uint64{4}, seqs(messages))
+	})
+
+	t.Run("Test the stores keep late messages of other nodes in order", func(t *testing.T) {
+		file, err := pkg.OpenFileStore(filepath.Join(t.TempDir(), "history.log"))
+		assert.NoError(t, err)
+		defer file.Close()
+		for _, store := range []pkg.MessageStore{pkg.NewMemoryStore(3), file} {
+			for _, seq := range []uint64{2, 5, 3, 1, 6} {
+				store.Append(pkg.Envelope{Type: pkg.TypeBroadcast, Room: "lobby", Seq: seq})
+			}
+			messages, _ := store.History(pkg.RoomConversation("lobby"), 0, 3)
+			assert.Equal(t, []uint64{3, 5, 6}, seqs(messages))
+			messages, _ = store.History(pkg.RoomConversation("lobby"), 5, 10)
+			assert.Subset(t, []uint64{1, 2, 3}, seqs(messages))
+			assert.IsIncreasing(t, seqs(messages), "A page before a late message should be in order as well")
+		}
+	})
+
+	t.Run("Test the file store keeps the messages across restarts", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "history.log")
+		store, err := pkg.OpenFileStore(path)
+		assert.NoError(t, err)
+		fill(t, store)
+		check(t, store)
+		assert.NoError(t, store.Close())
+
+		// a crash in the middle of a write leaves half a line behind
+		file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+		file.WriteString(`{"v": 1, "type": "broadcast", "room": "lob`)
+		file.Close()
+
+		store, err = pkg.OpenFileStore(path)
+		assert.NoError(t, err)
+		defer store.Close()
+		check(t, store)
+		assert.NoError(t, store.Append(pkg.Envelope{Type: pkg.TypeBroadcast, Room: "lobby", Seq: 7}))
+		messages, _ := store.History(pkg.RoomConversation("lobby"), 0, 1)
+		assert.Equal(t, []uint64{7}, seqs(messages), "The partly written message should have been cut off")
+	})
+
+	t.Run("Test names with slashes do not mix up conversations", func(t *testing.T) {
+		assert.NotEqual(t, pkg.DMConversation("r", "a", "b/c"), pkg.DMConversation("r", "a/b", "c"))
+		assert.NotEqual(t, pkg.DMConversation("r/a", "b", "c"), pkg.DMConversation("r", "a/b", "c"))
+		assert.NotEqual(t, pkg.RoomConversation("dm/r/a/b"), pkg.DMConversation("r", "a", "b"))
+
+		store := pkg.NewMemoryStore(10)
+		store.Append(pkg.Envelope{Type: pkg.TypeDM, Room: "r", From: "a", To: "b/c", Seq: 1})
+		store.Append(pkg.Envelope{Type: pkg.TypeDM, Room: "r", From: "a/b", To: "c", Seq: 2})
+		messages, _ := store.History(pkg.DMConversation("r", "a", "b/c"), 0, 10)
+		assert.Equal(t, []uint64{1}, seqs(messages))
+		messages, _ = store.History(pkg.DMConversation("r", "c", "a/b"), 0, 10)
+		assert.Equal(t, []uint64{2}, seqs(messages))
+	})
+}
+
+func TestHistory(t *testing.T) {
+
+	newServer := func(t *testing.T, store pkg.MessageStore) string {
+		config := pkg.DefaultConfig()
+		config.HistoryPageSize = 3
+		rooms := pkg.NewRooms(config)
+		rooms.Store = store
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pkg.ServerRoom(rooms, w, r)
+		}))
+		t.Cleanup(server.Close)
+		return "ws" + strings.TrimPrefix(server.URL, "http")
+	}
+	history := func(t *testing.T, reply map[string]any) ([]any, uint64) {
+		assert.Equal(t, pkg.TypeHistory, reply["type"])
+		payload := reply["payload"].(map[string]any)
+		cursor, _ := payload["cursor"].(float64)
+		return payload["messages"].([]any), uint64(cursor)
+	}
+	payloads := func(messages []any) []any {
+		var payloads []any
+		for _, message := range messages {
+			payloads = append(payloads, message.(map[string]any)["payload"])
+		}
+		return payloads
+	}
+
+	t.Run("Test members page backwards through the broadcasts of a room", func(t *testing.T) {
+		url := newServer(t, pkg.NewMemoryStore(100))
+		alice := getV1WebSocketConnection(t, url)
+		defer alice.Close()
+		readEnvelope(t, alice) // ignore the welcome message
+		for i := 1; i <= 5; i++ {
+			alice.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, Payload: fmt.Sprintf("message %d", i)})
+			readEnvelope(t, alice) // ignore our own broadcast
+		}
+
+		// members joining later can catch up
+		bob := getV1WebSocketConnection(t, url)
+		defer bob.Close()
+		readEnvelope(t, bob) // ignore the welcome message
+		bob.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeHistory, ID: "h-1"})
+		reply := readEnvelope(t, bob)
+		assert.Equal(t, "h-1", reply["id"])
+		messages, cursor := history(t, reply)
+		assert.Equal(t, []any{"message 3", "message 4", "message 5"}, payloads(messages), "The page should be capped by the history page size")
+		assert.NotZero(t, cursor)
+
+		bob.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeHistory, Seq: cursor, Payload: pkg.HistoryRequest{Limit: 1}})
+		messages, cursor = history(t, readEnvelope(t, bob))
+		assert.Equal(t, []any{"message 2"}, payloads(messages))
+		bob.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeHistory, Seq: cursor})
+		messages, cursor = history(t, readEnvelope(t, bob))
+		assert.Equal(t, []any{"message 1"}, payloads(messages))
+		assert.Zero(t, cursor, "There should be nothing before the first message")
+	})
+
+	t.Run("Test members read their own DM threads only", func(t *testing.T) {
+		url := newServer(t, pkg.NewMemoryStore(100))
+		alice := getV1WebSocketConnection(t, url)
+		defer alice.Close()
+		aliceID := readEnvelope(t, alice)["payload"].(map[string]any)["id"].(string)
+		bob := getV1WebSocketConnection(t, url)
+		defer bob.Close()
+		bobID := readEnvelope(t, bob)["payload"].(map[string]any)["id"].(string)
+
+		alice.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeDM, To: bobID, Payload: "hi bob"})
+		readEnvelope(t, bob)
+		bob.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeDM, To: aliceID, Payload: "hi alice"})
+		readEnvelope(t, alice)
+
+		bob.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeHistory, To: aliceID})
+		reply := readEnvelope(t, bob)
+		messages, _ := history(t, reply)
+		assert.Equal(t, []any{"hi bob", "hi alice"}, payloads(messages))
+		assert.Equal(t, aliceID, reply["to"])
+
+		bob.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeHistory, To: "somebody-else"})
+		messages, _ = history(t, readEnvelope(t, bob))
+		assert.Empty(t, messages)
+
+		bob.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeHistory, ID: "h-2", Room: "private"})
+		nack := readEnvelope(t, bob)
+		assert.Equal(t, pkg.TypeNack, nack["type"], "Rooms the member isn't part of can't be read")
+		assert.Equal(t, pkg.CodeInvalidRoom, nack["code"])
+	})
+
+	t.Run("Test broadcasts continue the sequence of the file store after a restart", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "history.log")
+		os.WriteFile(path, []byte(`{"v": 1, "type": "broadcast", "room": "lobby", "seq": 1000000000, "payload": "old"}`+"\n"), 0o600)
+		store, err := pkg.OpenFileStore(path)
+		assert.NoError(t, err)
+		defer store.Close()
+
+		conn := getV1WebSocketConnection(t, newServer(t, store))
+		defer conn.Close()
+		readEnvelope(t, conn) // ignore the welcome message
+		conn.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, Payload: "new"})
+		assert.Greater(t, readEnvelope(t, conn)["seq"], float64(1000000000))
+
+		conn.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeHistory})
+		messages, _ := history(t, readEnvelope(t, conn))
+		assert.Equal(t, []any{"old", "new"}, payloads(messages))
+	})
+
+	t.Run("Test history is refused without a store", func(t *testing.T) {
+		conn := getV1WebSocketConnection(t, newServer(t, nil))
+		defer conn.Close()
+		readEnvelope(t, conn) // ignore the welcome message
+		conn.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeHistory, ID: "h-1"})
+		assert.Equal(t, pkg.TypeNack, readEnvelope(t, conn)["type"])
+	})
+}
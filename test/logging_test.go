@@ -0,0 +1,138 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"websocket-server.com/pkg"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// logBuffer collects the log of the server, which is written from many goroutines.
+type logBuffer struct {
+	mu     sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (log *logBuffer) Write(p []byte) (int, error) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	return log.buffer.Write(p)
+}
+
+func (log *logBuffer) String() string {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	return log.buffer.String()
+}
+
+// records returns the records of a JSON log with the given message.
+func (log *logBuffer) records(t *testing.T, message string) []map[string]any {
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(log.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("the log line %q is not JSON %v", line, err)
+		}
+		if record["msg"] == message {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// useLogger makes the server log to the returned buffer the way the config asks for until the test is done.
+func useLogger(t *testing.T, config *pkg.Config) *logBuffer {
+	log := &logBuffer{}
+	logger, err := pkg.NewLogger(config, log)
+	if err != nil {
+		t.Fatalf("could not create the logger %v", err)
+	}
+	previous := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return log
+}
+
+func TestLogging(t *testing.T) {
+
+	secret := "the secret plan"
+	broadcast := func(t *testing.T, config *pkg.Config) string {
+		rooms := pkg.NewRooms(config)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pkg.ServerRoom(rooms, w, r)
+		}))
+		defer server.Close()
+
+		conn := getV1WebSocketConnection(t, "ws"+strings.TrimPrefix(server.URL, "http"))
+		defer conn.Close()
+		welcome := readEnvelope(t, conn)
+		conn.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, ID: "b-1", Payload: secret})
+		assert.Equal(t, pkg.TypeBroadcast, readEnvelope(t, conn)["type"])
+		assert.Equal(t, pkg.TypeAck, readEnvelope(t, conn)["type"])
+		return welcome["payload"].(map[string]any)["id"].(string)
+	}
+
+	t.Run("Test records are structured and carry the member's context", func(t *testing.T) {
+		config := pkg.DefaultConfig()
+		config.LogFormat, config.LogLevel = pkg.LOG_FORMAT_JSON, slog.LevelDebug
+		log := useLogger(t, config)
+		id := broadcast(t, config)
+
+		records := log.records(t, "Received a broadcast")
+		if assert.Len(t, records, 1) {
+			assert.Equal(t, id, records[0]["member_id"])
+			assert.Equal(t, config.DefaultRoom, records[0]["group"])
+			assert.Contains(t, records[0]["remote_addr"], "127.0.0.1:")
+			assert.Equal(t, "DEBUG", records[0]["level"])
+			assert.Equal(t, float64(len(secret)), records[0]["payload_bytes"], "Only the size of the payload should be logged")
+		}
+		assert.NotEmpty(t, log.records(t, "Added a member"))
+		assert.NotContains(t, log.String(), secret, "Payloads should never be logged when they are redacted")
+	})
+
+	t.Run("Test payloads are logged when redaction is turned off", func(t *testing.T) {
+		config := pkg.DefaultConfig()
+		config.LogLevel, config.RedactPayloads = slog.LevelDebug, false
+		log := useLogger(t, config)
+		broadcast(t, config)
+
+		assert.Contains(t, log.String(), `payload="the secret plan"`)
+	})
+
+	t.Run("Test records below the level are left out", func(t *testing.T) {
+		config := pkg.DefaultConfig()
+		config.LogLevel = slog.LevelWarn
+		log := useLogger(t, config)
+		broadcast(t, config)
+		time.Sleep(50 * time.Millisecond)
+
+		assert.NotContains(t, log.String(), "Added a member")
+		assert.NotContains(t, log.String(), "Received a broadcast")
+	})
+
+	t.Run("Test the log settings can be configured", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		os.WriteFile(path, []byte("log_format: json\nlog_level: debug\n"), 0o600)
+		config, err := pkg.LoadConfig([]string{"-config", path, "-redact-payloads=false"}, func(string) string { return "" })
+		assert.NoError(t, err)
+		assert.Equal(t, pkg.LOG_FORMAT_JSON, config.LogFormat)
+		assert.Equal(t, slog.LevelDebug, config.LogLevel)
+		assert.False(t, config.RedactPayloads)
+
+		_, err = pkg.LoadConfig([]string{"-log-format", "xml"}, func(string) string { return "" })
+		assert.ErrorContains(t, err, "log format must be text or json")
+		_, err = pkg.LoadConfig([]string{"-log-level", "loud"}, func(string) string { return "" })
+		assert.Error(t, err)
+	})
+}
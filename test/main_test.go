@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -64,7 +65,7 @@ func TestHandleWebSocket(t *testing.T) {
 	broadCastChatJson3, _ := json.Marshal(broadCastChat3)
 
 	t.Run("Test server can handle multiple connections",  func(t *testing.T) {
-		group := pkg.NewGroup()
+		group := pkg.NewGroup(pkg.DefaultConfig())
 		go group.Create()
 
 		// spin up the new server
@@ -76,7 +77,8 @@ func TestHandleWebSocket(t *testing.T) {
 		webSocketUrl := "ws" + strings.TrimPrefix(server.URL, "http") + "/pingpong"
 
 		done := make(chan bool)
-		connections := make(map[string]*websocket.Conn) 
+		connections := make(map[string]*websocket.Conn)
+		var mu sync.Mutex
 		
 		// create a client group to test our server
 		go func() {
@@ -86,7 +88,9 @@ func TestHandleWebSocket(t *testing.T) {
 
 			_, message, _ := connectionOne.ReadMessage()
 			assert.True(t, strings.HasPrefix(string(welcomeMessage), "Welcome!"), "The first message to a connection should be a welcome message")
+			mu.Lock()
 			connections[string(message)] = connectionOne
+			mu.Unlock()
 			done <- true
 		}()
 
@@ -97,7 +101,9 @@ func TestHandleWebSocket(t *testing.T) {
 			
 			assert.True(t, strings.HasPrefix(string(welcomeMessage), "Welcome!"), "The first message to a connection should be a welcome message")
 			_, message, _ := connectionTwo.ReadMessage()
+			mu.Lock()
 			connections[string(message)] = connectionTwo
+			mu.Unlock()
 			done <- true
 		}()
 
@@ -108,7 +114,9 @@ func TestHandleWebSocket(t *testing.T) {
 			
 			assert.True(t, strings.HasPrefix(string(welcomeMessage), "Welcome!"), "The first message to a connection should be a welcome message")
 			_, message, _ := connectionThree.ReadMessage()
+			mu.Lock()
 			connections[string(message)] = connectionThree
+			mu.Unlock()
 			done <- true
 		}()
 
@@ -116,28 +124,26 @@ func TestHandleWebSocket(t *testing.T) {
 			<- done
 		}
 		
-		assert.Equal(t, len(connections), len(group.Members), "The number of connections should be equal to the number of members of group")
+		assert.Equal(t, len(connections), group.Count(), "The number of connections should be equal to the number of members of group")
 
 		for key := range connections {
 			log.Printf("HELLO %s", key)
-			_, ok := group.Members[key]
-			assert.True(t, ok, "A key that exists in connections must be in group members.")
+			assert.True(t, group.Has(key), "A key that exists in connections must be in group members.")
 		}
 
 		for _, value := range connections {
 			drop(value)
 		}
 
-		// Note: Used this as was getting conncurrent map write exception when directly asserting the length of MAP. 
-		// Can be solved using Mutex on the group.Members
+		// Note: the members are removed by the group loop asynchronously after the connections are dropped.
 		time.Sleep(1 * time.Second)
 
-		assert.Equal(t, 0, len(group.Members), "The member which lose connections should be removed")
+		assert.Equal(t, 0, group.Count(), "The member which lose connections should be removed")
 	})
 
 
 	t.Run("Test server can send broadcasts to other members", func(t *testing.T) {
-		group := pkg.NewGroup()
+		group := pkg.NewGroup(pkg.DefaultConfig())
 		go group.Create()
 
 		// spin up the new server
@@ -150,6 +156,7 @@ func TestHandleWebSocket(t *testing.T) {
 
 		done := make(chan bool)
 		messagesRecieved := make(map[string]map[string]struct{})
+		var mu sync.Mutex
 		
 		// create a client group to test our server
 		go func() {
@@ -159,14 +166,17 @@ func TestHandleWebSocket(t *testing.T) {
 			connectionOne.ReadMessage() // ignore the welcome message
 			connectionOne.WriteMessage(websocket.TextMessage, getMyIdJson)
 			_, myId, _ := connectionOne.ReadMessage()
-			messagesRecieved[string(myId)] = make(map[string]struct{})
+			received := make(map[string]struct{})
 			connectionOne.WriteMessage(websocket.TextMessage, broadCastChatJson1)
 			_, message, _ := connectionOne.ReadMessage()
-			messagesRecieved[string(myId)][string(message)] = struct{}{}
+			received[string(message)] = struct{}{}
 			_, message, _ = connectionOne.ReadMessage()
-			messagesRecieved[string(myId)][string(message)] = struct{}{}
+			received[string(message)] = struct{}{}
 			_, message, _ = connectionOne.ReadMessage()
-			messagesRecieved[string(myId)][string(message)] = struct{}{}
+			received[string(message)] = struct{}{}
+			mu.Lock()
+			messagesRecieved[string(myId)] = received
+			mu.Unlock()
 			done <- true
 		}()
 
@@ -177,14 +187,17 @@ func TestHandleWebSocket(t *testing.T) {
 			connectionTwo.ReadMessage() // ignore the welcome message
 			connectionTwo.WriteMessage(websocket.TextMessage, getMyIdJson)
 			_, myId, _ := connectionTwo.ReadMessage()
-			messagesRecieved[string(myId)] = make(map[string]struct{})
+			received := make(map[string]struct{})
 			connectionTwo.WriteMessage(websocket.TextMessage, broadCastChatJson2)
 			_, message, _ := connectionTwo.ReadMessage()
-			messagesRecieved[string(myId)][string(message)] = struct{}{}
+			received[string(message)] = struct{}{}
 			_, message, _ = connectionTwo.ReadMessage()
-			messagesRecieved[string(myId)][string(message)] = struct{}{}
+			received[string(message)] = struct{}{}
 			_, message, _ = connectionTwo.ReadMessage()
-			messagesRecieved[string(myId)][string(message)] = struct{}{}
+			received[string(message)] = struct{}{}
+			mu.Lock()
+			messagesRecieved[string(myId)] = received
+			mu.Unlock()
 			done <- true
 		}()
 
@@ -195,14 +208,17 @@ func TestHandleWebSocket(t *testing.T) {
 			connectionThree.ReadMessage() // ignore the welcome message
 			connectionThree.WriteMessage(websocket.TextMessage, getMyIdJson)
 			_, myId, _ := connectionThree.ReadMessage()
-			messagesRecieved[string(myId)] = make(map[string]struct{})
+			received := make(map[string]struct{})
 			connectionThree.WriteMessage(websocket.TextMessage, broadCastChatJson3)
 			_, message, _ := connectionThree.ReadMessage()
-			messagesRecieved[string(myId)][string(message)] = struct{}{}
+			received[string(message)] = struct{}{}
 			_, message, _ = connectionThree.ReadMessage()
-			messagesRecieved[string(myId)][string(message)] = struct{}{}
+			received[string(message)] = struct{}{}
 			_, message, _ = connectionThree.ReadMessage()
-			messagesRecieved[string(myId)][string(message)] = struct{}{}
+			received[string(message)] = struct{}{}
+			mu.Lock()
+			messagesRecieved[string(myId)] = received
+			mu.Unlock()
 			done <- true
 		}()
 
@@ -222,7 +238,7 @@ func TestHandleWebSocket(t *testing.T) {
 
 
 	t.Run("Test server can send DMs to other members",  func(t *testing.T) {
-		group := pkg.NewGroup()
+		group := pkg.NewGroup(pkg.DefaultConfig())
 		go group.Create()
 
 		// spin up the new server
@@ -234,7 +250,8 @@ func TestHandleWebSocket(t *testing.T) {
 		webSocketUrl := "ws" + strings.TrimPrefix(server.URL, "http") + "/pingpong"
 
 		done := make(chan bool)
-		connections := make(map[string]*websocket.Conn) 
+		connections := make(map[string]*websocket.Conn)
+		var mu sync.Mutex
 		
 		// create a client group to test our server
 		go func() {
@@ -244,7 +261,9 @@ func TestHandleWebSocket(t *testing.T) {
 
 			_, message, _ := connectionOne.ReadMessage()
 			assert.True(t, strings.HasPrefix(string(welcomeMessage), "Welcome!"), "The first message to a connection should be a welcome message")
+			mu.Lock()
 			connections[string(message)] = connectionOne
+			mu.Unlock()
 			done <- true
 		}()
 
@@ -255,7 +274,9 @@ func TestHandleWebSocket(t *testing.T) {
 			
 			assert.True(t, strings.HasPrefix(string(welcomeMessage), "Welcome!"), "The first message to a connection should be a welcome message")
 			_, message, _ := connectionTwo.ReadMessage()
+			mu.Lock()
 			connections[string(message)] = connectionTwo
+			mu.Unlock()
 			done <- true
 		}()
 
@@ -266,7 +287,9 @@ func TestHandleWebSocket(t *testing.T) {
 			
 			assert.True(t, strings.HasPrefix(string(welcomeMessage), "Welcome!"), "The first message to a connection should be a welcome message")
 			_, message, _ := connectionThree.ReadMessage()
+			mu.Lock()
 			connections[string(message)] = connectionThree
+			mu.Unlock()
 			done <- true
 		}()
 
@@ -274,12 +297,11 @@ func TestHandleWebSocket(t *testing.T) {
 			<- done
 		}
 		
-		assert.Equal(t, len(connections), len(group.Members), "The number of connections should be equal to the number of members of group")
+		assert.Equal(t, len(connections), group.Count(), "The number of connections should be equal to the number of members of group")
 
 		for key := range connections {
 			log.Printf("HELLO %s", key)
-			_, ok := group.Members[key]
-			assert.True(t, ok, "A key that exists in connections must be in group members.")
+			assert.True(t, group.Has(key), "A key that exists in connections must be in group members.")
 		}
 
 		keys := make([]string, 0, len(connections))
@@ -305,11 +327,65 @@ func TestHandleWebSocket(t *testing.T) {
 			drop(value)
 		}
 
-		// Note: Used this as was getting conncurrent map write exception when directly asserting the length of MAP. 
-		// Can be solved using Mutex on the group.Members
+		// Note: the members are removed by the group loop asynchronously after the connections are dropped.
 		time.Sleep(1 * time.Second)
 
-		assert.Equal(t, 0, len(group.Members), "The member which lose connections should be removed")
+		assert.Equal(t, 0, group.Count(), "The member which lose connections should be removed")
 	})
 }
 
+
+func TestGroupMembership(t *testing.T) {
+	group := pkg.NewGroup(pkg.DefaultConfig())
+	go group.Create()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pingpong", func(w http.ResponseWriter, r *http.Request) {
+		pkg.ServerPingPong(group, w, r)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	webSocketUrl := "ws" + strings.TrimPrefix(server.URL, "http") + "/pingpong"
+
+	// keep reading the membership while members join so that the race detector can catch unsynchronized access
+	stop := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				for _, id := range group.Snapshot() {
+					group.Has(id)
+				}
+				group.Count()
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	connections := make([]*websocket.Conn, 5)
+	for i := range connections {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			connections[i] = getWebSocketConnection(t, webSocketUrl)
+			connections[i].ReadMessage() // wait for the welcome message
+		}(i)
+	}
+	wg.Wait()
+	stop <- true
+
+	ids := group.Snapshot()
+	assert.Equal(t, 5, group.Count(), "All the connections should be members of the group")
+	assert.Equal(t, 5, len(ids), "The snapshot should contain all the members")
+	assert.IsNonDecreasing(t, ids, "The snapshot should be sorted")
+	for _, id := range ids {
+		assert.True(t, group.Has(id), "Every member in the snapshot should be part of the group")
+	}
+	assert.False(t, group.Has("not-a-member"))
+
+	for _, connection := range connections {
+		connection.Close()
+	}
+}
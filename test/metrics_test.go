@@ -0,0 +1,163 @@
+package test
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"websocket-server.com/pkg"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// scrape reads /metrics like a Prometheus server would and returns the samples by series, e.g.
+// websocket_closes_total{code="1000",initiator="client"}. Samples of series that don't exist yet are zero.
+func scrape(t *testing.T) map[string]float64 {
+	server := httptest.NewServer(http.HandlerFunc(pkg.ServeMetrics))
+	defer server.Close()
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("could not scrape the metrics %v", err)
+	}
+	defer response.Body.Close()
+	assert.True(t, strings.HasPrefix(response.Header.Get("Content-Type"), "text/plain; version=0.0.4"))
+
+	samples := make(map[string]float64)
+	typed := make(map[string]bool)
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if fields := strings.Fields(line); len(fields) == 4 && fields[1] == "TYPE" {
+			typed[fields[2]] = true
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		series, sample, ok := strings.Cut(line, " ")
+		value, err := strconv.ParseFloat(sample, 64)
+		if !ok || err != nil {
+			t.Fatalf("could not parse the sample %q", line)
+		}
+		name, _, _ := strings.Cut(series, "{")
+		if !typed[name] && !typed[strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(name, "_bucket"), "_sum"), "_count")] {
+			t.Fatalf("the sample %q comes without a TYPE line", line)
+		}
+		samples[series] = value
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+
+	config := pkg.DefaultConfig()
+	config.PingInterval = 50 * time.Millisecond
+	rooms := pkg.NewRooms(config)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pkg.ServerRoom(rooms, w, r)
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "?room=metrics"
+
+	t.Run("Test members, messages and fan-out are counted", func(t *testing.T) {
+		// the members of the rooms are counted together, and those of the tests before may still be leaving
+		var before map[string]float64
+		assert.Eventually(t, func() bool {
+			before = scrape(t)
+			time.Sleep(20 * time.Millisecond)
+			return scrape(t)[`websocket_members`] == before[`websocket_members`]
+		}, 2*time.Second, time.Millisecond)
+		first := getV1WebSocketConnection(t, url)
+		defer first.Close()
+		readEnvelope(t, first) // ignore the welcome message
+		second := getV1WebSocketConnection(t, url)
+		defer second.Close()
+		readEnvelope(t, second) // ignore the welcome message
+
+		first.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, ID: "b-1", Payload: "hello"})
+		assert.Equal(t, pkg.TypeBroadcast, readEnvelope(t, second)["type"])
+		assert.Equal(t, pkg.TypeBroadcast, readEnvelope(t, first)["type"])
+		assert.Equal(t, pkg.TypeAck, readEnvelope(t, first)["type"])
+		first.WriteJSON(pkg.Envelope{V: 1, Type: "made-up"})
+		assert.Equal(t, pkg.TypeError, readEnvelope(t, first)["type"])
+
+		after := scrape(t)
+		assert.Equal(t, 2.0, after[`websocket_members`]-before[`websocket_members`])
+		assert.NotContains(t, after, `websocket_members{room="metrics"}`, "The names of the rooms should not be published")
+		assert.Equal(t, 2.0, after[`websocket_upgrades_total{result="accepted"}`]-before[`websocket_upgrades_total{result="accepted"}`])
+		assert.Equal(t, 1.0, after[`websocket_messages_in_total{type="broadcast"}`]-before[`websocket_messages_in_total{type="broadcast"}`])
+		assert.Equal(t, 1.0, after[`websocket_messages_in_total{type="unsupported"}`]-before[`websocket_messages_in_total{type="unsupported"}`], "Unknown types should not get a series of their own")
+		assert.NotContains(t, after, `websocket_messages_in_total{type="made-up"}`)
+		assert.Equal(t, 2.0, after[`websocket_messages_out_total{type="broadcast"}`]-before[`websocket_messages_out_total{type="broadcast"}`])
+		assert.Equal(t, 2.0, after[`websocket_messages_out_total{type="welcome"}`]-before[`websocket_messages_out_total{type="welcome"}`])
+		assert.Greater(t, after[`websocket_bytes_in_total`], before[`websocket_bytes_in_total`])
+		assert.Greater(t, after[`websocket_bytes_out_total`], before[`websocket_bytes_out_total`])
+		assert.Equal(t, 1.0, after[`websocket_broadcast_fanout_seconds_count`]-before[`websocket_broadcast_fanout_seconds_count`])
+		assert.Equal(t, after[`websocket_broadcast_fanout_seconds_count`], after[`websocket_broadcast_fanout_seconds_bucket{le="+Inf"}`])
+		assert.Greater(t, after[`websocket_send_queue_depth_count`], before[`websocket_send_queue_depth_count`])
+	})
+
+	t.Run("Test ping round trips are measured", func(t *testing.T) {
+		before := scrape(t)
+		conn := getV1WebSocketConnection(t, url)
+		defer conn.Close()
+		// the pings are only answered while reading
+		go func() {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		time.Sleep(5 * config.PingInterval)
+
+		after := scrape(t)
+		assert.Greater(t, after[`websocket_ping_rtt_seconds_count`], before[`websocket_ping_rtt_seconds_count`])
+		assert.Less(t, after[`websocket_ping_rtt_seconds_sum`]-before[`websocket_ping_rtt_seconds_sum`], 1.0)
+	})
+
+	t.Run("Test close codes are counted by initiator", func(t *testing.T) {
+		before := scrape(t)
+		conn := getV1WebSocketConnection(t, url)
+		readEnvelope(t, conn) // ignore the welcome message
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "bye"))
+		conn.ReadMessage()
+		conn.Close()
+
+		large := getV1WebSocketConnection(t, url)
+		defer large.Close()
+		large.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", int(config.MaxFrameSize)+1)))
+		large.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			if _, _, err := large.ReadMessage(); err != nil {
+				break
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+
+		after := scrape(t)
+		assert.Equal(t, 1.0, after[`websocket_closes_total{code="1001",initiator="client"}`]-before[`websocket_closes_total{code="1001",initiator="client"}`])
+		assert.Equal(t, 1.0, after[`websocket_closes_total{code="1009",initiator="server"}`]-before[`websocket_closes_total{code="1009",initiator="server"}`])
+	})
+
+	t.Run("Test refused upgrades are counted and stopped rooms are dropped", func(t *testing.T) {
+		before := scrape(t)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.NoError(t, rooms.Stop(ctx))
+
+		_, response, err := websocket.DefaultDialer.Dial(url, nil)
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode)
+
+		after := scrape(t)
+		assert.Equal(t, 1.0, after[`websocket_upgrades_total{result="unavailable"}`]-before[`websocket_upgrades_total{result="unavailable"}`])
+		assert.LessOrEqual(t, after[`websocket_members`], before[`websocket_members`], "The members of a stopped room should not be counted anymore")
+	})
+}
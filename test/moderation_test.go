@@ -0,0 +1,136 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"websocket-server.com/pkg"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModeration(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "keys.yaml")
+	os.WriteFile(path, []byte(strings.Join([]string{
+		"key-of-admin: {subject: admin, roles: [admin]}",
+		"key-of-reader: {subject: reader, roles: [read-only]}",
+		"key-of-alice: alice",
+		"key-of-bob: bob",
+	}, "\n")), 0o600)
+	authenticator, err := pkg.LoadAPIKeyAuthenticator(path)
+	assert.NoError(t, err)
+
+	rooms := pkg.NewRooms(pkg.DefaultConfig())
+	rooms.Authenticator = authenticator
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pkg.ServerRoom(rooms, w, r)
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	dial := func(key string) (*websocket.Conn, *http.Response, error) {
+		dialer := websocket.Dialer{Subprotocols: []string{pkg.SUBPROTOCOL_V1}}
+		return dialer.Dial(url, http.Header{"X-API-Key": {key}})
+	}
+	connect := func(t *testing.T, key string) *websocket.Conn {
+		conn, _, err := dial(key)
+		if err != nil {
+			t.Fatalf("could not connect with %s %v", key, err)
+		}
+		readEnvelope(t, conn) // ignore the welcome message
+		return conn
+	}
+	expectNack := func(t *testing.T, conn *websocket.Conn, id string, code string) {
+		nack := readEnvelope(t, conn)
+		assert.Equal(t, pkg.TypeNack, nack["type"])
+		assert.Equal(t, id, nack["id"])
+		assert.Equal(t, code, nack["code"])
+	}
+	expectClose := func(t *testing.T, conn *websocket.Conn, code int) {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, _, err := conn.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, code), "The connection should be closed with %d but got %v", code, err)
+	}
+
+	admin := connect(t, "key-of-admin")
+	defer admin.Close()
+
+	t.Run("Test read-only members can't send messages", func(t *testing.T) {
+		reader := connect(t, "key-of-reader")
+		defer reader.Close()
+
+		reader.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, ID: "r-1", Payload: "hello"})
+		expectNack(t, reader, "r-1", pkg.CodeForbidden)
+		reader.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeDM, ID: "r-2", To: "admin", Payload: "hello"})
+		expectNack(t, reader, "r-2", pkg.CodeForbidden)
+		reader.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeKick, ID: "r-3", To: "admin"})
+		expectNack(t, reader, "r-3", pkg.CodeForbidden)
+	})
+
+	t.Run("Test muted members can't send messages until they are unmuted", func(t *testing.T) {
+		alice := connect(t, "key-of-alice")
+		defer alice.Close()
+
+		admin.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeMute, ID: "a-1", To: "alice", Payload: "calm down"})
+		assert.Equal(t, pkg.TypeAck, readEnvelope(t, admin)["type"])
+		mute := readEnvelope(t, alice)
+		assert.Equal(t, pkg.TypeMute, mute["type"])
+		assert.Equal(t, "calm down", mute["payload"])
+		assert.True(t, rooms.Get(pkg.DefaultConfig().DefaultRoom).Muted("alice"))
+
+		alice.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, ID: "m-1", Payload: "let me talk"})
+		expectNack(t, alice, "m-1", pkg.CodeMuted)
+
+		admin.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeUnmute, ID: "a-2", To: "alice"})
+		assert.Equal(t, pkg.TypeAck, readEnvelope(t, admin)["type"])
+		assert.Equal(t, pkg.TypeUnmute, readEnvelope(t, alice)["type"])
+
+		alice.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, ID: "m-2", Payload: "thanks"})
+		assert.Equal(t, pkg.TypeBroadcast, readEnvelope(t, alice)["type"])
+		assert.Equal(t, pkg.TypeAck, readEnvelope(t, alice)["type"])
+		assert.Equal(t, pkg.TypeBroadcast, readEnvelope(t, admin)["type"])
+	})
+
+	t.Run("Test kicked members are disconnected", func(t *testing.T) {
+		bob := connect(t, "key-of-bob")
+		defer bob.Close()
+
+		admin.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeKick, ID: "a-3", To: "bob", Payload: "spam"})
+		assert.Equal(t, pkg.TypeAck, readEnvelope(t, admin)["type"])
+		kick := readEnvelope(t, bob)
+		assert.Equal(t, pkg.TypeKick, kick["type"])
+		assert.Equal(t, "admin", kick["from"])
+		expectClose(t, bob, websocket.ClosePolicyViolation)
+
+		admin.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeKick, ID: "a-4", To: "bob"})
+		expectNack(t, admin, "a-4", pkg.CodeUnknownRecipient)
+	})
+
+	t.Run("Test banned members can't come back until they are unbanned", func(t *testing.T) {
+		bob := connect(t, "key-of-bob")
+		defer bob.Close()
+
+		admin.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeBan, ID: "a-5", To: "bob"})
+		assert.Equal(t, pkg.TypeAck, readEnvelope(t, admin)["type"])
+		assert.Equal(t, pkg.TypeBan, readEnvelope(t, bob)["type"])
+		expectClose(t, bob, websocket.ClosePolicyViolation)
+		time.Sleep(100 * time.Millisecond)
+
+		_, response, err := dial("key-of-bob")
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusForbidden, response.StatusCode)
+
+		admin.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeUnban, ID: "a-6", To: "bob"})
+		assert.Equal(t, pkg.TypeAck, readEnvelope(t, admin)["type"])
+
+		bob = connect(t, "key-of-bob")
+		bob.Close()
+	})
+}
@@ -0,0 +1,237 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"websocket-server.com/pkg"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOfflineQueue(t *testing.T) {
+
+	newConfig := func() *pkg.Config {
+		config := pkg.DefaultConfig()
+		config.AuthMode = pkg.AUTH_MODE_API_KEY
+		config.OfflineQueueSize = 2
+		return config
+	}
+	dm := func(to string, payload string) pkg.Envelope {
+		return pkg.Envelope{V: 1, Type: pkg.TypeDM, From: "alice", To: to, Payload: payload}
+	}
+	payloads := func(messages []pkg.Envelope) []any {
+		var payloads []any
+		for _, message := range messages {
+			payloads = append(payloads, message.Payload)
+		}
+		return payloads
+	}
+
+	t.Run("Test there is no offline queue without stable member IDs", func(t *testing.T) {
+		config := newConfig()
+		config.AuthMode = pkg.AUTH_MODE_NONE
+		queue, err := pkg.NewOfflineQueue(config)
+		assert.NoError(t, err)
+		assert.Nil(t, queue)
+	})
+
+	t.Run("Test DMs are only kept for members that were seen", func(t *testing.T) {
+		queue, _ := pkg.NewOfflineQueue(newConfig())
+		assert.ErrorIs(t, queue.Push(dm("nobody", "hello?")), pkg.ErrUnknownRecipient)
+		queue.Seen("bob")
+		assert.NoError(t, queue.Push(dm("bob", "hello")))
+	})
+
+	t.Run("Test the DMs of a member are taken in order and only once", func(t *testing.T) {
+		queue, _ := pkg.NewOfflineQueue(newConfig())
+		queue.Seen("bob")
+		queue.Seen("carol")
+		assert.NoError(t, queue.Push(dm("bob", "first")))
+		assert.NoError(t, queue.Push(dm("carol", "other")))
+		assert.NoError(t, queue.Push(dm("bob", "second")))
+		assert.ErrorIs(t, queue.Push(dm("bob", "third")), pkg.ErrOfflineQueueFull)
+
+		assert.Equal(t, []any{"first", "second"}, payloads(queue.Take("bob")))
+		assert.Empty(t, queue.Take("bob"))
+		assert.Equal(t, []any{"other"}, payloads(queue.Take("carol")))
+	})
+
+	t.Run("Test DMs expire after the TTL", func(t *testing.T) {
+		config := newConfig()
+		config.OfflineTTL = 50 * time.Millisecond
+		queue, _ := pkg.NewOfflineQueue(config)
+		queue.Seen("bob")
+		queue.Push(dm("bob", "old"))
+		queue.Push(dm("bob", "older"))
+		time.Sleep(100 * time.Millisecond)
+		assert.NoError(t, queue.Push(dm("bob", "new")), "Expired DMs should not count towards the cap")
+		assert.Equal(t, []any{"new"}, payloads(queue.Take("bob")))
+	})
+
+	t.Run("Test there are caps on the members and DMs waiting altogether", func(t *testing.T) {
+		config := newConfig()
+		config.OfflineRecipients, config.OfflineMessages = 2, 3
+		queue, _ := pkg.NewOfflineQueue(config)
+		for _, id := range []string{"bob", "carol", "dave"} {
+			queue.Seen(id)
+		}
+		assert.NoError(t, queue.Push(dm("bob", "one")))
+		assert.NoError(t, queue.Push(dm("carol", "two")))
+		assert.ErrorIs(t, queue.Push(dm("dave", "three")), pkg.ErrOfflineQueuesFull, "Too many members should have DMs waiting")
+		assert.NoError(t, queue.Push(dm("bob", "three")))
+		assert.ErrorIs(t, queue.Push(dm("carol", "four")), pkg.ErrOfflineQueuesFull, "Too many DMs should be waiting")
+
+		queue.Take("bob")
+		assert.NoError(t, queue.Push(dm("dave", "four")), "Taken DMs should make room again")
+	})
+
+	t.Run("Test expired DMs are only given back once when the queues are full", func(t *testing.T) {
+		config := newConfig()
+		config.OfflineQueueSize, config.OfflineTTL = 3, 600*time.Millisecond
+		config.OfflineFile = filepath.Join(t.TempDir(), "offline.log")
+		queue, _ := pkg.NewOfflineQueue(config)
+		queue.Seen("bob")
+		queue.Seen("carol")
+		queue.Push(dm("bob", "expires"))
+		time.Sleep(300 * time.Millisecond)
+		queue.Push(dm("bob", "waits"))
+		queue.Push(dm("carol", "waits"))
+		queue.Close()
+
+		// a lower cap after a restart leaves more DMs waiting than it allows
+		config.OfflineMessages = 2
+		queue, err := pkg.NewOfflineQueue(config)
+		assert.NoError(t, err)
+		defer queue.Close()
+		time.Sleep(400 * time.Millisecond)
+		for range 3 {
+			assert.ErrorIs(t, queue.Push(dm("bob", "refused")), pkg.ErrOfflineQueuesFull, "Retries should not count the expired DM again")
+		}
+		assert.ErrorIs(t, queue.Push(dm("carol", "refused")), pkg.ErrOfflineQueuesFull)
+
+		assert.Equal(t, []any{"waits"}, payloads(queue.Take("carol")))
+		assert.NoError(t, queue.Push(dm("bob", "fits")))
+		assert.ErrorIs(t, queue.Push(dm("bob", "refused")), pkg.ErrOfflineQueuesFull)
+		assert.Equal(t, []any{"waits", "fits"}, payloads(queue.Take("bob")))
+	})
+
+	t.Run("Test the offline file keeps the waiting DMs across restarts", func(t *testing.T) {
+		config := newConfig()
+		config.OfflineFile = filepath.Join(t.TempDir(), "offline.log")
+		queue, err := pkg.NewOfflineQueue(config)
+		assert.NoError(t, err)
+		queue.Seen("bob")
+		queue.Seen("carol")
+		queue.Push(dm("bob", "for bob"))
+		queue.Push(dm("carol", "for carol"))
+		queue.Take("carol")
+		assert.NoError(t, queue.Close())
+
+		// a crash in the middle of a write leaves half a line behind
+		file, _ := os.OpenFile(config.OfflineFile, os.O_APPEND|os.O_WRONLY, 0o600)
+		file.WriteString(`{"to": "bob", "queued": {"mess`)
+		file.Close()
+
+		queue, err = pkg.NewOfflineQueue(config)
+		assert.NoError(t, err)
+		assert.Empty(t, queue.Take("carol"), "Taken DMs should not come back")
+		assert.NoError(t, queue.Close())
+
+		queue, err = pkg.NewOfflineQueue(config)
+		assert.NoError(t, err)
+		defer queue.Close()
+		assert.Equal(t, []any{"for bob"}, payloads(queue.Take("bob")))
+		assert.NoError(t, queue.Push(dm("carol", "again")), "The members seen should be kept as well")
+	})
+}
+
+func TestOfflineDelivery(t *testing.T) {
+
+	config := pkg.DefaultConfig()
+	config.AuthMode = pkg.AUTH_MODE_API_KEY
+	config.OfflineQueueSize = 2
+	rooms := pkg.NewRooms(config)
+	rooms.Authenticator = pkg.NewAPIKeyAuthenticator(map[string]string{"key-of-alice": "alice", "key-of-bob": "bob"})
+	rooms.Offline, _ = pkg.NewOfflineQueue(config)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pkg.ServerRoom(rooms, w, r)
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	dial := func(t *testing.T, key string) *websocket.Conn {
+		dialer := websocket.Dialer{Subprotocols: []string{pkg.SUBPROTOCOL_V1}}
+		conn, _, err := dialer.Dial(url, http.Header{"X-API-Key": {key}})
+		if err != nil {
+			t.Fatalf("could not open a ws connection on %s %v", url, err)
+		}
+		return conn
+	}
+
+	alice := dial(t, "key-of-alice")
+	defer alice.Close()
+	readEnvelope(t, alice) // ignore the welcome message
+
+	t.Run("Test DMs to members that never connected are refused", func(t *testing.T) {
+		alice.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeDM, ID: "dm-0", To: "bob", Payload: "who are you?"})
+		nack := readEnvelope(t, alice)
+		assert.Equal(t, pkg.TypeNack, nack["type"])
+		assert.Equal(t, pkg.CodeUnknownRecipient, nack["code"])
+
+		bob := dial(t, "key-of-bob")
+		readEnvelope(t, bob) // ignore the welcome message
+		bob.Close()
+		assert.Eventually(t, func() bool { return rooms.Connections() == 1 }, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Test DMs to a member that is not connected are acked and delivered after its welcome", func(t *testing.T) {
+		alice.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeDM, ID: "dm-1", To: "bob", Payload: "first"})
+		assert.Equal(t, pkg.TypeAck, readEnvelope(t, alice)["type"])
+		alice.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeDM, ID: "dm-2", To: "bob", Payload: "second"})
+		assert.Equal(t, pkg.TypeAck, readEnvelope(t, alice)["type"])
+		alice.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeDM, ID: "dm-3", To: "bob", Payload: "third"})
+		nack := readEnvelope(t, alice)
+		assert.Equal(t, pkg.TypeNack, nack["type"], "The queue of bob should be full")
+		assert.Equal(t, pkg.CodeUndeliverable, nack["code"])
+
+		bob := dial(t, "key-of-bob")
+		defer bob.Close()
+		assert.Equal(t, pkg.TypeWelcome, readEnvelope(t, bob)["type"])
+		first := readEnvelope(t, bob)
+		assert.Equal(t, pkg.TypeDM, first["type"])
+		assert.Equal(t, "alice", first["from"])
+		assert.Equal(t, "first", first["payload"])
+		assert.Equal(t, "second", readEnvelope(t, bob)["payload"])
+
+		// anything after the waiting DMs comes live
+		alice.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeDM, To: "bob", Payload: "live"})
+		assert.Equal(t, "live", readEnvelope(t, bob)["payload"])
+	})
+
+	t.Run("Test the DMs are not delivered a second time on the next connection", func(t *testing.T) {
+		assert.Eventually(t, func() bool { return rooms.Connections() == 1 }, time.Second, 10*time.Millisecond)
+
+		bob := dial(t, "key-of-bob")
+		defer bob.Close()
+		readEnvelope(t, bob) // ignore the welcome message
+		alice.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, Payload: "hello"})
+		assert.Equal(t, "hello", readEnvelope(t, bob)["payload"])
+		readEnvelope(t, alice) // ignore our own broadcast
+	})
+
+	t.Run("Test read receipts are not kept for members that are not connected", func(t *testing.T) {
+		assert.Eventually(t, func() bool { return rooms.Connections() == 1 }, time.Second, 10*time.Millisecond)
+
+		alice.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeRead, ID: "read-1", To: "bob", Seq: 1})
+		nack := readEnvelope(t, alice)
+		assert.Equal(t, pkg.TypeNack, nack["type"])
+		assert.Equal(t, pkg.CodeUnknownRecipient, nack["code"])
+	})
+}
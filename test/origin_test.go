@@ -0,0 +1,119 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"websocket-server.com/pkg"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func rejections(kind string) int64 {
+	return int64(pkg.OriginRejections.Value(kind))
+}
+
+func TestOrigins(t *testing.T) {
+
+	newServer := func(config *pkg.Config) string {
+		rooms := pkg.NewRooms(config)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pkg.ServerRoom(rooms, w, r)
+		}))
+		t.Cleanup(server.Close)
+		return "ws" + strings.TrimPrefix(server.URL, "http")
+	}
+	dial := func(url string, origin string) (*http.Response, error) {
+		conn, response, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {origin}})
+		if err == nil {
+			conn.Close()
+		}
+		return response, err
+	}
+
+	t.Run("Test only the same origin is allowed by default", func(t *testing.T) {
+		url := newServer(pkg.DefaultConfig())
+		before := rejections("upgrade")
+
+		_, err := dial(url, "http"+strings.TrimPrefix(url, "ws"))
+		assert.NoError(t, err, "The same origin should be allowed")
+
+		response, err := dial(url, "https://evil.example")
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusForbidden, response.StatusCode)
+		assert.Equal(t, before+1, rejections("upgrade"), "The rejection should be counted")
+	})
+
+	t.Run("Test the allowlist matches wildcard subdomains", func(t *testing.T) {
+		config := pkg.DefaultConfig()
+		config.AllowedOrigins = pkg.StringList{"https://*.example.com", "http://localhost:3000"}
+		url := newServer(config)
+
+		for origin, allowed := range map[string]bool{
+			"https://app.example.com":     true,
+			"https://a.b.example.com":     true,
+			"https://example.com":         false,
+			"http://app.example.com":      false,
+			"https://app.example.com:444": false,
+			"https://evilexample.com":     false,
+			"http://localhost:3000":       true,
+			"http://localhost:3001":       false,
+		} {
+			_, err := dial(url, origin)
+			if allowed {
+				assert.NoError(t, err, "%s should be allowed", origin)
+			} else {
+				assert.Error(t, err, "%s should be refused", origin)
+			}
+		}
+	})
+
+	t.Run("Test invalid origins are rejected by the config", func(t *testing.T) {
+		_, err := pkg.LoadConfig([]string{"-allowed-origins", "https://app.*.com", "-cors-origins", "ftp://files.example.com"}, func(string) string { return "" })
+		assert.ErrorContains(t, err, "invalid allowed origin")
+		assert.ErrorContains(t, err, "invalid CORS origin")
+	})
+}
+
+func TestCORS(t *testing.T) {
+	config := pkg.DefaultConfig()
+	config.CORSOrigins = pkg.StringList{"https://*.example.com"}
+	handler := pkg.CORS(config, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	request := func(method string, origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/getMemberIds", nil)
+		r.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			r.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	t.Run("Test allowed origins get the CORS headers", func(t *testing.T) {
+		w := request(http.MethodGet, "https://admin.example.com")
+		assert.Equal(t, "https://admin.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "ok", w.Body.String())
+
+		w = request(http.MethodOptions, "https://admin.example.com")
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Contains(t, w.Header().Get("Access-Control-Allow-Headers"), "Authorization")
+	})
+
+	t.Run("Test other origins don't get the CORS headers", func(t *testing.T) {
+		before := rejections("cors")
+
+		w := request(http.MethodGet, "https://evil.example")
+		assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+		w = request(http.MethodOptions, "https://evil.example")
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Equal(t, before+2, rejections("cors"), "Both rejections should be counted")
+	})
+}
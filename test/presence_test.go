@@ -0,0 +1,157 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"websocket-server.com/pkg"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// cutBus is a bus that stops publishing once it is cut, the way a node that crashed goes silent.
+type cutBus struct {
+	pkg.Bus
+	cut atomic.Bool
+}
+
+func (bus *cutBus) Publish(topic string, message []byte) error {
+	if bus.cut.Load() {
+		return nil
+	}
+	return bus.Bus.Publish(topic, message)
+}
+
+func presenceConfig() *pkg.Config {
+	config := pkg.DefaultConfig()
+	config.PresenceHeartbeat = 20 * time.Millisecond
+	config.PresenceLease = 100 * time.Millisecond
+	return config
+}
+
+func TestPresence(t *testing.T) {
+
+	start := func(t *testing.T, node string, bus pkg.Bus, config *pkg.Config) *pkg.Presence {
+		presence, err := pkg.StartPresence(node, bus, config)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		t.Cleanup(presence.Stop)
+		return presence
+	}
+	locate := func(presence *pkg.Presence, id string) string {
+		node, _ := presence.Locate(id)
+		return node
+	}
+
+	t.Run("Test members are located on the node they are connected to", func(t *testing.T) {
+		bus := pkg.NewMemoryBus()
+		a := start(t, "a", bus, presenceConfig())
+		b := start(t, "b", bus, presenceConfig())
+
+		a.Online("alice")
+		assert.Equal(t, "a", locate(a, "alice"))
+		assert.Eventually(t, func() bool { return locate(b, "alice") == "a" }, time.Second, 10*time.Millisecond)
+		assert.Equal(t, []string{"a", "b"}, b.Nodes())
+
+		a.Offline("alice")
+		assert.Eventually(t, func() bool { return locate(b, "alice") == "" }, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Test the members of a node that stops heartbeating expire", func(t *testing.T) {
+		bus := pkg.NewMemoryBus()
+		a := start(t, "a", bus, presenceConfig())
+		crashing := &cutBus{Bus: bus}
+		c := start(t, "c", crashing, presenceConfig())
+
+		c.Online("carol")
+		assert.Eventually(t, func() bool { return locate(a, "carol") == "c" }, time.Second, 10*time.Millisecond)
+		crashing.cut.Store(true)
+		assert.Eventually(t, func() bool { return locate(a, "carol") == "" }, time.Second, 10*time.Millisecond)
+		assert.False(t, a.Alive("c"))
+		assert.Equal(t, []string{"a"}, a.Nodes())
+
+		crashing.cut.Store(false)
+		assert.Eventually(t, func() bool { return locate(a, "carol") == "c" }, time.Second, 10*time.Millisecond, "The node should be back with its next heartbeat")
+	})
+
+	t.Run("Test a node that stops is forgotten before its lease runs out", func(t *testing.T) {
+		bus := pkg.NewMemoryBus()
+		config := presenceConfig()
+		config.PresenceLease = time.Minute
+		a := start(t, "a", bus, config)
+		b := start(t, "b", bus, config)
+
+		b.Online("bob")
+		assert.Eventually(t, func() bool { return locate(a, "bob") == "b" }, time.Second, 10*time.Millisecond)
+		b.Stop()
+		assert.Eventually(t, func() bool { return !a.Alive("b") }, time.Second, 10*time.Millisecond)
+		assert.Equal(t, "", locate(a, "bob"))
+	})
+}
+
+func TestPresenceRouting(t *testing.T) {
+
+	node := func(t *testing.T, id string, bus pkg.Bus, number int) (*pkg.Rooms, string) {
+		config := presenceConfig()
+		config.NodeID, config.NodeNumber = id, number
+		rooms := pkg.NewRooms(config)
+		rooms.Bus = bus
+		presence, err := pkg.StartPresence(rooms.Node, bus, config)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		t.Cleanup(presence.Stop)
+		rooms.Presence = presence
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pkg.ServerRoom(rooms, w, r)
+		}))
+		t.Cleanup(server.Close)
+		return rooms, "ws" + strings.TrimPrefix(server.URL, "http")
+	}
+	roster := func(rooms *pkg.Rooms) []string {
+		group, ok := rooms.Lookup(pkg.DefaultConfig().DefaultRoom)
+		if !ok {
+			return nil
+		}
+		return group.Roster()
+	}
+
+	t.Run("Test DMs go to the node of the recipient until that node is gone", func(t *testing.T) {
+		bus := pkg.NewMemoryBus()
+		crashing := &cutBus{Bus: bus}
+		roomsA, urlA := node(t, "a", bus, 1)
+		roomsB, urlB := node(t, "b", crashing, 2)
+
+		bob := getV1WebSocketConnection(t, urlA)
+		defer bob.Close()
+		bobID := readEnvelope(t, bob)["payload"].(map[string]any)["id"].(string)
+		alice := getV1WebSocketConnection(t, urlB)
+		defer alice.Close()
+		aliceID := readEnvelope(t, alice)["payload"].(map[string]any)["id"].(string)
+		assert.Eventually(t, func() bool {
+			node, _ := roomsA.Presence.Locate(aliceID)
+			return node == "b" && len(roster(roomsA)) == 2
+		}, time.Second, 10*time.Millisecond, "Node a should know that alice is on node b")
+
+		bob.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeDM, ID: "dm-1", To: aliceID, Payload: "hi alice"})
+		assert.Equal(t, pkg.TypeAck, readEnvelope(t, bob)["type"])
+		dm := readEnvelope(t, alice)
+		assert.Equal(t, bobID, dm["from"])
+		assert.Equal(t, "hi alice", dm["payload"])
+
+		crashing.cut.Store(true)
+		assert.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual([]string{bobID}, roster(roomsA))
+		}, time.Second, 10*time.Millisecond, "The members of a node that is gone should leave the room")
+		assert.Len(t, roster(roomsB), 2, "Node b doesn't know that it is cut off")
+		bob.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeDM, ID: "dm-2", To: aliceID, Payload: "still there?"})
+		nack := readEnvelope(t, bob)
+		assert.Equal(t, pkg.TypeNack, nack["type"])
+		assert.Equal(t, pkg.CodeUnknownRecipient, nack["code"])
+	})
+}
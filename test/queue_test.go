@@ -0,0 +1,47 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+
+	"websocket-server.com/pkg"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendQueue(t *testing.T) {
+
+	t.Run("Test drop newest keeps the queue and rejects new messages", func(t *testing.T) {
+		member := pkg.NewMember("slow", nil, pkg.DefaultConfig())
+		member.Overflow = pkg.OverflowDropNewest
+
+		for i := 0; i < pkg.DefaultConfig().SendQueueSize; i++ {
+			assert.True(t, member.Send([]byte(fmt.Sprint(i))), "Messages within the queue size should be queued")
+		}
+		assert.False(t, member.Send([]byte("overflow")), "A message sent to a full queue should be dropped")
+		assert.Equal(t, int64(1), member.Dropped())
+	})
+
+	t.Run("Test drop oldest always queues the new message", func(t *testing.T) {
+		member := pkg.NewMember("slow", nil, pkg.DefaultConfig())
+		member.Overflow = pkg.OverflowDropOldest
+		overflows := pkg.QueueOverflows.Value("drop-oldest")
+
+		for i := 0; i < pkg.DefaultConfig().SendQueueSize+10; i++ {
+			assert.True(t, member.Send([]byte(fmt.Sprint(i))), "Messages should always be queued when dropping the oldest")
+		}
+		assert.Equal(t, int64(10), member.Dropped())
+		assert.Equal(t, overflows+10, pkg.QueueOverflows.Value("drop-oldest"), "Every overflow should be counted by policy")
+	})
+
+	t.Run("Test disconnect policy stops queueing for the slow consumer", func(t *testing.T) {
+		member := pkg.NewMember("slow", nil, pkg.DefaultConfig())
+		member.Overflow = pkg.OverflowDisconnect
+
+		for i := 0; i < pkg.DefaultConfig().SendQueueSize; i++ {
+			member.Send([]byte(fmt.Sprint(i)))
+		}
+		assert.False(t, member.Send([]byte("overflow")), "A slow consumer should not get more messages queued")
+		assert.Equal(t, int64(1), member.Dropped())
+	})
+}
@@ -0,0 +1,222 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"websocket-server.com/pkg"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func rateLimited(limit string) int64 {
+	return int64(pkg.RateLimited.Value(limit))
+}
+
+func TestTokenBucket(t *testing.T) {
+	bucket := pkg.NewTokenBucket(10, 2)
+	assert.True(t, bucket.Allow(1))
+	assert.True(t, bucket.Allow(1))
+	assert.False(t, bucket.Allow(1), "The burst should be used up")
+
+	wait := bucket.Reserve(1)
+	assert.InDelta(t, 100*time.Millisecond, wait, float64(20*time.Millisecond), "One token should take a tenth of a second")
+
+	var disabled *pkg.TokenBucket = pkg.NewTokenBucket(0, 0)
+	assert.True(t, disabled.Allow(1000), "A bucket without a rate should allow everything")
+}
+
+func TestRateLimits(t *testing.T) {
+
+	newServer := func(config *pkg.Config) string {
+		rooms := pkg.NewRooms(config)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pkg.ServerRoom(rooms, w, r)
+		}))
+		t.Cleanup(server.Close)
+		return "ws" + strings.TrimPrefix(server.URL, "http")
+	}
+	connect := func(t *testing.T, url string) *websocket.Conn {
+		conn := getV1WebSocketConnection(t, url)
+		readEnvelope(t, conn) // ignore the welcome message
+		return conn
+	}
+
+	t.Run("Test messages over the member limit are dropped with a nack", func(t *testing.T) {
+		config := pkg.DefaultConfig()
+		config.MemberMessageRate, config.MemberMessageBurst = 0.1, 2
+		conn := connect(t, newServer(config))
+		defer conn.Close()
+		before := rateLimited("member_messages")
+
+		for _, id := range []string{"b-1", "b-2"} {
+			conn.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, ID: id, Payload: "hello"})
+			assert.Equal(t, pkg.TypeBroadcast, readEnvelope(t, conn)["type"])
+			assert.Equal(t, pkg.TypeAck, readEnvelope(t, conn)["type"])
+		}
+		conn.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, ID: "b-3", Payload: "hello"})
+		nack := readEnvelope(t, conn)
+		assert.Equal(t, pkg.TypeNack, nack["type"])
+		assert.Equal(t, "b-3", nack["id"])
+		assert.Equal(t, pkg.CodeRateLimited, nack["code"])
+		assert.Equal(t, before+1, rateLimited("member_messages"))
+	})
+
+	t.Run("Test invalid messages count against the limit and are not answered once over it", func(t *testing.T) {
+		config := pkg.DefaultConfig()
+		config.MemberMessageRate, config.MemberMessageBurst = 0.1, 2
+		conn := connect(t, newServer(config))
+		defer conn.Close()
+		before := rateLimited("member_messages")
+
+		for range 10 {
+			conn.WriteMessage(websocket.TextMessage, []byte("not json"))
+		}
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		replies := 0
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				break
+			}
+			replies++
+		}
+		assert.Equal(t, 3, replies, "Only the messages within the burst and the first one over it should be answered")
+		assert.Equal(t, before+8, rateLimited("member_messages"))
+	})
+
+	t.Run("Test a message refused by one limit doesn't use up the others", func(t *testing.T) {
+		config := pkg.DefaultConfig()
+		config.MemberMessageRate, config.MemberMessageBurst = 0.1, 2
+		config.MemberByteRate, config.MemberByteBurst = 0.1, 200
+		conn := connect(t, newServer(config))
+		defer conn.Close()
+
+		conn.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeWhoami, ID: "w-1", Payload: strings.Repeat("x", 300)})
+		nack := readEnvelope(t, conn)
+		assert.Equal(t, pkg.CodeRateLimited, nack["code"])
+		assert.Equal(t, "w-1", nack["id"])
+		for _, id := range []string{"w-2", "w-3"} {
+			conn.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeWhoami, ID: id})
+			assert.Equal(t, pkg.TypeWhoami, readEnvelope(t, conn)["type"], "The refused message should not count against the message limit")
+		}
+	})
+
+	t.Run("Test members over the limit are disconnected when configured", func(t *testing.T) {
+		config := pkg.DefaultConfig()
+		config.MemberByteRate, config.MemberByteBurst = 1, config.MaxPayloadSize
+		config.RateLimitAction = pkg.RateLimitDisconnect
+		conn := connect(t, newServer(config))
+		defer conn.Close()
+
+		payload := strings.Repeat("x", config.MaxPayloadSize/2)
+		for i := 0; i < 3; i++ {
+			conn.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeWhoami, Payload: payload})
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			_, _, err := conn.ReadMessage()
+			if err != nil {
+				assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), "The member should be disconnected but got %v", err)
+				break
+			}
+		}
+	})
+
+	t.Run("Test messages over the limit are delayed when throttling", func(t *testing.T) {
+		config := pkg.DefaultConfig()
+		config.MemberMessageRate, config.MemberMessageBurst = 10, 1
+		config.RateLimitAction = pkg.RateLimitThrottle
+		conn := connect(t, newServer(config))
+		defer conn.Close()
+
+		start := time.Now()
+		for i := 0; i < 4; i++ {
+			conn.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeWhoami})
+		}
+		for i := 0; i < 4; i++ {
+			assert.Equal(t, pkg.TypeWhoami, readEnvelope(t, conn)["type"], "Throttled messages should not be dropped")
+		}
+		assert.GreaterOrEqual(t, time.Since(start), 250*time.Millisecond, "Three messages over the burst should take three tenths of a second")
+	})
+
+	t.Run("Test broadcasts over the room cap are dropped", func(t *testing.T) {
+		config := pkg.DefaultConfig()
+		config.RoomBroadcastRate, config.RoomBroadcastBurst = 0.1, 1
+		url := newServer(config)
+		first := connect(t, url)
+		defer first.Close()
+		second := connect(t, url)
+		defer second.Close()
+
+		first.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, ID: "f-1", Payload: "hello"})
+		assert.Equal(t, pkg.TypeBroadcast, readEnvelope(t, second)["type"])
+
+		second.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, ID: "s-1", Payload: "hello"})
+		nack := readEnvelope(t, second)
+		assert.Equal(t, pkg.TypeNack, nack["type"], "The room cap is shared by all the members")
+		assert.Equal(t, pkg.CodeRateLimited, nack["code"])
+	})
+
+	t.Run("Test the room cap is not held against the members", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "keys.yaml")
+		os.WriteFile(path, []byte("key-of-reader: {subject: reader, roles: [read-only]}\nkey-of-alice: alice\n"), 0o600)
+		authenticator, err := pkg.LoadAPIKeyAuthenticator(path)
+		assert.NoError(t, err)
+		config := pkg.DefaultConfig()
+		config.RoomBroadcastRate, config.RoomBroadcastBurst = 0.1, 1
+		config.RateLimitAction = pkg.RateLimitDisconnect
+		rooms := pkg.NewRooms(config)
+		rooms.Authenticator = authenticator
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pkg.ServerRoom(rooms, w, r)
+		}))
+		defer server.Close()
+		dial := func(key string) *websocket.Conn {
+			dialer := websocket.Dialer{Subprotocols: []string{pkg.SUBPROTOCOL_V1}}
+			conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), http.Header{"X-API-Key": {key}})
+			if err != nil {
+				t.Fatalf("could not connect with %s %v", key, err)
+			}
+			readEnvelope(t, conn)
+			return conn
+		}
+		reader := dial("key-of-reader")
+		defer reader.Close()
+		alice := dial("key-of-alice")
+		defer alice.Close()
+
+		reader.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, ID: "r-1", Payload: "hello"})
+		assert.Equal(t, pkg.CodeForbidden, readEnvelope(t, reader)["code"])
+		alice.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, ID: "a-1", Payload: "hello"})
+		assert.Equal(t, pkg.TypeBroadcast, readEnvelope(t, alice)["type"], "Refused broadcasts should not use up the room cap")
+		assert.Equal(t, pkg.TypeAck, readEnvelope(t, alice)["type"])
+
+		alice.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, ID: "a-2", Payload: "hello again"})
+		nack := readEnvelope(t, alice)
+		assert.Equal(t, pkg.TypeNack, nack["type"])
+		assert.Equal(t, pkg.CodeRateLimited, nack["code"])
+		alice.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeWhoami})
+		assert.Equal(t, pkg.TypeWhoami, readEnvelope(t, alice)["type"], "The room cap should not disconnect anybody")
+	})
+
+	t.Run("Test upgrades over the per IP limit are refused", func(t *testing.T) {
+		config := pkg.DefaultConfig()
+		config.UpgradeRate, config.UpgradeBurst = 0.1, 2
+		url := newServer(config)
+		before := rateLimited("upgrades")
+
+		for i := 0; i < 2; i++ {
+			connect(t, url).Close()
+		}
+		_, response, err := websocket.DefaultDialer.Dial(url, nil)
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusTooManyRequests, response.StatusCode)
+		assert.Equal(t, before+1, rateLimited("upgrades"))
+	})
+}
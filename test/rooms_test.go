@@ -0,0 +1,106 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"websocket-server.com/pkg"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRooms(t *testing.T) {
+
+	newRoomServer := func(rooms *pkg.Rooms) string {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/pingpong", func(w http.ResponseWriter, r *http.Request) {
+			pkg.ServerRoom(rooms, w, r)
+		})
+		mux.HandleFunc("/rooms/{name}/ws", func(w http.ResponseWriter, r *http.Request) {
+			pkg.ServerRoom(rooms, w, r)
+		})
+		server := httptest.NewServer(mux)
+		t.Cleanup(server.Close)
+		return "ws" + strings.TrimPrefix(server.URL, "http")
+	}
+
+	t.Run("Test rooms are created lazily and isolated from each other", func(t *testing.T) {
+		rooms := pkg.NewRooms(pkg.DefaultConfig())
+		url := newRoomServer(rooms)
+
+		trading := getWebSocketConnection(t, url+"/rooms/trading-desk/ws")
+		defer drop(trading)
+		trading.ReadMessage() // ignore the welcome message
+
+		lobby := getWebSocketConnection(t, url+"/pingpong")
+		defer drop(lobby)
+		lobby.ReadMessage() // ignore the welcome message
+
+		assert.Equal(t, []string{pkg.DefaultConfig().DefaultRoom, "trading-desk"}, rooms.Names())
+
+		broadcast, _ := json.Marshal(pkg.Chat{ID: "-1", Message: "only for traders"})
+		trading.WriteMessage(websocket.TextMessage, broadcast)
+		_, message, _ := trading.ReadMessage()
+		assert.Equal(t, "only for traders", string(message))
+
+		lobby.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		_, _, err := lobby.ReadMessage()
+		assert.Error(t, err, "A broadcast in one room must not reach members of another room")
+	})
+
+	t.Run("Test a member can join and leave rooms over one socket", func(t *testing.T) {
+		rooms := pkg.NewRooms(pkg.DefaultConfig())
+		url := newRoomServer(rooms)
+
+		lobby := getWebSocketConnection(t, url+"/pingpong")
+		defer drop(lobby)
+		lobby.ReadMessage() // ignore the welcome message
+
+		trading := getWebSocketConnection(t, url+"/pingpong?room=trading-desk")
+		defer drop(trading)
+		trading.ReadMessage() // ignore the welcome message
+
+		join, _ := json.Marshal(pkg.Chat{ID: "-2", Room: "trading-desk"})
+		lobby.WriteMessage(websocket.TextMessage, join)
+		_, welcome, _ := lobby.ReadMessage()
+		assert.True(t, strings.HasPrefix(string(welcome), "Welcome!"), "Joining a room should send the welcome message of that room")
+
+		broadcast, _ := json.Marshal(pkg.Chat{ID: "-1", Message: "hello traders"})
+		trading.WriteMessage(websocket.TextMessage, broadcast)
+		_, message, _ := lobby.ReadMessage()
+		assert.Equal(t, "hello traders", string(message))
+		trading.ReadMessage() // the sender receives its own broadcast
+
+		leave, _ := json.Marshal(pkg.Chat{ID: "-3", Room: "trading-desk"})
+		lobby.WriteMessage(websocket.TextMessage, leave)
+		time.Sleep(100 * time.Millisecond)
+
+		trading.WriteMessage(websocket.TextMessage, broadcast)
+		trading.ReadMessage() // the sender receives its own broadcast
+		lobby.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		_, _, err := lobby.ReadMessage()
+		assert.Error(t, err, "A member that left a room must not receive its broadcasts")
+	})
+
+	t.Run("Test empty rooms are torn down after the idle timeout", func(t *testing.T) {
+		config := pkg.DefaultConfig()
+		config.RoomIdleTimeout = 200 * time.Millisecond
+		rooms := pkg.NewRooms(config)
+		url := newRoomServer(rooms)
+
+		connection := getWebSocketConnection(t, url+"/rooms/ephemeral/ws")
+		connection.ReadMessage() // ignore the welcome message
+		_, ok := rooms.Lookup("ephemeral")
+		assert.True(t, ok, "The room should exist while it has members")
+
+		drop(connection)
+		time.Sleep(500 * time.Millisecond)
+		_, ok = rooms.Lookup("ephemeral")
+		assert.False(t, ok, "The room should be torn down once it has been empty for the idle timeout")
+	})
+}
@@ -0,0 +1,131 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"websocket-server.com/pkg"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionResumption(t *testing.T) {
+
+	newServer := func(t *testing.T, grace time.Duration) (*pkg.Rooms, string) {
+		config := pkg.DefaultConfig()
+		config.ResumeGrace = grace
+		rooms := pkg.NewRooms(config)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pkg.ServerRoom(rooms, w, r)
+		}))
+		t.Cleanup(server.Close)
+		return rooms, "ws" + strings.TrimPrefix(server.URL, "http")
+	}
+	welcome := func(t *testing.T, conn *websocket.Conn) map[string]any {
+		envelope := readEnvelope(t, conn)
+		assert.Equal(t, pkg.TypeWelcome, envelope["type"])
+		return envelope["payload"].(map[string]any)
+	}
+	// join joins the room and returns the payload of its welcome message, which can come before or after the ack
+	join := func(t *testing.T, conn *websocket.Conn, room string) map[string]any {
+		conn.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeJoin, ID: "join-1", Room: room})
+		var payload map[string]any
+		for range 2 {
+			if envelope := readEnvelope(t, conn); envelope["type"] == pkg.TypeWelcome {
+				payload = envelope["payload"].(map[string]any)
+			}
+		}
+		return payload
+	}
+	// cut drops the connection without a close frame, the way a flaky network does
+	cut := func(t *testing.T, rooms *pkg.Rooms, conn *websocket.Conn, connections int) {
+		conn.UnderlyingConn().Close()
+		assert.Eventually(t, func() bool { return rooms.Connections() == connections }, time.Second, 10*time.Millisecond)
+	}
+
+	t.Run("Test there are no resume tokens without a resume grace", func(t *testing.T) {
+		_, url := newServer(t, 0)
+		conn := getV1WebSocketConnection(t, url)
+		defer conn.Close()
+		assert.NotContains(t, welcome(t, conn), "resume_token")
+	})
+
+	t.Run("Test a dropped member resumes its ID and rooms and gets what it missed", func(t *testing.T) {
+		rooms, url := newServer(t, 5*time.Second)
+		alice := getV1WebSocketConnection(t, url)
+		payload := welcome(t, alice)
+		aliceID, token := payload["id"].(string), payload["resume_token"].(string)
+		assert.NotEmpty(t, token)
+		join(t, alice, "side")
+
+		bob := getV1WebSocketConnection(t, url)
+		defer bob.Close()
+		bobID := welcome(t, bob)["id"]
+		join(t, bob, "side")
+
+		bob.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, Payload: "one"})
+		readEnvelope(t, bob) // ignore our own broadcast
+		lastSeq := uint64(readEnvelope(t, alice)["seq"].(float64))
+		cut(t, rooms, alice, 1)
+
+		bob.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, Payload: "two"})
+		readEnvelope(t, bob) // ignore our own broadcast
+		bob.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeDM, ID: "dm-1", To: aliceID, Payload: "three"})
+		assert.Equal(t, pkg.TypeAck, readEnvelope(t, bob)["type"], "DMs to a parked member should be kept")
+		bob.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, Room: "side", Payload: "four"})
+		readEnvelope(t, bob) // ignore our own broadcast
+
+		alice = getV1WebSocketConnection(t, url+"?resume="+token+"&last_seq="+strconv.FormatUint(lastSeq, 10))
+		defer alice.Close()
+		payload = welcome(t, alice)
+		assert.Equal(t, aliceID, payload["id"])
+		assert.Equal(t, true, payload["resumed"])
+		assert.NotEqual(t, token, payload["resume_token"], "Every connection should get a new token")
+		assert.Equal(t, "two", readEnvelope(t, alice)["payload"])
+		dm := readEnvelope(t, alice)
+		assert.Equal(t, pkg.TypeDM, dm["type"])
+		assert.Equal(t, "three", dm["payload"])
+
+		payload = welcome(t, alice)
+		assert.Equal(t, []any{bobID}, payload["members"], "The other rooms should be rejoined")
+		assert.Equal(t, "four", readEnvelope(t, alice)["payload"])
+
+		bob.WriteJSON(pkg.Envelope{V: 1, Type: pkg.TypeBroadcast, Room: "side", Payload: "five"})
+		assert.Equal(t, "five", readEnvelope(t, alice)["payload"])
+
+		conn := getV1WebSocketConnection(t, url+"?resume="+token)
+		defer conn.Close()
+		payload = welcome(t, conn)
+		assert.NotEqual(t, aliceID, payload["id"], "A token should only resume a session once")
+		assert.NotContains(t, payload, "resumed")
+	})
+
+	t.Run("Test a parked member leaves its rooms once the grace is over", func(t *testing.T) {
+		rooms, url := newServer(t, 100*time.Millisecond)
+		conn := getV1WebSocketConnection(t, url)
+		payload := welcome(t, conn)
+		group, _ := rooms.Lookup(pkg.DefaultConfig().DefaultRoom)
+		cut(t, rooms, conn, 0)
+		assert.True(t, group.Has(payload["id"].(string)), "The member should stay in the room during the grace")
+		assert.Eventually(t, func() bool { return !group.Has(payload["id"].(string)) }, time.Second, 10*time.Millisecond)
+
+		conn = getV1WebSocketConnection(t, url+"?resume="+payload["resume_token"].(string))
+		defer conn.Close()
+		assert.NotEqual(t, payload["id"], welcome(t, conn)["id"])
+	})
+
+	t.Run("Test members that close the connection themselves are not parked", func(t *testing.T) {
+		rooms, url := newServer(t, 5*time.Second)
+		conn := getV1WebSocketConnection(t, url)
+		payload := welcome(t, conn)
+		group, _ := rooms.Lookup(pkg.DefaultConfig().DefaultRoom)
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		assert.Eventually(t, func() bool { return !group.Has(payload["id"].(string)) }, time.Second, 10*time.Millisecond)
+		conn.Close()
+	})
+}
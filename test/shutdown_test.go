@@ -0,0 +1,96 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"websocket-server.com/pkg"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdown(t *testing.T) {
+
+	expectGoingAway := func(t *testing.T, conn *websocket.Conn, reason string) {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, _, err := conn.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "The member should be closed with CloseGoingAway but got %v", err)
+		if closeErr, ok := err.(*websocket.CloseError); ok {
+			assert.Equal(t, reason, closeErr.Text)
+		}
+	}
+
+	t.Run("Test stopping a group flushes the queued messages before going away", func(t *testing.T) {
+		config := pkg.DefaultConfig()
+		config.ShutdownReason = "see you later"
+		group := pkg.NewGroup(config)
+		go group.Create()
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pkg.ServerPingPong(group, w, r)
+		}))
+		defer server.Close()
+		url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+		conn := getWebSocketConnection(t, url)
+		defer conn.Close()
+		conn.ReadMessage() // ignore the welcome message
+
+		broadcast, _ := json.Marshal(pkg.Chat{ID: "-1", Message: "last words"})
+		conn.WriteMessage(websocket.TextMessage, broadcast)
+		time.Sleep(100 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.NoError(t, group.Stop(ctx))
+
+		_, message, err := conn.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, "last words", string(message), "Pending messages should be flushed before the close frame")
+		expectGoingAway(t, conn, "see you later")
+		assert.Equal(t, 0, group.Count())
+
+		_, response, err := websocket.DefaultDialer.Dial(url, nil)
+		assert.Error(t, err, "A stopped group should not accept new members")
+		if response != nil {
+			assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode)
+		}
+	})
+
+	t.Run("Test stopping the rooms closes every room and rejects new upgrades", func(t *testing.T) {
+		rooms := pkg.NewRooms(pkg.DefaultConfig())
+		mux := http.NewServeMux()
+		mux.HandleFunc("/rooms/{name}/ws", func(w http.ResponseWriter, r *http.Request) {
+			pkg.ServerRoom(rooms, w, r)
+		})
+		server := httptest.NewServer(mux)
+		defer server.Close()
+		url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+		first := getWebSocketConnection(t, url+"/rooms/first/ws")
+		defer first.Close()
+		first.ReadMessage() // ignore the welcome message
+		second := getWebSocketConnection(t, url+"/rooms/second/ws")
+		defer second.Close()
+		second.ReadMessage() // ignore the welcome message
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.NoError(t, rooms.Stop(ctx))
+
+		expectGoingAway(t, first, pkg.DefaultConfig().ShutdownReason)
+		expectGoingAway(t, second, pkg.DefaultConfig().ShutdownReason)
+		assert.Empty(t, rooms.Names(), "Stopped rooms should be removed from the registry")
+
+		_, response, err := websocket.DefaultDialer.Dial(url+"/rooms/first/ws", nil)
+		assert.Error(t, err, "A stopping registry should not accept new members")
+		if response != nil {
+			assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode)
+		}
+	})
+}